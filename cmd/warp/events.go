@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zulfikawr/warp/internal/discovery"
+	"github.com/zulfikawr/warp/internal/server"
+)
+
+// jsonOutput is set by the global --json flag: stdout then carries only
+// newline-delimited JSON events, and text meant for people goes to stderr.
+var jsonOutput bool
+
+// startedEvent announces a server. It carries what the human output shows:
+// the code of a code share, else its URL and token.
+type startedEvent struct {
+	Event string `json:"event"` // server-started
+	Mode  string `json:"mode"`  // send or host
+	URL   string `json:"url,omitempty"`
+	Token string `json:"token,omitempty"`
+	Code  string `json:"code,omitempty"`
+	Port  int    `json:"port"`
+}
+
+// transferEvent is a peer-connected, progress or completed event of one
+// transfer. Servers name the peer and payload; receive names where the
+// payload went, or carries a text share itself.
+type transferEvent struct {
+	Event     string  `json:"event"`
+	Peer      string  `json:"peer,omitempty"`
+	UserAgent string  `json:"user_agent,omitempty"`
+	Name      string  `json:"name,omitempty"`
+	Upload    bool    `json:"upload,omitempty"`
+	Bytes     int64   `json:"bytes"`
+	Size      int64   `json:"size"` // -1 when unknown
+	Rate      float64 `json:"rate"` // bytes per second
+	Path      string  `json:"path,omitempty"`
+	Text      *string `json:"text,omitempty"`
+}
+
+// searchEvent completes a search with the services found.
+type searchEvent struct {
+	Event string       `json:"event"` // completed
+	Hosts []hostResult `json:"hosts"`
+}
+
+type hostResult struct {
+	Name      string `json:"name"`
+	Mode      string `json:"mode"`
+	URL       string `json:"url,omitempty"` // left out for code shares
+	Nameplate string `json:"nameplate,omitempty"`
+	FileName  string `json:"file,omitempty"`
+	Size      int64  `json:"size,omitempty"`
+	Hostname  string `json:"hostname,omitempty"`
+	IP        string `json:"ip"`
+	Port      int    `json:"port"`
+}
+
+type errorEvent struct {
+	Event   string `json:"event"` // error
+	Message string `json:"message"`
+}
+
+var emitMu sync.Mutex
+
+// emit writes ev to stdout as one line of JSON.
+func emit(ev any) {
+	emitMu.Lock()
+	defer emitMu.Unlock()
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(ev); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// fatal reports an error, as an event too under --json, and exits.
+func fatal(v ...any) {
+	if jsonOutput {
+		emit(errorEvent{Event: "error", Message: fmt.Sprint(v...)})
+	}
+	log.Fatal(v...)
+}
+
+func fatalf(format string, v ...any) {
+	fatal(fmt.Sprintf(format, v...))
+}
+
+// hostResults lists discovered services for a search event.
+func hostResults(services []discovery.Service) []hostResult {
+	out := make([]hostResult, 0, len(services))
+	for _, svc := range services {
+		h := hostResult{
+			Name: svc.Name, Mode: svc.Mode, Nameplate: svc.Nameplate, FileName: svc.FileName,
+			Hostname: svc.Hostname, IP: svc.IP.String(), Port: svc.Port,
+		}
+		if svc.Nameplate == "" {
+			h.URL = svc.URL
+		}
+		if svc.FileName != "" {
+			h.Size = svc.Size
+		}
+		out = append(out, h)
+	}
+	return out
+}
+
+// progressInterval spaces out the progress events of one transfer.
+const progressInterval = time.Second
+
+// jsonProgress turns a receive's progress into progress events and passes
+// the text written to it, such as item names, on to stderr. A text share is
+// kept for the completed event.
+type jsonProgress struct {
+	mu          sync.Mutex
+	read, total int64
+	rate        float64
+	last        time.Time
+	text        strings.Builder
+}
+
+func (p *jsonProgress) Write(b []byte) (int, error) {
+	return os.Stderr.Write(b)
+}
+
+func (p *jsonProgress) TextOutput() io.Writer { return &p.text }
+
+func (p *jsonProgress) ReportProgress(read, total int64, elapsed time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.read, p.total = read, total
+	if s := elapsed.Seconds(); s > 0 {
+		p.rate = float64(read) / s
+	}
+	if read != total && time.Since(p.last) < progressInterval {
+		return
+	}
+	p.last = time.Now()
+	emit(p.event("progress"))
+}
+
+// event reports the progress so far as an event of kind.
+func (p *jsonProgress) event(kind string) transferEvent {
+	return transferEvent{Event: kind, Bytes: p.read, Size: p.total, Rate: p.rate}
+}
+
+// reportTransfers emits events for srv's transfers until the returned func
+// is called: peer-connected when a peer starts one, progress while it moves
+// and completed once it has all arrived.
+func reportTransfers(srv *server.Server) (stop func()) {
+	type key struct {
+		peer, agent, name string
+		upload            bool
+	}
+	seen := make(map[key]server.Transfer)
+	scan := func() {
+		for _, t := range srv.Transfers() {
+			k := key{t.Peer, t.UserAgent, t.Name, t.Upload}
+			old, ok := seen[k]
+			seen[k] = t
+			ev := transferEvent{
+				Peer: t.Peer, UserAgent: t.UserAgent, Name: t.Name, Upload: t.Upload,
+				Bytes: t.Bytes, Size: t.Size, Rate: t.Rate(),
+			}
+			if !ok {
+				ev.Event = "peer-connected"
+				emit(ev)
+			}
+			switch {
+			case t.Done && !old.Done:
+				ev.Event = "completed"
+			case t.Active && t.Moved != old.Moved:
+				ev.Event = "progress"
+			default:
+				continue
+			}
+			emit(ev)
+		}
+	}
+	quit, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		t := time.NewTicker(progressInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-quit:
+				scan()
+				return
+			case <-t.C:
+				scan()
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		<-stopped
+	}
+}
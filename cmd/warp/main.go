@@ -1,17 +1,24 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/zulfikawr/warp/internal/client"
 	"github.com/zulfikawr/warp/internal/crypto"
 	"github.com/zulfikawr/warp/internal/discovery"
+	"github.com/zulfikawr/warp/internal/protocol"
 	"github.com/zulfikawr/warp/internal/server"
 	"github.com/zulfikawr/warp/internal/ui"
 )
@@ -43,7 +50,7 @@ func setColorsEnabled(enabled bool) {
 func filterGlobalFlags(args []string) []string {
 	out := make([]string, 0, len(args))
 	for _, a := range args {
-		if a == "--no-color" {
+		if a == "--no-color" || a == "--json" {
 			continue
 		}
 		out = append(out, a)
@@ -56,12 +63,17 @@ func main() {
 	// Determine color usage from env and global flag
 	enableColors := os.Getenv("NO_COLOR") == ""
 	for _, a := range os.Args[1:] {
-		if a == "--no-color" {
+		switch a {
+		case "--no-color":
 			enableColors = false
-			break
+		case "--json":
+			jsonOutput = true
 		}
 	}
 	setColorsEnabled(enableColors)
+	if jsonOutput {
+		console = os.Stderr
+	}
 	if len(os.Args) < 2 {
 		usage()
 		os.Exit(2)
@@ -74,6 +86,8 @@ func main() {
 		hostCmd(filterGlobalFlags(os.Args[2:]))
 	case "receive":
 		receiveCmd(filterGlobalFlags(os.Args[2:]))
+	case "push":
+		pushCmd(filterGlobalFlags(os.Args[2:]))
 	case "search":
 		searchCmd(filterGlobalFlags(os.Args[2:]))
 	case "-h", "--help":
@@ -95,11 +109,12 @@ func usage() {
 	fmt.Println()
 
 	fmt.Println(cBold + "Usage:" + cReset)
-	fmt.Println("  " + cGreen + "warp send" + cReset + " [flags] <path>")
+	fmt.Println("  " + cGreen + "warp send" + cReset + " [flags] <path>...")
 	fmt.Println("  " + cGreen + "warp send" + cReset + " --text <text>")
 	fmt.Println("  " + cGreen + "warp send" + cReset + " --stdin < file")
 	fmt.Println("  " + cGreen + "warp host" + cReset + " [flags]")
-	fmt.Println("  " + cGreen + "warp receive" + cReset + " [flags] <url>")
+	fmt.Println("  " + cGreen + "warp receive" + cReset + " [flags] [url|code]")
+	fmt.Println("  " + cGreen + "warp push" + cReset + " [url] <path>...")
 	fmt.Println("  " + cGreen + "warp search" + cReset + " [flags]")
 	fmt.Println()
 
@@ -110,26 +125,40 @@ func usage() {
 	fmt.Println("\t" + cYellow + "--text string" + cReset + "     send a text snippet instead of a file")
 	fmt.Println("\t" + cYellow + "--stdin" + cReset + "           read text from stdin")
 	fmt.Println("\t" + cYellow + "--no-qr" + cReset + "           skip printing the QR code")
+	fmt.Println("\t" + cYellow + "--tls" + cReset + "             serve HTTPS with a pinned self-signed certificate")
+	fmt.Println("\t" + cYellow + "-e, --encrypt" + cReset + "     encrypt the payload end to end")
+	fmt.Println("\t" + cYellow + "-c, --code" + cReset + "        share a short code like 7-crossword-pumpkin")
 	fmt.Println()
 	fmt.Println("  " + cMagenta + "host" + cReset + "  Receive uploads into a directory you control")
 	fmt.Println("\t" + cYellow + "-i, --interface" + cReset + "   bind to a specific network interface")
 	fmt.Println("\t" + cYellow + "-d, --dest" + cReset + "        destination directory for uploads (default .)")
 	fmt.Println("\t" + cYellow + "--no-qr" + cReset + "           skip printing the QR code")
+	fmt.Println("\t" + cYellow + "--tls" + cReset + "             serve HTTPS with a pinned self-signed certificate")
 	fmt.Println()
-	fmt.Println("  " + cMagenta + "receive" + cReset + "  Download from a warp URL")
+	fmt.Println("  " + cMagenta + "receive" + cReset + "  Download from a warp URL or code")
 	fmt.Println("\t" + cYellow + "-o, --output" + cReset + "      write to a specific file or directory")
 	fmt.Println("\t" + cYellow + "-f, --force" + cReset + "       overwrite existing files")
 	fmt.Println()
+	fmt.Println("  " + cMagenta + "push" + cReset + "     Upload files to a warp host")
+	fmt.Println()
 	fmt.Println("  " + cMagenta + "search" + cReset + "   Discover nearby warp hosts via mDNS")
 	fmt.Println("\t" + cYellow + "--timeout" + cReset + "          duration to wait for discovery (default 3s)")
 	fmt.Println()
+	fmt.Println(cBold + "Global flags:" + cReset)
+	fmt.Println("  " + cYellow + "--json" + cReset + "      print newline-delimited JSON events on stdout (server-started, peer-connected,")
+	fmt.Println("              progress, completed, error) and human output on stderr")
+	fmt.Println("  " + cYellow + "--no-color" + cReset + "  disable colors")
+	fmt.Println()
 
 	fmt.Println(cBold + "Examples:" + cReset)
 	fmt.Println("  " + cGreen + "warp send" + cReset + " ./photo.jpg " + cDim + "		    # Share a file" + cReset)
 	fmt.Println("  " + cGreen + "warp send" + cReset + " --text \"hello\" " + cDim + "	            # Share text" + cReset)
 	fmt.Println("  " + cGreen + "warp host" + cReset + " -d uploads " + cDim + "		            # Save uploads to dir" + cReset)
+	fmt.Println("  " + cGreen + "warp push" + cReset + " http://hostname:port/u/<token> build.tar " + cDim + "# Upload" + cReset)
 	fmt.Println("  " + cGreen + "warp search" + cReset + " " + cDim + "				    # Discover hosts" + cReset)
 	fmt.Println("  " + cGreen + "warp receive" + cReset + " http://hostname:port/<token> " + cDim + "# Download" + cReset)
+	fmt.Println("  " + cGreen + "warp receive" + cReset + " 7-crossword-pumpkin " + cDim + "	    # Download by code" + cReset)
+	fmt.Println("  " + cGreen + "warp send" + cReset + " --json ./build.tar | jq -r 'select(.event == \"server-started\").url'")
 	fmt.Println()
 	fmt.Println(cDim + "Use \"warp <command> -h\" for command-specific help." + cReset)
 }
@@ -138,28 +167,50 @@ func sendHelp() {
 	fmt.Println(cBold + cGreen + "warp send" + cReset + " - Share a file, directory, or text snippet")
 	fmt.Println()
 	fmt.Println(cBold + "Usage:" + cReset)
-	fmt.Println("  " + cGreen + "warp send" + cReset + " [flags] <path>")
+	fmt.Println("  " + cGreen + "warp send" + cReset + " [flags] <path>...")
 	fmt.Println("  " + cGreen + "warp send" + cReset + " --text <text>")
 	fmt.Println("  " + cGreen + "warp send" + cReset + " --stdin < file")
 	fmt.Println()
 	fmt.Println(cBold + "Description:" + cReset)
 	fmt.Println("  Start a server and share a file, directory, or text with another device.")
 	fmt.Println("  The recipient can download using the generated URL or token.")
+	fmt.Println("  Several paths are shared together behind an index, with a zip of everything.")
+	fmt.Println("  Browsers get directories as uncompressed zips that show progress and resume.")
+	fmt.Println("  On a terminal, a live table shows each receiver's progress, rate and ETA.")
 	fmt.Println()
 	fmt.Println(cBold + "Flags:" + cReset)
 	fmt.Println("  " + cYellow + "-p, --port" + cReset + "        choose specific port (default: random)")
 	fmt.Println("  " + cYellow + "-i, --interface" + cReset + "   bind to a specific network interface")
+	fmt.Println("  " + cYellow + "--bind addr" + cReset + "       listen on this IP instead (0.0.0.0 or :: for every interface)")
 	fmt.Println("  " + cYellow + "--text string" + cReset + "     send a text snippet instead of a file")
 	fmt.Println("  " + cYellow + "--stdin" + cReset + "           read text content from stdin")
 	fmt.Println("  " + cYellow + "--no-qr" + cReset + "           skip printing the QR code")
+	fmt.Println("  " + cYellow + "--tls" + cReset + "             serve HTTPS with a pinned self-signed certificate")
+	fmt.Println("  " + cYellow + "-e, --encrypt" + cReset + "     encrypt the payload end to end (key stays in the URL fragment)")
+	fmt.Println("  " + cYellow + "-c, --code" + cReset + "        share a short code instead of a URL (implies --encrypt;")
+	fmt.Println("                    one attempt per code, a wrong guess stops the share)")
+	fmt.Println("  " + cYellow + "--format fmt" + cReset + "      default archive for directories: zip, tar, tgz or zst (default: zip)")
+	fmt.Println("  " + cYellow + "--symlinks how" + cReset + "    symlinks in directories: preserve, follow or skip (default: preserve)")
+	fmt.Println("  " + cYellow + "--exclude pat" + cReset + "     leave out directory entries matching a gitignore-style pattern (repeatable)")
+	fmt.Println("  " + cYellow + "--include pat" + cReset + "     send only directory entries matching a pattern (repeatable)")
+	fmt.Println("  " + cYellow + "--gitignore" + cReset + "       honour .gitignore files and leave out .git")
+	fmt.Println("  " + cYellow + "--once" + cReset + "            stop after the first complete download")
+	fmt.Println("  " + cYellow + "--max-downloads n" + cReset + " stop after n complete downloads (resumes count once)")
+	fmt.Println("  " + cYellow + "--expire dur" + cReset + "      stop after a duration such as 10m or 2h")
 	fmt.Println("  " + cYellow + "-v, --verbose" + cReset + "     verbose logging")
 	fmt.Println()
 	fmt.Println(cBold + "Examples:" + cReset)
 	fmt.Println("  " + cGreen + "warp send" + cReset + " ./photo.jpg              " + cDim + "# Share a file" + cReset)
 	fmt.Println("  " + cGreen + "warp send" + cReset + " ./documents/             " + cDim + "# Share a directory" + cReset)
+	fmt.Println("  " + cGreen + "warp send" + cReset + " a.log b.log ./conf       " + cDim + "# Share several paths" + cReset)
 	fmt.Println("  " + cGreen + "warp send" + cReset + " --text \"hello world\"     " + cDim + "# Share text" + cReset)
 	fmt.Println("  echo \"hello\" | " + cGreen + "warp send" + cReset + " --stdin   " + cDim + "# Read from stdin" + cReset)
 	fmt.Println("  " + cGreen + "warp send" + cReset + " -p 8080 ./file.zip       " + cDim + "# Use specific port" + cReset)
+	fmt.Println("  " + cGreen + "warp send" + cReset + " -e ./customers.csv       " + cDim + "# Encrypt end to end" + cReset)
+	fmt.Println("  " + cGreen + "warp send" + cReset + " -c ./report.pdf          " + cDim + "# Share with a short code" + cReset)
+	fmt.Println("  " + cGreen + "warp send" + cReset + " --once -e ./secret.env   " + cDim + "# One download, then the share closes" + cReset)
+	fmt.Println("  " + cGreen + "warp send" + cReset + " --gitignore ./project    " + cDim + "# Send a checkout without build output" + cReset)
+	fmt.Println("  " + cGreen + "warp send" + cReset + " --exclude node_modules --include '*.go' ./src")
 }
 
 func hostHelp() {
@@ -171,32 +222,47 @@ func hostHelp() {
 	fmt.Println(cBold + "Description:" + cReset)
 	fmt.Println("  Start an upload server and receive files from other devices.")
 	fmt.Println("  Uploaded files are saved to the specified directory.")
+	fmt.Println("  On a terminal, a live table shows uploads in progress.")
 	fmt.Println()
 	fmt.Println(cBold + "Flags:" + cReset)
+	fmt.Println("  " + cYellow + "-p, --port" + cReset + "        choose specific port (default: random)")
 	fmt.Println("  " + cYellow + "-i, --interface" + cReset + "   bind to a specific network interface")
+	fmt.Println("  " + cYellow + "--bind addr" + cReset + "       listen on this IP instead (0.0.0.0 or :: for every interface)")
 	fmt.Println("  " + cYellow + "-d, --dest" + cReset + "        destination directory for uploads (default: .)")
 	fmt.Println("  " + cYellow + "--no-qr" + cReset + "           skip printing the QR code")
+	fmt.Println("  " + cYellow + "--tls" + cReset + "             serve HTTPS with a pinned self-signed certificate")
 	fmt.Println("  " + cYellow + "-v, --verbose" + cReset + "     verbose logging")
 	fmt.Println()
 	fmt.Println(cBold + "Examples:" + cReset)
 	fmt.Println("  " + cGreen + "warp host" + cReset + "                          " + cDim + "# Accept uploads to current directory" + cReset)
 	fmt.Println("  " + cGreen + "warp host" + cReset + " -d ./uploads             " + cDim + "# Save uploads to ./uploads" + cReset)
 	fmt.Println("  " + cGreen + "warp host" + cReset + " -d ./downloads -i eth0   " + cDim + "# Bind to specific interface" + cReset)
+	fmt.Println("  " + cGreen + "warp host" + cReset + " -p 8443 --bind 0.0.0.0   " + cDim + "# Fixed port on every interface" + cReset)
 }
 
 func receiveHelp() {
-	fmt.Println(cBold + cGreen + "warp receive" + cReset + " - Download from a warp URL")
+	fmt.Println(cBold + cGreen + "warp receive" + cReset + " - Download from a warp URL or code")
 	fmt.Println()
 	fmt.Println(cBold + "Usage:" + cReset)
-	fmt.Println("  " + cGreen + "warp receive" + cReset + " [flags] <url>")
+	fmt.Println("  " + cGreen + "warp receive" + cReset + " [flags] [url|code]")
 	fmt.Println()
 	fmt.Println(cBold + "Description:" + cReset)
 	fmt.Println("  Connect to a warp server and download the shared file or text.")
+	fmt.Println("  A short code such as 7-crossword-pumpkin is resolved via mDNS.")
+	fmt.Println("  Without a URL or code, nearby senders are listed to pick from.")
 	fmt.Println("  Downloaded files are saved to the current directory or specified path.")
+	fmt.Println("  Files arrive as name.warp-partial and get their name once complete;")
+	fmt.Println("  rerun an interrupted download to resume it.")
+	fmt.Println("  Multi-item shares are saved into the output directory, one entry per item.")
+	fmt.Println("  Directories are recreated file by file; rerun to resume an interrupted one.")
 	fmt.Println("  Text content is printed to stdout by default.")
+	fmt.Println("  With -o -, any payload streams to stdout for piping: files and text as they")
+	fmt.Println("  are, directories and multi-item shares as one archive. Progress goes to")
+	fmt.Println("  stderr, and only when it is a terminal.")
 	fmt.Println()
 	fmt.Println(cBold + "Flags:" + cReset)
-	fmt.Println("  " + cYellow + "-o, --output" + cReset + "      write to a specific file or directory")
+	fmt.Println("  " + cYellow + "-o, --output" + cReset + "      write to a specific file or directory (- for stdout)")
+	fmt.Println("  " + cYellow + "--format fmt" + cReset + "      take a directory as one zip, tar, tgz or zst archive")
 	fmt.Println("  " + cYellow + "-f, --force" + cReset + "       overwrite existing files without prompting")
 	fmt.Println("  " + cYellow + "-v, --verbose" + cReset + "     verbose logging")
 	fmt.Println()
@@ -205,6 +271,30 @@ func receiveHelp() {
 	fmt.Println("  " + cGreen + "warp receive" + cReset + " http://host:port/d/token -o myfile.zip  " + cDim + "# Save with custom name" + cReset)
 	fmt.Println("  " + cGreen + "warp receive" + cReset + " http://host:port/d/token -d downloads   " + cDim + "# Save to directory" + cReset)
 	fmt.Println("  " + cGreen + "warp receive" + cReset + " http://host:port/t/token                " + cDim + "# Print text to stdout" + cReset)
+	fmt.Println("  " + cGreen + "warp receive" + cReset + " 7-crossword-pumpkin                     " + cDim + "# Download by code" + cReset)
+	fmt.Println("  " + cGreen + "warp receive" + cReset + " -o - <url> | sha256sum                  " + cDim + "# Stream a file into another command" + cReset)
+	fmt.Println("  " + cGreen + "warp receive" + cReset + " --format tar -o - <url> | tar x         " + cDim + "# Unpack a directory, modes intact" + cReset)
+	fmt.Println("  " + cGreen + "warp receive" + cReset + "                                         " + cDim + "# Pick a nearby sender" + cReset)
+}
+
+func pushHelp() {
+	fmt.Println(cBold + cGreen + "warp push" + cReset + " - Upload files to a warp host")
+	fmt.Println()
+	fmt.Println(cBold + "Usage:" + cReset)
+	fmt.Println("  " + cGreen + "warp push" + cReset + " [url] <path>...")
+	fmt.Println()
+	fmt.Println(cBold + "Description:" + cReset)
+	fmt.Println("  Upload files to the URL printed by \"warp host\", without a browser.")
+	fmt.Println("  Without a URL, pick one of the hosts found on the local network.")
+	fmt.Println("  Files go up in parallel chunks sized by the host, each checked by its")
+	fmt.Println("  SHA-256. Chunks lost to network drops are retried for up to two minutes.")
+	fmt.Println("  The host keeps what arrived, so re-running an interrupted push sends only")
+	fmt.Println("  the missing parts; files appear on the host once they are complete.")
+	fmt.Println()
+	fmt.Println(cBold + "Examples:" + cReset)
+	fmt.Println("  " + cGreen + "warp push" + cReset + " http://host:port/u/token ./dist/app.tar.gz   " + cDim + "# Upload one file" + cReset)
+	fmt.Println("  " + cGreen + "warp push" + cReset + " http://host:port/u/token *.log               " + cDim + "# Upload several" + cReset)
+	fmt.Println("  " + cGreen + "warp push" + cReset + " ./scan.pdf                                   " + cDim + "# Upload to a nearby host" + cReset)
 }
 
 func searchHelp() {
@@ -232,53 +322,136 @@ func sendCmd(args []string) {
 	port := fs.Int("port", 0, "specific port")
 	fs.IntVar(port, "p", 0, "")
 	noQR := fs.Bool("no-qr", false, "disable QR")
+	useTLS := fs.Bool("tls", false, "serve HTTPS")
 	iface := fs.String("interface", "", "network interface")
 	fs.StringVar(iface, "i", "", "")
+	bind := fs.String("bind", "", "IP address to listen on")
 	text := fs.String("text", "", "send text instead of file")
 	stdin := fs.Bool("stdin", false, "read from stdin")
+	encrypt := fs.Bool("encrypt", false, "encrypt the payload end to end")
+	fs.BoolVar(encrypt, "e", false, "")
+	useCode := fs.Bool("code", false, "share a short code")
+	fs.BoolVar(useCode, "c", false, "")
+	format := fs.String("format", protocol.FormatZip, "default archive format for directories")
+	symlinks := fs.String("symlinks", server.SymlinksPreserve, "preserve, follow or skip symlinks in directories")
+	var exclude, include patternList
+	fs.Var(&exclude, "exclude", "leave out directory entries matching a pattern")
+	fs.Var(&include, "include", "send only directory entries matching a pattern")
+	gitignore := fs.Bool("gitignore", false, "honour .gitignore files")
+	once := fs.Bool("once", false, "stop after the first complete download")
+	maxDownloads := fs.Int("max-downloads", 0, "stop after this many complete downloads")
+	expire := fs.Duration("expire", 0, "stop after this long")
 	verbose := fs.Bool("verbose", false, "verbose logging")
 	fs.BoolVar(verbose, "v", false, "")
 	fs.Parse(args)
+	if _, ok := protocol.ArchiveMediaTypes[*format]; !ok {
+		fatalf("unknown archive format %q: use zip, tar, tgz or zst", *format)
+	}
+	switch *symlinks {
+	case server.SymlinksPreserve, server.SymlinksFollow, server.SymlinksSkip:
+	default:
+		fatalf("unknown symlink policy %q: use preserve, follow or skip", *symlinks)
+	}
+	if *maxDownloads < 0 || *expire < 0 {
+		fatal("--max-downloads and --expire must not be negative")
+	}
+	if *once {
+		*maxDownloads = 1
+	}
 
 	tok, err := crypto.GenerateToken(nil)
-	if err != nil { log.Fatal(err) }
+	if err != nil { fatal(err) }
+
+	// Receivers trade the code for the token and key via PAKE, so the
+	// payload is always encrypted in code mode
+	var code string
+	if *useCode {
+		if code, err = crypto.GenerateCode(nil); err != nil { fatal(err) }
+		*encrypt = true
+	}
+
+	// With encryption, only the first half of the token goes into the URL
+	// path; the second half stays in the fragment and keys the payload.
+	pathTok, secret := tok, ""
+	if *encrypt {
+		pathTok, secret = crypto.SplitToken(tok)
+	}
 
 	var srv *server.Server
 
 	// Handle text sharing
 	if *text != "" {
-		srv = &server.Server{InterfaceName: *iface, Token: tok, TextContent: *text}
+		srv = &server.Server{InterfaceName: *iface, Token: pathTok, Secret: secret, Code: code, TLS: *useTLS, TextContent: *text}
 	} else if *stdin {
 		// Read from stdin
 		data, err := io.ReadAll(os.Stdin)
-		if err != nil { log.Fatal(err) }
-		srv = &server.Server{InterfaceName: *iface, Token: tok, TextContent: string(data)}
+		if err != nil { fatal(err) }
+		srv = &server.Server{InterfaceName: *iface, Token: pathTok, Secret: secret, Code: code, TLS: *useTLS, TextContent: string(data)}
 	} else {
 		// Handle file/directory
 		if fs.NArg() < 1 {
-			log.Fatal("send requires a path, --text, or --stdin")
+			fatal("send requires a path, --text, or --stdin")
 		}
 		path := fs.Arg(0)
-		srv = &server.Server{InterfaceName: *iface, Token: tok, SrcPath: path}
+		srv = &server.Server{InterfaceName: *iface, Token: pathTok, Secret: secret, Code: code, TLS: *useTLS, SrcPath: path, SrcPaths: fs.Args()[1:]}
 	}
+	srv.Port, srv.ListenAddr = *port, *bind
+	srv.ArchiveFormat, srv.Symlinks = *format, *symlinks
+	srv.Exclude, srv.Include, srv.GitIgnore = exclude, include, *gitignore
+	srv.MaxDownloads, srv.Expire = *maxDownloads, *expire
 
 	url, err := srv.Start()
-	if err != nil { log.Fatal(err) }
+	if err != nil { fatal(err) }
 	defer srv.Shutdown()
 
 	// Display what we're serving
 	if srv.TextContent != "" {
-		fmt.Printf("> Serving text (%d bytes)\n", len(srv.TextContent))
+		fmt.Fprintf(console, "> Serving text (%d bytes)\n", len(srv.TextContent))
+	} else if len(srv.SrcPaths) > 0 {
+		fmt.Fprintf(console, "> Serving %d items: '%s'\n", len(srv.SrcPaths)+1, strings.Join(fs.Args(), "', '"))
+	} else {
+		fmt.Fprintf(console, "> Serving '%s'\n", srv.SrcPath)
+	}
+	if code != "" {
+		fmt.Fprintf(console, "> Code: %s\n", code)
 	} else {
-		fmt.Printf("> Serving '%s'\n", srv.SrcPath)
+		fmt.Fprintf(console, "> Token: %s\n", tok)
+	}
+	if srv.Secret != "" {
+		fmt.Fprintln(console, "> Encrypted: aes-256-gcm (key is in the URL fragment)")
+	}
+	if srv.MaxDownloads > 0 {
+		fmt.Fprintf(console, "> Closes after %d download(s)\n", srv.MaxDownloads)
 	}
-	fmt.Printf("> Token: %s\n\n", tok)
+	if srv.Expire > 0 {
+		fmt.Fprintf(console, "> Expires in %s\n", srv.Expire)
+	}
+	fmt.Fprintln(console)
 
 	if !*noQR {
-		_ = ui.PrintQR(url)
+		_ = ui.FprintQR(console, url)
+	}
+	if code != "" {
+		fmt.Fprintf(console, "On the other device run: warp receive %s\n", code)
+	} else {
+		fmt.Fprintf(console, "Or run: warp receive %s\n", url)
+	}
+	if jsonOutput {
+		ev := startedEvent{Event: "server-started", Mode: "send", Code: code, Port: srv.Port}
+		if code == "" {
+			ev.URL, ev.Token = url, tok
+		}
+		emit(ev)
+	}
+	stopDashboard := showTransfers(srv)
+	awaitShutdown(srv)
+	stopDashboard()
+	switch err := srv.Err(); {
+	case errors.Is(err, server.ErrDownloadLimit), errors.Is(err, server.ErrExpired):
+		fmt.Fprintf(console, "> %s\n", err)
+	case err != nil:
+		fatal(err)
 	}
-	fmt.Printf("Or run: warp receive %s\n", url)
-	select {} // block until interrupted
 }
 
 func receiveCmd(args []string) {
@@ -288,53 +461,307 @@ func receiveCmd(args []string) {
 	fs.StringVar(out, "o", "", "")
 	force := fs.Bool("force", false, "overwrite existing")
 	fs.BoolVar(force, "f", false, "")
+	format := fs.String("format", "", "archive format for directories")
 	verbose := fs.Bool("verbose", false, "verbose logging")
 	fs.BoolVar(verbose, "v", false, "")
 	fs.Parse(args)
+	if jsonOutput && *out == "-" {
+		fatal("--json can't be combined with -o -: the payload would mix with the events on stdout")
+	}
+	if *out == "-" {
+		// Stdout carries the payload, so picking a sender happens on stderr
+		console = os.Stderr
+	}
+	var url string
 	if fs.NArg() < 1 {
-		log.Fatal("receive requires a URL")
-	}
-	url := fs.Arg(0)
-	file, err := client.Receive(url, *out, *force, os.Stdout)
-	if err != nil { log.Fatal(err) }
-	if file == "(stdout)" {
-		// Text was output to stdout, just print newline
-		fmt.Println()
+		picked, err := pickSender(bufio.NewReader(os.Stdin))
+		if err != nil { fatal(err) }
+		url = picked
+	} else {
+		url = fs.Arg(0)
+	}
+	if !strings.Contains(url, "://") {
+		resolved, err := client.ResolveCode(context.Background(), url, 3*time.Second)
+		if err != nil { fatal(err) }
+		url = resolved
+	}
+	// Progress stays off stdout, which may carry the payload, and is drawn
+	// only for someone watching
+	var progress io.Writer
+	if isTerminal(os.Stderr) {
+		progress = os.Stderr
+	}
+	// Under --json, text shares end up in the completed event
+	var events *jsonProgress
+	if jsonOutput {
+		events = new(jsonProgress)
+		progress = events
+	}
+	var file string
+	var err error
+	if *format != "" {
+		file, err = client.ReceiveArchive(url, *format, *out, *force, progress)
 	} else {
-		fmt.Printf("\nSaved to %s\n", file)
+		file, err = client.Receive(url, *out, *force, progress)
+	}
+	if err != nil { fatal(err) }
+	if jsonOutput {
+		ev := events.event("completed")
+		if file == "(stdout)" {
+			t := events.text.String()
+			ev.Text = &t
+			ev.Bytes, ev.Size = int64(len(t)), int64(len(t))
+		} else {
+			ev.Path = file
+		}
+		emit(ev)
+		return
+	}
+	if progress != nil {
+		// End the progress bar's line, or the text's
+		fmt.Fprintln(progress)
+	}
+	if file != "(stdout)" {
+		fmt.Fprintf(console, "Saved to %s\n", file)
 	}
 }
 
+// pickSender lists the senders found via mDNS and returns the URL (or, for
+// code-protected senders, the code-unlocked URL) of the one the user picks.
+func pickSender(in *bufio.Reader) (string, error) {
+	svc, err := pickService(in, "send", "sender")
+	if err != nil { return "", err }
+	if svc.Nameplate == "" {
+		return svc.URL, nil
+	}
+	code, err := ui.Ask(in, console, "Code (starts with "+svc.Nameplate+"-)")
+	if err != nil { return "", err }
+	return client.ExchangeCode(svc.URL, code)
+}
+
+// pickService browses mDNS for services in mode and lets the user choose one.
+func pickService(in *bufio.Reader, mode, what string) (discovery.Service, error) {
+	fmt.Fprintf(console, "Looking for nearby %ss...\n", what)
+	services, err := discovery.Browse(context.Background(), 3*time.Second)
+	if err != nil { return discovery.Service{}, err }
+	var found []discovery.Service
+	var options []string
+	for _, svc := range services {
+		if svc.Mode != mode {
+			continue
+		}
+		found = append(found, svc)
+		options = append(options, describeService(svc))
+	}
+	if len(found) == 0 {
+		return discovery.Service{}, fmt.Errorf("no %ss found on this network", what)
+	}
+	i, err := ui.Pick(in, console, "Pick a "+what, options)
+	if err != nil { return discovery.Service{}, err }
+	return found[i], nil
+}
+
+// describeService formats a discovered service as one picker line.
+func describeService(svc discovery.Service) string {
+	var parts []string
+	switch {
+	case svc.FileName != "":
+		parts = append(parts, svc.FileName)
+		if svc.Size >= 0 {
+			parts = append(parts, cDim+"("+ui.FormatBytes(svc.Size)+")"+cReset)
+		}
+	case svc.Mode == "send":
+		parts = append(parts, cDim+"(encrypted share)"+cReset)
+	}
+	from := svc.Hostname
+	if from == "" {
+		from = svc.IP.String()
+	}
+	parts = append(parts, "from "+cGreen+from+cReset)
+	if svc.Nameplate != "" {
+		parts = append(parts, cYellow+"code "+svc.Nameplate+"-..."+cReset)
+	}
+	return strings.Join(parts, " ")
+}
+
+// patternList collects the patterns of a repeatable flag.
+type patternList []string
+
+func (l *patternList) String() string     { return strings.Join(*l, ",") }
+func (l *patternList) Set(v string) error { *l = append(*l, v); return nil }
+
+func pushCmd(args []string) {
+	fs := flag.NewFlagSet("push", flag.ExitOnError)
+	fs.Usage = pushHelp
+	fs.Parse(args)
+	// Without a URL, the files go to a host picked from the network
+	url, paths := fs.Arg(0), fs.Args()
+	if strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") {
+		paths = paths[1:]
+	} else {
+		url = ""
+	}
+	if len(paths) == 0 {
+		fatal("push requires at least one file")
+	}
+	name := url
+	if url == "" {
+		svc, err := pickService(bufio.NewReader(os.Stdin), "host", "host")
+		if err != nil { fatal(err) }
+		url, name = svc.URL, svc.Name
+	}
+	for _, p := range paths {
+		fmt.Fprintf(console, "%s\n", filepath.Base(p))
+		if err := client.Upload(url, p, console); err != nil { fatal(err) }
+		fmt.Fprintln(console)
+	}
+	fmt.Fprintf(console, "Uploaded %d file(s) to %s\n", len(paths), name)
+}
+
 func hostCmd(args []string) {
 	fs := flag.NewFlagSet("host", flag.ExitOnError)
 	fs.Usage = hostHelp
+	port := fs.Int("port", 0, "specific port")
+	fs.IntVar(port, "p", 0, "")
 	iface := fs.String("interface", "", "network interface")
 	fs.StringVar(iface, "i", "", "")
+	bind := fs.String("bind", "", "IP address to listen on")
 	dest := fs.String("dest", ".", "destination directory for uploads")
 	fs.StringVar(dest, "d", ".", "")
 	noQR := fs.Bool("no-qr", false, "disable QR")
+	useTLS := fs.Bool("tls", false, "serve HTTPS")
 	verbose := fs.Bool("verbose", false, "verbose logging")
 	fs.BoolVar(verbose, "v", false, "")
 	fs.Parse(args)
 
 	// Ensure destination exists
 	if err := os.MkdirAll(*dest, 0o755); err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 
 	tok, err := crypto.GenerateToken(nil)
-	if err != nil { log.Fatal(err) }
-	srv := &server.Server{InterfaceName: *iface, Token: tok, HostMode: true, UploadDir: *dest}
+	if err != nil { fatal(err) }
+	srv := &server.Server{InterfaceName: *iface, Port: *port, ListenAddr: *bind, Token: tok, HostMode: true, UploadDir: *dest, TLS: *useTLS}
 	url, err := srv.Start()
-	if err != nil { log.Fatal(err) }
+	if err != nil { fatal(err) }
 	defer srv.Shutdown()
 
-	fmt.Printf("> Hosting uploads to '%s'\n> Token: %s\n\n", *dest, tok)
+	fmt.Fprintf(console, "> Hosting uploads to '%s'\n> Token: %s\n\n", *dest, tok)
 	if !*noQR {
-		_ = ui.PrintQR(url)
+		_ = ui.FprintQR(console, url)
+	}
+	fmt.Fprintf(console, "Open this on another device to upload:\n%s\n", url)
+	fmt.Fprintf(console, "Or run: warp push %s <files>\n", url)
+	if jsonOutput {
+		emit(startedEvent{Event: "server-started", Mode: "host", URL: url, Token: tok, Port: srv.Port})
+	}
+	stopDashboard := showTransfers(srv)
+	awaitShutdown(srv)
+	stopDashboard()
+}
+
+// console is where commands print for people: stdout, or stderr under
+// --json, or the dashboard while one is on screen.
+var console io.Writer = os.Stdout
+
+// showTransfers keeps a live table of srv's transfers at the bottom of the
+// terminal, with log output scrolling above it, until the returned func is
+// called. Under --json the table goes to stderr and transfers are reported
+// as events too. Off a terminal there is no table.
+func showTransfers(srv *server.Server) (stop func()) {
+	stopEvents := func() {}
+	if jsonOutput {
+		stopEvents = reportTransfers(srv)
+	}
+	term, prev := os.Stdout, console
+	if jsonOutput {
+		term = os.Stderr
+	}
+	if !isTerminal(term) {
+		return stopEvents
+	}
+	dash := ui.NewDashboard(term)
+	console = dash
+	log.SetOutput(dash)
+	quit, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		t := time.NewTicker(500 * time.Millisecond)
+		defer t.Stop()
+		for {
+			dash.Update(transferRows(srv.Transfers()))
+			select {
+			case <-quit:
+				return
+			case <-t.C:
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		<-stopped
+		dash.Update(transferRows(srv.Transfers()))
+		log.SetOutput(os.Stderr)
+		console = prev
+		stopEvents()
+	}
+}
+
+// transferRows lays transfers out for a dashboard.
+func transferRows(ts []server.Transfer) []ui.Row {
+	rows := make([]ui.Row, len(ts))
+	for i, t := range ts {
+		state := "idle"
+		switch {
+		case t.Active && t.Upload:
+			state = "receiving"
+		case t.Active:
+			state = "sending"
+		case t.Done:
+			state = "done"
+		case t.Failed:
+			state = "broken off"
+		}
+		rows[i] = ui.Row{
+			Peer: t.Peer, Agent: t.UserAgent, Name: t.Name, Upload: t.Upload,
+			Bytes: t.Bytes, Size: t.Size, Rate: t.Rate(), ETA: t.ETA(), State: state,
+		}
+	}
+	return rows
+}
+
+// isTerminal reports whether f is a terminal rather than a pipe or file.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// drainTimeout is how long an interrupted server waits for transfers in
+// flight.
+const drainTimeout = 30 * time.Second
+
+// awaitShutdown blocks until srv stops itself or SIGINT or SIGTERM arrives.
+// A signal withdraws the mDNS advertisement and lets transfers in flight
+// finish for up to drainTimeout; a second one exits at once.
+func awaitShutdown(srv *server.Server) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	select {
+	case <-srv.Done():
+		return
+	case <-sigs:
+	}
+	fmt.Fprintf(console, "\n> Stopping: waiting up to %s for transfers in progress (press Ctrl-C again to quit now)\n", drainTimeout)
+	go func() {
+		<-sigs
+		os.Exit(1)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := srv.Drain(ctx); err != nil {
+		fmt.Fprintln(console, "> Transfers still in progress were cut off")
 	}
-	fmt.Printf("Open this on another device to upload:\n%s\n", url)
-	select {}
 }
 
 func searchCmd(args []string) {
@@ -345,16 +772,24 @@ func searchCmd(args []string) {
 
 	services, err := discovery.Browse(context.Background(), *timeout)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
+	}
+	if jsonOutput {
+		emit(searchEvent{Event: "completed", Hosts: hostResults(services)})
+		return
 	}
 
 	if len(services) == 0 {
-		fmt.Println("No warp hosts found")
+		fmt.Fprintln(console, "No warp hosts found")
 		return
 	}
 
-	fmt.Println("Discovered hosts:")
+	fmt.Fprintln(console, "Discovered hosts:")
 	for _, svc := range services {
-		fmt.Printf("- %s [%s] %s\n", svc.Name, svc.Mode, svc.URL)
+		if svc.Nameplate != "" {
+			fmt.Fprintf(console, "- %s [%s] code %s-...\n", svc.Name, svc.Mode, svc.Nameplate)
+			continue
+		}
+		fmt.Fprintf(console, "- %s [%s] %s\n", svc.Name, svc.Mode, svc.URL)
 	}
 }
@@ -4,6 +4,7 @@ go 1.25.4
 
 require (
 	github.com/grandcat/zeroconf v1.0.0
+	github.com/klauspost/compress v1.17.11
 	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 )
 
@@ -0,0 +1,131 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/zulfikawr/warp/internal/crypto"
+	"github.com/zulfikawr/warp/internal/discovery"
+	"github.com/zulfikawr/warp/internal/protocol"
+)
+
+// ErrWrongCode is returned when the sender rejected the code.
+var ErrWrongCode = errors.New("the sender rejected the code")
+
+// ResolveCode finds the sender advertising the code's nameplate via mDNS,
+// authenticates with the code via PAKE and returns the full download URL,
+// including the fragment key, for Receive.
+func ResolveCode(ctx context.Context, code string, timeout time.Duration) (string, error) {
+	code, nameplate, err := crypto.ParseCode(code)
+	if err != nil {
+		return "", err
+	}
+
+	services, err := discovery.Browse(ctx, timeout)
+	if err != nil {
+		return "", err
+	}
+	var matches []discovery.Service
+	for _, svc := range services {
+		if svc.Mode == "send" && svc.Nameplate == nameplate {
+			matches = append(matches, svc)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no sender found for code %s on this network", code)
+	case 1:
+	default:
+		// Trying the code against the wrong sender would burn its code
+		return "", fmt.Errorf("%d senders share nameplate %s; ask for the URL instead", len(matches), nameplate)
+	}
+	return ExchangeCode(matches[0].URL, code)
+}
+
+// ExchangeCode runs the PAKE exchange against the sender at rawURL (any URL
+// on the sender; only scheme, host and a pinned fingerprint are used) and
+// returns the download URL it unlocks.
+func ExchangeCode(rawURL, code string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	hc, err := newHTTPClient(rawURL)
+	if err != nil {
+		return "", err
+	}
+	frag, err := fragmentParams(rawURL)
+	if err != nil {
+		return "", err
+	}
+	pinned := strings.ToLower(frag.Get(protocol.FingerprintFragment))
+	// String re-escapes the zone of a link-local host
+	base := (&url.URL{Scheme: u.Scheme, Host: u.Host}).String()
+
+	p, err := crypto.NewPAKE(crypto.RoleClient, code, nil)
+	if err != nil {
+		return "", err
+	}
+	var reply protocol.PakeReply
+	if err := postJSON(hc, base+protocol.PakePathPrefix+"start", protocol.PakeStart{Msg: p.Message()}, &reply); err != nil {
+		return "", err
+	}
+	key, err := p.Finish(reply.Msg)
+	if err != nil {
+		return "", err
+	}
+
+	var grant protocol.PakeGrant
+	confirm := protocol.PakeConfirm{ID: reply.ID, MAC: crypto.ConfirmMAC(key, crypto.RoleClient)}
+	if err := postJSON(hc, base+protocol.PakePathPrefix+"confirm", confirm, &grant); err != nil {
+		return "", err
+	}
+	plain, err := crypto.OpenBox(key, grant.Box)
+	if err != nil {
+		return "", errors.New("sender failed to authenticate the exchange")
+	}
+	var ticket protocol.PakeTicket
+	if err := json.Unmarshal(plain, &ticket); err != nil {
+		return "", err
+	}
+	// The fingerprint in the ticket is authenticated by the code; the one
+	// from mDNS that the exchange ran over is not.
+	if pinned != "" && ticket.Fingerprint != pinned {
+		return "", errors.New("sender certificate changed during the exchange")
+	}
+	frag = url.Values{}
+	frag.Set(protocol.KeyFragment, ticket.Secret)
+	if ticket.Fingerprint != "" {
+		frag.Set(protocol.FingerprintFragment, ticket.Fingerprint)
+	}
+	return base + protocol.PathPrefix + ticket.Token + "#" + frag.Encode(), nil
+}
+
+func postJSON(hc *http.Client, url string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	resp, err := hc.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusForbidden:
+		return ErrWrongCode
+	case http.StatusConflict:
+		return errors.New("this code was already used; ask the sender for a new one")
+	default:
+		return fmt.Errorf("http status %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,260 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// partialSuffix marks a file still being received. It is renamed to its
+// final name only once complete and verified.
+const partialSuffix = ".warp-partial"
+
+// partialMeta is kept beside a partial file and says what it is part of,
+// and which bytes of it have been written. The file's size proves nothing:
+// parallel ranges are written in place into a file grown to full size.
+type partialMeta struct {
+	URL      string     `json:"url"` // without the fragment, which holds the key
+	ETag     string     `json:"etag,omitempty"`
+	Size     int64      `json:"size"`
+	Received [][2]int64 `json:"received,omitempty"` // half-open ranges, sorted and merged
+}
+
+// resumes reports whether a partial file described by m is part of the
+// payload described by want. Only the sender's strong ETag ties them
+// together; dates are too coarse to tell a replaced file apart.
+func (m partialMeta) resumes(want partialMeta) bool {
+	switch {
+	case m.Size != want.Size || want.Size <= 0 || m.ETag == "":
+		return false
+	case want.ETag != "":
+		return m.ETag == want.ETag
+	default:
+		// The sender checks it through If-Range
+		return true
+	}
+}
+
+// partial is an open partial file and how much of it can be resumed:
+// start is where its received prefix ends. Writes through it are recorded
+// in its metadata.
+type partial struct {
+	*os.File
+	dest  string
+	start int64
+
+	mu        sync.Mutex // guards meta and saved
+	meta      partialMeta
+	saved     time.Time
+	committed bool
+}
+
+// partialSaveInterval spaces out metadata writes while bytes arrive. A
+// crash loses at most that much of the record, never claiming bytes that
+// were not written.
+const partialSaveInterval = 250 * time.Millisecond
+
+func (p *partial) path() string     { return p.dest + partialSuffix }
+func (p *partial) metaPath() string { return p.dest + partialSuffix + ".json" }
+
+// openPartial opens the partial file for dest. Its bytes are kept only when
+// its metadata describes the same payload as want: the same size and the
+// same ETag. A want without an ETag keeps a partial that has one; the sender
+// checks it through If-Range. A partial without an ETag starts over.
+func openPartial(dest string, want partialMeta) (*partial, error) {
+	want.URL = stripFragment(want.URL)
+	p := &partial{dest: dest, meta: want}
+	var err error
+	if p.File, err = os.OpenFile(p.path(), os.O_RDWR|os.O_CREATE, 0o600); err != nil {
+		return nil, err
+	}
+	var old partialMeta
+	if b, err := os.ReadFile(p.metaPath()); err == nil && json.Unmarshal(b, &old) == nil && old.resumes(want) {
+		fi, err := p.Stat()
+		if err == nil {
+			// Ranges past the end of the file were never written after all
+			old.Received = cutRanges(old.Received, fi.Size(), -1)
+			start := int64(0)
+			if len(old.Received) > 0 && old.Received[0][0] == 0 {
+				start = old.Received[0][1]
+			}
+			if _, err := p.Seek(start, io.SeekStart); err == nil {
+				p.meta, p.start = old, start
+				return p, nil
+			}
+		}
+	}
+	if err := p.restart(); err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// restart discards the partial file's bytes and records p.meta for it.
+func (p *partial) restart() error {
+	p.start = 0
+	if err := p.Truncate(0); err != nil { return err }
+	if _, err := p.Seek(0, io.SeekStart); err != nil { return err }
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.meta.Received = nil
+	return p.writeMeta()
+}
+
+// setETag records the ETag the sender served the bytes with.
+func (p *partial) setETag(h http.Header) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if etag := h.Get("ETag"); etag != p.meta.ETag {
+		p.meta.ETag = etag
+		return p.writeMeta()
+	}
+	return nil
+}
+
+// Write appends b at the file offset, recording what was written.
+func (p *partial) Write(b []byte) (int, error) {
+	off, err := p.Seek(0, io.SeekCurrent)
+	if err != nil { return 0, err }
+	n, err := p.File.Write(b)
+	p.received(off, int64(n))
+	return n, err
+}
+
+// ReadFrom copies r in through Write, as the file's own ReadFrom would
+// bypass the record.
+func (p *partial) ReadFrom(r io.Reader) (int64, error) {
+	return io.CopyBuffer(struct{ io.Writer }{p}, r, make([]byte, 1<<20))
+}
+
+// WriteAt writes b at off, recording what was written.
+func (p *partial) WriteAt(b []byte, off int64) (int, error) {
+	n, err := p.File.WriteAt(b, off)
+	p.received(off, int64(n))
+	return n, err
+}
+
+// received records that [off, off+n) was written, saving the record now
+// and then.
+func (p *partial) received(off, n int64) {
+	if n <= 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.meta.Received = addRange(p.meta.Received, off, off+n)
+	if time.Since(p.saved) >= partialSaveInterval {
+		_ = p.writeMeta()
+	}
+}
+
+// missing returns the inclusive byte ranges of the payload not yet written.
+func (p *partial) missing() [][2]int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var gaps [][2]int64
+	var pos int64
+	for _, r := range p.meta.Received {
+		if r[0] > pos {
+			gaps = append(gaps, [2]int64{pos, r[0] - 1})
+		}
+		pos = r[1]
+	}
+	if pos < p.meta.Size {
+		gaps = append(gaps, [2]int64{pos, p.meta.Size - 1})
+	}
+	return gaps
+}
+
+// writeMeta saves p.meta. p.mu is held.
+func (p *partial) writeMeta() error {
+	b, _ := json.Marshal(p.meta)
+	p.saved = time.Now()
+	return os.WriteFile(p.metaPath(), b, 0o600)
+}
+
+// Close saves the record of what was written and closes the file.
+func (p *partial) Close() error {
+	if p.committed {
+		return nil
+	}
+	p.mu.Lock()
+	err := p.writeMeta()
+	p.mu.Unlock()
+	if cerr := p.File.Close(); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// verify checks the partial file against the sender's digest. The ranges
+// of a corrupt file are forgotten, so the next run re-fetches just them.
+func (p *partial) verify(hc *http.Client, key []byte, rawURL string) error {
+	err := verifyFile(hc, key, rawURL, p.path())
+	var ce *CorruptError
+	if errors.As(err, &ce) && len(ce.Ranges) > 0 {
+		p.mu.Lock()
+		for _, r := range ce.Ranges {
+			p.meta.Received = cutRanges(p.meta.Received, r[0], r[1]+1)
+		}
+		_ = p.writeMeta()
+		p.mu.Unlock()
+	}
+	return err
+}
+
+// commit moves the complete partial file to its final name.
+func (p *partial) commit() error {
+	if err := p.File.Close(); err != nil { return err }
+	if err := os.Rename(p.path(), p.dest); err != nil { return err }
+	p.committed = true
+	os.Remove(p.metaPath())
+	return nil
+}
+
+// addRange adds [a, b) to the sorted, merged ranges rs.
+func addRange(rs [][2]int64, a, b int64) [][2]int64 {
+	rs = append(rs, [2]int64{a, b})
+	sort.Slice(rs, func(i, j int) bool { return rs[i][0] < rs[j][0] })
+	merged := rs[:1]
+	for _, r := range rs[1:] {
+		last := &merged[len(merged)-1]
+		if r[0] <= last[1] {
+			last[1] = max(last[1], r[1])
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// cutRanges removes [a, b) from the ranges rs; b < 0 means to the end.
+func cutRanges(rs [][2]int64, a, b int64) [][2]int64 {
+	var out [][2]int64
+	for _, r := range rs {
+		if r[0] < a {
+			out = append(out, [2]int64{r[0], min(r[1], a)})
+		}
+		if b >= 0 && r[1] > b {
+			out = append(out, [2]int64{max(r[0], b), r[1]})
+		}
+	}
+	return out
+}
+
+// stripFragment drops the fragment (the key and certificate pin) from rawURL.
+func stripFragment(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	u.Fragment, u.RawFragment = "", ""
+	return u.String()
+}
@@ -1,46 +1,228 @@
 package client
 
 import (
+	"compress/gzip"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/zulfikawr/warp/internal/crypto"
+	"github.com/zulfikawr/warp/internal/protocol"
 )
 
 // Receive downloads from url to outputPath. If outputPath is empty, derive from headers or URL.
-// For text content (Content-Type: text/plain), outputs to stdout instead of saving to a file.
-// Supports resumable downloads via HTTP Range headers if the file already partially exists.
+// For text content (Content-Type: text/plain), outputs to stdout instead of saving to a file,
+// or to the TextOutput of a progress writer that is a TextReceiver.
+// Files are received into outputPath.warp-partial and renamed once complete; an interrupted
+// download of the same payload resumes via HTTP Range headers. Large files are split into
+// ranges fetched over parallel connections. Received files are
+// checked against the sender's SHA-256 digest; a *CorruptError names the ranges to re-fetch.
+// Encrypted payloads are decrypted while streaming with the key carried in the URL fragment,
+// and compressible ones travel compressed.
+// Shared directories are mirrored into outputPath file by file rather than saved as a zip.
+// An outputPath of "-" streams the payload to stdout as ReceiveTo does.
 func Receive(url string, outputPath string, force bool, progress io.Writer) (string, error) {
-	// First, make a HEAD request or GET to determine filename and check for existing partial file
-	var startByte int64 = 0
-	var existingSize int64 = 0
-	
-	// Try initial request to get headers
-	resp, err := http.Get(url)
+	if outputPath == "-" {
+		if _, err := ReceiveTo(url, os.Stdout, progress); err != nil { return "", err }
+		return "(stdout)", nil
+	}
+	accept := protocol.IndexMediaType + ", " + protocol.ManifestMediaType + ", */*;q=0.8"
+	return receive(url, outputPath, accept, true, force, progress)
+}
+
+// ReceiveTo streams the payload at url into dst: a file or text as is, a
+// directory as the sender's default archive and a multi-item share as one
+// archive of everything. It returns the name the sender gave the payload,
+// "" for text. Streams can't resume; an interrupted one starts over.
+func ReceiveTo(url string, dst, progress io.Writer) (string, error) {
+	key, err := keyFromURL(url)
 	if err != nil { return "", err }
-	
+	hc, err := newHTTPClient(url)
+	if err != nil { return "", err }
+	// Multi-item shares list their items; everything streams from the
+	// index's archive URL instead
+	resp, err := open(hc, url, protocol.IndexMediaType+", */*;q=0.8", false)
+	if err != nil { return "", err }
+	defer resp.Body.Close()
+	body, err := openBody(resp, key, 0)
+	if err != nil { return "", err }
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), protocol.IndexMediaType) {
+		var idx protocol.Index
+		if err := json.NewDecoder(body).Decode(&idx); err != nil { return "", fmt.Errorf("invalid index: %w", err) }
+		allURL, err := resolveURL(url, idx.All)
+		if err != nil { return "", err }
+		return ReceiveTo(keepQuery(allURL, url), dst, progress)
+	}
+	text := isText(resp)
+	if progress != nil && !text {
+		body = &progressReader{r: body, total: payloadLength(resp), out: progress, start: time.Now()}
+	}
+	if _, err := io.CopyBuffer(dst, body, make([]byte, 1<<20)); err != nil { return "", err }
+	if text {
+		return "", nil
+	}
+	return filenameFromResponse(resp), nil
+}
+
+// ReceiveArchive downloads a shared directory (or, from a multi-item share's
+// /all URL, everything) as one archive in format, one of the protocol.Format
+// constants. An outputPath of "-" streams the archive to stdout.
+func ReceiveArchive(rawURL, format, outputPath string, force bool, progress io.Writer) (string, error) {
+	if outputPath == "-" {
+		if _, err := ReceiveArchiveTo(rawURL, format, os.Stdout, progress); err != nil { return "", err }
+		return "(stdout)", nil
+	}
+	u, err := archiveURL(rawURL, format)
+	if err != nil { return "", err }
+	// Tarballs are built as they stream and can't serve a one-byte probe;
+	// asking for one would build and deliver the whole archive
+	return receive(u, outputPath, "*/*", format == protocol.FormatZip, force, progress)
+}
+
+// ReceiveArchiveTo streams a shared directory, or everything in a multi-item
+// share, into dst as one archive in format, returning the archive's name.
+func ReceiveArchiveTo(rawURL, format string, dst, progress io.Writer) (string, error) {
+	u, err := archiveURL(rawURL, format)
+	if err != nil { return "", err }
+	return ReceiveTo(u, dst, progress)
+}
+
+// archiveURL asks for rawURL in the archive format. The format goes in the
+// URL so every request of the download agrees.
+func archiveURL(rawURL, format string) (string, error) {
+	if _, ok := protocol.ArchiveMediaTypes[format]; !ok {
+		return "", fmt.Errorf("unknown archive format %q", format)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil { return "", err }
+	q := u.Query()
+	q.Set(protocol.FormatQuery, format)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// open makes the first request of a download, asking for accept and, when
+// probe is set, only the first byte of a file. Multi-item shares answer with
+// a JSON index and directories with a manifest when asked for one.
+func open(hc *http.Client, url, accept string, probe bool) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil { return nil, err }
+	req.Header.Set("Accept", accept)
+	req.Header.Set(protocol.AcceptEncodingHeader, acceptEncoding)
+	if probe {
+		// A whole payload the receiver drops unread would count against
+		// download limits, as the sender can't tell it went unread
+		req.Header.Set("Range", "bytes=0-0")
+	}
+	resp, err := hc.Do(req)
+	if err != nil { return nil, err }
+	if resp.StatusCode == http.StatusGone {
+		resp.Body.Close()
+		return nil, errors.New("the share is no longer available: it expired or reached its download limit")
+	}
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
 		resp.Body.Close()
-		return "", fmt.Errorf("http status %d", resp.StatusCode)
+		return nil, fmt.Errorf("http status %d", resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// probedLength returns the payload size a probe response reports, or -1.
+func probedLength(resp *http.Response) int64 {
+	if resp.StatusCode == http.StatusOK {
+		return payloadLength(resp)
+	}
+	_, total, _ := strings.Cut(resp.Header.Get("Content-Range"), "/")
+	n, err := strconv.ParseInt(total, 10, 64)
+	if err != nil {
+		return -1
 	}
+	return n
+}
 
-	// Check if this is text content (text/plain without attachment disposition)
+// isText reports whether resp carries a text share (text/plain without an
+// attachment disposition).
+func isText(resp *http.Response) bool {
+	return strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") && resp.Header.Get("Content-Disposition") == ""
+}
+
+// keepQuery gives rawURL the query of from, such as an archive format.
+func keepQuery(rawURL, from string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil { return rawURL }
+	f, err := url.Parse(from)
+	if err != nil || f.RawQuery == "" { return rawURL }
+	u.RawQuery = f.RawQuery
+	return u.String()
+}
+
+// receive downloads url to outputPath. Its first request asks for one byte
+// when probe is set; otherwise its response is the download itself.
+func receive(url, outputPath, accept string, probe, force bool, progress io.Writer) (string, error) {
+	key, err := keyFromURL(url)
+	if err != nil { return "", err }
+	hc, err := newHTTPClient(url)
+	if err != nil { return "", err }
+
+	// First, make a GET request to determine the filename and size
+	resp, err := open(hc, url, accept, probe)
+	if err != nil { return "", err }
 	contentType := resp.Header.Get("Content-Type")
-	disposition := resp.Header.Get("Content-Disposition")
-	isTextContent := strings.HasPrefix(contentType, "text/plain") && disposition == ""
 
-	if isTextContent {
+	if isText(resp) {
 		// Output text to stdout
-		_, err := io.Copy(os.Stdout, resp.Body)
+		body, err := openBody(resp, key, 0)
+		if err != nil {
+			resp.Body.Close()
+			return "", err
+		}
+		out := io.Writer(os.Stdout)
+		if t, ok := progress.(TextReceiver); ok {
+			out = t.TextOutput()
+		}
+		_, err = io.Copy(out, body)
 		resp.Body.Close()
 		if err != nil { return "", err }
 		return "(stdout)", nil
 	}
 
+	if strings.HasPrefix(contentType, protocol.IndexMediaType) {
+		body, err := openBody(resp, key, 0)
+		if err != nil {
+			resp.Body.Close()
+			return "", err
+		}
+		var idx protocol.Index
+		err = json.NewDecoder(body).Decode(&idx)
+		resp.Body.Close()
+		if err != nil { return "", fmt.Errorf("invalid index: %w", err) }
+		return receiveIndex(url, idx, outputPath, force, progress)
+	}
+
+	if strings.HasPrefix(contentType, protocol.ManifestMediaType) {
+		body, err := openBody(resp, key, 0)
+		if err != nil {
+			resp.Body.Close()
+			return "", err
+		}
+		var m protocol.Manifest
+		err = json.NewDecoder(body).Decode(&m)
+		resp.Body.Close()
+		if err != nil { return "", fmt.Errorf("invalid manifest: %w", err) }
+		return receiveTree(url, m, outputPath, force, progress)
+	}
+
 	name := filenameFromResponse(resp)
 	if name == "" {
 		name = path.Base(resp.Request.URL.Path)
@@ -50,71 +232,204 @@ func Receive(url string, outputPath string, force bool, progress io.Writer) (str
 		outputPath = name
 	}
 	
-	totalSize := resp.ContentLength
-	resp.Body.Close()
+	totalSize := probedLength(resp)
+	ranged := resp.Header.Get("Accept-Ranges") == "bytes"
+	if probe {
+		resp.Body.Close()
+	} else {
+		defer resp.Body.Close()
+	}
 	
-	// Check if file already exists and can be resumed
-	var f *os.File
-	if fi, err := os.Stat(outputPath); err == nil {
-		existingSize = fi.Size()
-		if !force && existingSize > 0 && existingSize < totalSize {
-			// File exists and is incomplete - try to resume
-			startByte = existingSize
-			f, err = os.OpenFile(outputPath, os.O_WRONLY|os.O_APPEND, 0o600)
-			if err != nil { return "", err }
-		} else if !force {
-			return "", errors.New("destination exists; use --force to overwrite")
-		} else {
-			// Force overwrite
-			f, err = os.Create(outputPath)
-			if err != nil { return "", err }
+	if _, err := os.Stat(outputPath); err == nil && !force {
+		return "", errors.New("destination exists; use --force to overwrite")
+	}
+	// Bytes land in a partial file that becomes outputPath once complete;
+	// an interrupted earlier run of the same payload is resumed
+	p, err := openPartial(outputPath, partialMeta{
+		URL:  url,
+		ETag: resp.Header.Get("ETag"),
+		Size: totalSize,
+	})
+	if err != nil { return "", err }
+	defer p.Close()
+	startByte := p.start
+
+	// Large files from servers that take ranges are fetched over several
+	// connections at once
+	gaps := p.missing()
+	var left int64
+	for _, g := range gaps {
+		left += g[1] - g[0] + 1
+	}
+	if ranged && left >= 2*minSegmentSize {
+		if err := receiveSegments(hc, url, key, p, p.meta.ETag, gaps, totalSize, progress); err != nil {
+			if errors.Is(err, errPayloadChanged) {
+				// Nothing fetched so far can be trusted; the next run starts over
+				_ = p.restart()
+				return "", fmt.Errorf("%s changed on the sender during the download; run again to start over", name)
+			}
+			return "", err
 		}
-	} else {
-		// File doesn't exist - create new
-		f, err = os.Create(outputPath)
-		if err != nil { return "", err }
+		if err := p.verify(hc, key, url); err != nil { return "", err }
+		if err := p.commit(); err != nil { return "", err }
+		return outputPath, nil
 	}
-	defer f.Close()
 	
-	// Make the actual download request with Range header if resuming
-	var downloadResp *http.Response
-	if startByte > 0 {
-		req, err := http.NewRequest("GET", url, nil)
-		if err != nil { return "", err }
-		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", startByte))
-		downloadResp, err = http.DefaultClient.Do(req)
-		if err != nil { return "", err }
-		defer downloadResp.Body.Close()
-		
-		if downloadResp.StatusCode != http.StatusPartialContent {
-			// Server doesn't support resume, start over
-			f.Close()
-			f, err = os.Create(outputPath)
-			if err != nil { return "", err }
-			defer f.Close()
-			startByte = 0
-			downloadResp.Body.Close()
-			downloadResp, err = http.Get(url)
+	// Make the actual download request with Range header if resuming,
+	// unless the first response already is the download
+	if startByte < totalSize || totalSize < 0 {
+		downloadResp := resp
+		if probe || startByte > 0 {
+			req, err := http.NewRequest("GET", url, nil)
 			if err != nil { return "", err }
+			req.Header.Set(protocol.AcceptEncodingHeader, acceptEncoding)
+			if startByte > 0 {
+				req.Header.Set("Range", fmt.Sprintf("bytes=%d-", startByte))
+				if v := p.meta.ETag; v != "" {
+					req.Header.Set("If-Range", v)
+				}
+			}
+			if downloadResp, err = hc.Do(req); err != nil { return "", err }
 			defer downloadResp.Body.Close()
 		}
-	} else {
-		downloadResp, err = http.Get(url)
+		switch downloadResp.StatusCode {
+		case http.StatusPartialContent:
+		case http.StatusOK:
+			// Server doesn't support resume, or the payload changed: start over
+			if startByte > 0 {
+				if err := p.restart(); err != nil { return "", err }
+				startByte = 0
+			}
+		default:
+			return "", fmt.Errorf("http status %d", downloadResp.StatusCode)
+		}
+		if err := p.setETag(downloadResp.Header); err != nil { return "", err }
+
+		src, err := openBody(downloadResp, key, startByte)
 		if err != nil { return "", err }
-		defer downloadResp.Body.Close()
+		if progress != nil {
+			// Start progress tracking from existing bytes if resuming
+			src = &progressReader{r: src, total: totalSize, read: startByte, out: progress, start: time.Now()}
+		}
+		// Use larger buffer for faster I/O on large files
+		buf := make([]byte, 1<<20) // 1MB buffer
+		if _, err := io.CopyBuffer(p, src, buf); err != nil { return "", err }
 	}
-	
-	var src io.Reader = downloadResp.Body
-	if progress != nil {
-		// Start progress tracking from existing bytes if resuming
-		src = &progressReader{r: downloadResp.Body, total: totalSize, read: startByte, out: progress, start: time.Now()}
-	}
-	// Use larger buffer for faster I/O on large files
-	buf := make([]byte, 1<<20) // 1MB buffer
-	if _, err := io.CopyBuffer(f, src, buf); err != nil { return "", err }
+	// Files (unlike zips and text) come with a digest of their content
+	if ranged {
+		if err := p.verify(hc, key, url); err != nil { return "", err }
+	}
+	if err := p.commit(); err != nil { return "", err }
 	return outputPath, nil
 }
 
+// receiveIndex downloads every item of a multi-item share into outputDir.
+func receiveIndex(rawURL string, idx protocol.Index, outputDir string, force bool, progress io.Writer) (string, error) {
+	if outputDir == "" {
+		outputDir = "."
+	}
+	if err := os.MkdirAll(outputDir, 0o755); err != nil { return "", err }
+	for _, it := range idx.Items {
+		name := filepath.Base(it.Name)
+		if name == "." || name == ".." || name == string(filepath.Separator) {
+			return "", fmt.Errorf("invalid item name %q", it.Name)
+		}
+		itemURL, err := resolveURL(rawURL, it.URL)
+		if err != nil { return "", err }
+		if progress != nil {
+			fmt.Fprintf(progress, "%s\n", name)
+		}
+		if _, err := Receive(itemURL, filepath.Join(outputDir, name), force, progress); err != nil {
+			return "", fmt.Errorf("%s: %w", name, err)
+		}
+		if progress != nil {
+			fmt.Fprintln(progress)
+		}
+	}
+	return outputDir, nil
+}
+
+// resolveURL resolves a server path against base, keeping base's fragment
+// (the key and certificate pin) on the result.
+func resolveURL(base, ref string) (string, error) {
+	b, err := url.Parse(base)
+	if err != nil { return "", err }
+	r, err := url.Parse(ref)
+	if err != nil { return "", err }
+	u := b.ResolveReference(r)
+	u.Fragment = b.Fragment
+	u.RawFragment = b.RawFragment
+	return u.String(), nil
+}
+
+// keyFromURL derives the payload key from the URL fragment, if present.
+func keyFromURL(raw string) ([]byte, error) {
+	frag, err := fragmentParams(raw)
+	if err != nil { return nil, err }
+	secret := frag.Get(protocol.KeyFragment)
+	if secret == "" { return nil, nil }
+	return crypto.DeriveKey(secret)
+}
+
+// acceptEncoding lists the codings receivers decode, preferred first.
+const acceptEncoding = protocol.EncodingZstd + ", " + protocol.EncodingGzip
+
+// openBody returns the plaintext payload of resp, decrypting it when the
+// server sealed it and decompressing it when the server compressed it.
+// offset is the plaintext position the body must start at.
+func openBody(resp *http.Response, key []byte, offset int64) (io.Reader, error) {
+	body, err := unseal(resp, key, offset)
+	if err != nil { return nil, err }
+	switch coding := resp.Header.Get(protocol.EncodingHeader); coding {
+	case "":
+		return body, nil
+	case protocol.EncodingZstd:
+		d, err := zstd.NewReader(body, zstd.WithDecoderConcurrency(1))
+		if err != nil { return nil, err }
+		return d.IOReadCloser(), nil
+	case protocol.EncodingGzip:
+		return gzip.NewReader(body)
+	default:
+		return nil, fmt.Errorf("unsupported encoding %q", coding)
+	}
+}
+
+// unseal returns the body of resp, decrypting it when the server sealed it.
+func unseal(resp *http.Response, key []byte, offset int64) (io.Reader, error) {
+	cipher := resp.Header.Get(protocol.CipherHeader)
+	if cipher == "" {
+		if key != nil {
+			return nil, errors.New("expected an encrypted transfer but the server sent plaintext")
+		}
+		return resp.Body, nil
+	}
+	if cipher != protocol.CipherAESGCM {
+		return nil, fmt.Errorf("unsupported cipher %q", cipher)
+	}
+	if key == nil {
+		return nil, errors.New("transfer is encrypted; use the full URL including its #key= part")
+	}
+	or, err := crypto.NewOpenReader(resp.Body, key)
+	if err != nil { return nil, err }
+	if or.Offset() != offset {
+		return nil, fmt.Errorf("encrypted stream starts at byte %d, expected %d", or.Offset(), offset)
+	}
+	return or, nil
+}
+
+// payloadLength returns the plaintext length of the response body.
+func payloadLength(resp *http.Response) int64 {
+	if v := resp.Header.Get(protocol.PlainLengthHeader); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return n
+		}
+	}
+	if resp.Header.Get(protocol.CipherHeader) != "" {
+		return -1
+	}
+	return resp.ContentLength
+}
+
 func filenameFromResponse(resp *http.Response) string {
 	cd := resp.Header.Get("Content-Disposition")
 	if cd == "" { return "" }
@@ -143,19 +458,44 @@ type progressReader struct {
 func (p *progressReader) Read(b []byte) (int, error) {
 	n, err := p.r.Read(b)
 	p.read += int64(n)
-	if p.total > 0 && p.out != nil {
-		pct := float64(p.read) / float64(p.total) * 100.0
-		elapsed := time.Since(p.start).Seconds()
-		var mbps float64
-		if elapsed > 0 {
-			// Convert bytes to megabits: (bytes * 8) / (1_000_000 bits per megabit)
-			mbps = (float64(p.read) * 8) / (elapsed * 1_000_000)
-		}
-		fmt.Fprintf(p.out, "\r[%-20s] %3.0f%% | %5.1f Mbps", bar(pct), pct, mbps)
-	}
+	showProgress(p.out, p.read, p.total, p.start)
 	return n, err
 }
 
+// ProgressReporter is a progress writer that takes figures instead of a
+// rendered bar. Text such as item names is still written to it.
+type ProgressReporter interface {
+	io.Writer
+	ReportProgress(read, total int64, elapsed time.Duration)
+}
+
+// TextReceiver is a progress writer that takes text shares, which Receive
+// otherwise writes to stdout.
+type TextReceiver interface {
+	io.Writer
+	TextOutput() io.Writer
+}
+
+// showProgress draws a bar for read of total bytes on out, or hands the
+// figures over when out is a ProgressReporter. total is -1 when unknown.
+func showProgress(out io.Writer, read, total int64, start time.Time) {
+	if r, ok := out.(ProgressReporter); ok {
+		r.ReportProgress(read, total, time.Since(start))
+		return
+	}
+	if total <= 0 || out == nil {
+		return
+	}
+	pct := float64(read) / float64(total) * 100.0
+	elapsed := time.Since(start).Seconds()
+	var mbps float64
+	if elapsed > 0 {
+		// Convert bytes to megabits: (bytes * 8) / (1_000_000 bits per megabit)
+		mbps = (float64(read) * 8) / (elapsed * 1_000_000)
+	}
+	fmt.Fprintf(out, "\r[%-20s] %3.0f%% | %5.1f Mbps", bar(pct), pct, mbps)
+}
+
 func bar(pct float64) string {
 	filled := int(pct / 5) // 20 slots
 	if filled < 0 { filled = 0 }
@@ -0,0 +1,131 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zulfikawr/warp/internal/protocol"
+)
+
+const (
+	// segmentCount is how many ranges a large file is split into.
+	segmentCount = 4
+	// minSegmentSize keeps segments large enough to be worth a connection.
+	minSegmentSize = 8 << 20
+	// segmentRetries is how often a failed segment is retried, continuing
+	// from the last byte it wrote.
+	segmentRetries = 3
+)
+
+// segment is the inclusive byte range [pos, end] still to be fetched.
+type segment struct {
+	pos, end int64
+}
+
+// errPayloadChanged means the sender's file no longer matches the validator
+// a download started with.
+var errPayloadChanged = errors.New("payload changed on the sender")
+
+// receiveSegments fetches the inclusive ranges gaps of url, total bytes in
+// all, into p over parallel ranged requests, writing each range in place.
+// Every request carries validator (the ETag, may be empty) in If-Range, so
+// ranges of a replaced file are never mixed in. What arrives is recorded
+// in p's metadata, so a later Receive resumes whatever is still missing.
+func receiveSegments(hc *http.Client, url string, key []byte, p *partial, validator string, gaps [][2]int64, total int64, progress io.Writer) error {
+	if err := p.Truncate(total); err != nil { return err }
+	var left int64
+	for _, g := range gaps {
+		left += g[1] - g[0] + 1
+	}
+	size := max(left/segmentCount, minSegmentSize)
+	var segs []*segment
+	for _, g := range gaps {
+		for pos := g[0]; pos <= g[1]; pos += size {
+			segs = append(segs, &segment{pos: pos, end: min(pos+size-1, g[1])})
+		}
+	}
+
+	sp := &sharedProgress{total: total, read: total - left, out: progress, start: time.Now()}
+	jobs := make(chan *segment, len(segs))
+	for _, sg := range segs {
+		jobs <- sg
+	}
+	close(jobs)
+	errs := make(chan error, len(segs))
+	var wg sync.WaitGroup
+	for i := 0; i < min(segmentCount, len(segs)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for sg := range jobs {
+				var err error
+				for attempt := 0; attempt <= segmentRetries; attempt++ {
+					if attempt > 0 {
+						time.Sleep(time.Duration(attempt) * 500 * time.Millisecond)
+					}
+					if err = fetchSegment(hc, url, key, p, validator, sg, sp); err == nil || errors.Is(err, errPayloadChanged) {
+						break
+					}
+				}
+				if err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// fetchSegment fetches the rest of sg into p, advancing sg.pos as bytes land.
+func fetchSegment(hc *http.Client, url string, key []byte, p *partial, validator string, sg *segment, sp *sharedProgress) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil { return err }
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", sg.pos, sg.end))
+	req.Header.Set(protocol.AcceptEncodingHeader, acceptEncoding)
+	if validator != "" {
+		req.Header.Set("If-Range", validator)
+	}
+	resp, err := hc.Do(req)
+	if err != nil { return err }
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK && validator != "" {
+		return errPayloadChanged
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("http status %d for range request", resp.StatusCode)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Range"), "bytes "+strconv.FormatInt(sg.pos, 10)+"-") {
+		return errors.New("server returned a different range than requested")
+	}
+	src, err := openBody(resp, key, sg.pos)
+	if err != nil { return err }
+
+	want := sg.end - sg.pos + 1
+	buf := make([]byte, 1<<20)
+	var got int64
+	for got < want {
+		n, rerr := src.Read(buf[:min(int64(len(buf)), want-got)])
+		if n > 0 {
+			if _, err := p.WriteAt(buf[:n], sg.pos); err != nil { return err }
+			sg.pos += int64(n)
+			got += int64(n)
+			sp.add(int64(n))
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil { return rerr }
+	}
+	if got < want {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/zulfikawr/warp/internal/protocol"
+)
+
+// fragmentParams parses the key=value parameters warp puts in the URL
+// fragment. Fragments never leave the client.
+func fragmentParams(raw string) (url.Values, error) {
+	u, err := url.Parse(raw)
+	if err != nil { return nil, err }
+	if u.Fragment == "" { return url.Values{}, nil }
+	frag, err := url.ParseQuery(u.Fragment)
+	if err != nil { return nil, fmt.Errorf("invalid URL fragment: %w", err) }
+	return frag, nil
+}
+
+// newHTTPClient returns a client for raw. HTTPS URLs carrying a certificate
+// fingerprint pin that certificate instead of consulting the system CAs,
+// since warp servers use ephemeral self-signed certificates.
+func newHTTPClient(raw string) (*http.Client, error) {
+	frag, err := fragmentParams(raw)
+	if err != nil { return nil, err }
+	fp := strings.ToLower(frag.Get(protocol.FingerprintFragment))
+	if fp == "" || !strings.HasPrefix(strings.ToLower(raw), "https://") {
+		return http.DefaultClient, nil
+	}
+	want, err := hex.DecodeString(fp)
+	if err != nil || len(want) != sha256.Size {
+		return nil, errors.New("invalid certificate fingerprint in URL")
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = &tls.Config{
+		// Chain verification is replaced by the pin check below
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("server sent no certificate")
+			}
+			sum := sha256.Sum256(cs.PeerCertificates[0].Raw)
+			if !bytes.Equal(sum[:], want) {
+				return errors.New("server certificate does not match the pinned fingerprint")
+			}
+			return nil
+		},
+	}
+	return &http.Client{Transport: tr}, nil
+}
@@ -0,0 +1,208 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/zulfikawr/warp/internal/protocol"
+)
+
+// treeWorkers is how many files of a directory are fetched at once.
+const treeWorkers = 4
+
+// receiveTree mirrors a shared directory into outputDir, fetching files in
+// parallel. Every file resumes on its own: complete files are skipped and
+// interrupted ones continue from their partial file with a Range request.
+// Empty directories and symlinks are recreated, and every entry gets its
+// mode and mtime back, so scripts stay executable.
+func receiveTree(rawURL string, m protocol.Manifest, outputDir string, force bool, progress io.Writer) (string, error) {
+	if outputDir == "" {
+		outputDir = filepath.Base(m.Root)
+		if outputDir == "." || outputDir == ".." || outputDir == string(filepath.Separator) {
+			return "", fmt.Errorf("invalid directory name %q", m.Root)
+		}
+	}
+	key, err := keyFromURL(rawURL)
+	if err != nil { return "", err }
+	hc, err := newHTTPClient(rawURL)
+	if err != nil { return "", err }
+
+	if err := os.MkdirAll(outputDir, 0o755); err != nil { return "", err }
+	var files, dirs, links []protocol.ManifestEntry
+	var total int64
+	linked := make(map[string]bool)
+	for _, e := range m.Files {
+		if !filepath.IsLocal(filepath.FromSlash(e.Path)) {
+			return "", fmt.Errorf("invalid path %q in manifest", e.Path)
+		}
+		if e.Link != "" {
+			links = append(links, e)
+			linked[e.Path] = true
+		}
+	}
+	for _, e := range m.Files {
+		// Nothing may be written through a link the manifest creates
+		for d := path.Dir(e.Path); d != "."; d = path.Dir(d) {
+			if linked[d] {
+				return "", fmt.Errorf("invalid path %q in manifest", e.Path)
+			}
+		}
+		switch {
+		case e.Link != "":
+		case e.Dir:
+			dirs = append(dirs, e)
+			if err := os.MkdirAll(filepath.Join(outputDir, filepath.FromSlash(e.Path)), 0o755); err != nil { return "", err }
+		default:
+			files = append(files, e)
+			total += e.Size
+		}
+	}
+
+	tp := &sharedProgress{total: total, out: progress, start: time.Now()}
+	jobs := make(chan protocol.ManifestEntry)
+	errs := make(chan error, len(files))
+	var wg sync.WaitGroup
+	for i := 0; i < treeWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range jobs {
+				if err := fetchTreeFile(hc, key, rawURL, e, outputDir, force, tp); err != nil {
+					errs <- fmt.Errorf("%s: %w", e.Path, err)
+				}
+			}
+		}()
+	}
+	for _, e := range files {
+		jobs <- e
+	}
+	close(jobs)
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil { return "", err }
+	for _, e := range links {
+		if err := makeLink(e, outputDir, force); err != nil {
+			return "", fmt.Errorf("%s: %w", e.Path, err)
+		}
+	}
+
+	// Children first, so setting a directory's mtime isn't undone by
+	// creating entries inside it
+	for i := len(dirs) - 1; i >= 0; i-- {
+		p := filepath.Join(outputDir, filepath.FromSlash(dirs[i].Path))
+		_ = os.Chmod(p, os.FileMode(dirs[i].Mode).Perm()|0o700)
+		mt := time.Unix(dirs[i].MTime, 0)
+		_ = os.Chtimes(p, mt, mt)
+	}
+	return outputDir, nil
+}
+
+// fetchTreeFile downloads one manifest entry into outputDir through a
+// partial file, resuming an interrupted one. A file whose size and mtime
+// already match is complete.
+func fetchTreeFile(hc *http.Client, key []byte, rawURL string, e protocol.ManifestEntry, outputDir string, force bool, tp *sharedProgress) error {
+	dest := filepath.Join(outputDir, filepath.FromSlash(e.Path))
+	mt := time.Unix(e.MTime, 0)
+	if fi, err := os.Stat(dest); err == nil && !force {
+		if fi.Size() == e.Size && fi.ModTime().Unix() == e.MTime {
+			tp.add(e.Size)
+			return nil
+		}
+		return errors.New("destination exists; use --force to overwrite")
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil { return err }
+
+	fileURL, err := resolveURL(rawURL, e.URL)
+	if err != nil { return err }
+	p, err := openPartial(dest, partialMeta{URL: fileURL, Size: e.Size})
+	if err != nil { return err }
+	defer p.Close()
+	if p.start < e.Size || e.Size == 0 {
+		req, err := http.NewRequest(http.MethodGet, fileURL, nil)
+		if err != nil { return err }
+		req.Header.Set(protocol.AcceptEncodingHeader, acceptEncoding)
+		if p.start > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", p.start))
+			if v := p.meta.ETag; v != "" {
+				req.Header.Set("If-Range", v)
+			}
+		}
+		resp, err := hc.Do(req)
+		if err != nil { return err }
+		defer resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusPartialContent:
+		case http.StatusOK:
+			// Full body: the file changed, the server ignored the range, or
+			// none was asked for
+			if p.start > 0 {
+				if err := p.restart(); err != nil { return err }
+			}
+		default:
+			return fmt.Errorf("http status %d", resp.StatusCode)
+		}
+		if err := p.setETag(resp.Header); err != nil { return err }
+		tp.add(p.start)
+		src, err := openBody(resp, key, p.start)
+		if err != nil { return err }
+		buf := make([]byte, 1<<20)
+		if _, err := io.CopyBuffer(p, &sharedProgressReader{r: src, p: tp}, buf); err != nil { return err }
+	} else {
+		tp.add(p.start)
+	}
+	if err := p.verify(hc, key, fileURL); err != nil { return err }
+	if err := p.commit(); err != nil { return err }
+	if err := os.Chmod(dest, os.FileMode(e.Mode).Perm()); err != nil { return err }
+	return os.Chtimes(dest, mt, mt)
+}
+
+// makeLink creates the symlink described by e inside outputDir. A link
+// that already points at the same target is kept.
+func makeLink(e protocol.ManifestEntry, outputDir string, force bool) error {
+	dest := filepath.Join(outputDir, filepath.FromSlash(e.Path))
+	if target, err := os.Readlink(dest); err == nil && target == e.Link {
+		return nil
+	}
+	if _, err := os.Lstat(dest); err == nil {
+		if !force {
+			return errors.New("destination exists; use --force to overwrite")
+		}
+		if err := os.Remove(dest); err != nil { return err }
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil { return err }
+	return os.Symlink(e.Link, dest)
+}
+
+// sharedProgress shows the combined progress of parallel downloads.
+type sharedProgress struct {
+	mu    sync.Mutex
+	total int64
+	read  int64
+	out   io.Writer
+	start time.Time
+}
+
+func (p *sharedProgress) add(n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.read += n
+	showProgress(p.out, p.read, p.total, p.start)
+}
+
+type sharedProgressReader struct {
+	r io.Reader
+	p *sharedProgress
+}
+
+func (t *sharedProgressReader) Read(b []byte) (int, error) {
+	n, err := t.r.Read(b)
+	t.p.add(int64(n))
+	return n, err
+}
@@ -0,0 +1,244 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zulfikawr/warp/internal/protocol"
+)
+
+const (
+	// uploadRetries is how often a chunk the host rejected as corrupt is
+	// sent again.
+	uploadRetries = 3
+	// uploadDropTimeout is how long a chunk keeps retrying through network
+	// drops before the upload gives up.
+	uploadDropTimeout = 2 * time.Minute
+)
+
+// Upload sends the file at path to a warp host (an upload URL, /u/{token})
+// through an upload session: the host reports which ranges it still lacks,
+// chunks of those go out in parallel as sized by the host's manifest, each
+// carrying its SHA-256 so the host can reject corrupt ones, and chunks lost
+// to network drops are retried until the host is reachable again. Running
+// Upload again after a failure sends only what the host is missing.
+func Upload(rawURL, path string, progress io.Writer) error {
+	hc, err := newHTTPClient(rawURL)
+	if err != nil { return err }
+	f, err := os.Open(path)
+	if err != nil { return err }
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil { return err }
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil { return err }
+
+	sess, err := openUploadSession(hc, rawURL, protocol.UploadSessionRequest{
+		Name:   filepath.Base(path),
+		Size:   fi.Size(),
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+	})
+	if err != nil { return err }
+	sessURL := uploadURL(rawURL, protocol.UploadSessionsPath, sess.ID)
+
+	chunkSize, workers := uploadParams(hc, rawURL)
+	var chunks []segment
+	var done int64 = fi.Size()
+	for _, m := range sess.Missing {
+		done -= m[1] - m[0] + 1
+		for pos := m[0]; pos <= m[1]; pos += int64(chunkSize) {
+			chunks = append(chunks, segment{pos: pos, end: min(pos+int64(chunkSize)-1, m[1])})
+		}
+	}
+	if workers > len(chunks) {
+		workers = len(chunks)
+	}
+
+	sp := &sharedProgress{total: fi.Size(), read: done, out: progress, start: time.Now()}
+	jobs := make(chan segment)
+	errs := make(chan error, workers)
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, chunkSize)
+			for c := range jobs {
+				chunk := buf[:c.end-c.pos+1]
+				if _, err := f.ReadAt(chunk, c.pos); err != nil {
+					errs <- err
+					stopOnce.Do(func() { close(stop) })
+					return
+				}
+				if err := sendChunk(hc, sessURL, chunk, c.pos); err != nil {
+					errs <- err
+					stopOnce.Do(func() { close(stop) })
+					return
+				}
+				sp.add(int64(len(chunk)))
+			}
+		}()
+	}
+feed:
+	for _, c := range chunks {
+		select {
+		case jobs <- c:
+		case <-stop:
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return err
+	}
+	return finishUploadSession(hc, sessURL)
+}
+
+// openUploadSession creates the host's session for a file, or finds the one
+// an earlier attempt left behind.
+func openUploadSession(hc *http.Client, rawURL string, req protocol.UploadSessionRequest) (*protocol.UploadSession, error) {
+	body, _ := json.Marshal(req)
+	resp, err := hc.Post(uploadURL(rawURL, protocol.UploadSessionsPath), "application/json", bytes.NewReader(body))
+	if err != nil { return nil, err }
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &uploadStatusError{resp.StatusCode}
+	}
+	var sess protocol.UploadSession
+	if err := json.NewDecoder(resp.Body).Decode(&sess); err != nil {
+		return nil, fmt.Errorf("invalid upload session: %w", err)
+	}
+	return &sess, nil
+}
+
+// finishUploadSession asks the host to verify the file and move it into
+// place.
+func finishUploadSession(hc *http.Client, sessURL string) error {
+	resp, err := hc.Post(sessURL+"/finish", "application/json", nil)
+	if err != nil { return err }
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusConflict:
+		return errors.New("host is still missing parts of the file; run the upload again")
+	case http.StatusUnprocessableEntity:
+		return errors.New("uploaded file does not match its SHA-256 on the host; run the upload again")
+	default:
+		return &uploadStatusError{resp.StatusCode}
+	}
+}
+
+// uploadURL resolves elems below the upload URL rawURL, without its
+// fragment.
+func uploadURL(rawURL string, elems ...string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	u.Fragment = ""
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + strings.Join(elems, "/")
+	return u.String()
+}
+
+var errChunkRejected = errors.New("host rejected a corrupt chunk")
+
+// sendChunk posts one chunk, re-sending it when the host rejects its digest
+// and waiting out network drops with a growing backoff.
+func sendChunk(hc *http.Client, sessURL string, chunk []byte, offset int64) error {
+	sum := sha256.Sum256(chunk)
+	digest := hex.EncodeToString(sum[:])
+	rejected := 0
+	backoff := 500 * time.Millisecond
+	deadline := time.Now().Add(uploadDropTimeout)
+	for {
+		err := postChunk(hc, sessURL, chunk, digest, offset)
+		var herr *uploadStatusError
+		switch {
+		case err == nil:
+			return nil
+		case errors.Is(err, errChunkRejected):
+			if rejected++; rejected > uploadRetries {
+				return fmt.Errorf("bytes %d-%d: %w", offset, offset+int64(len(chunk))-1, err)
+			}
+			continue
+		case errors.As(err, &herr) && herr.code < 500:
+			// The host refused the upload itself; retrying won't help
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("host unreachable for %s: %w", uploadDropTimeout, err)
+		}
+		time.Sleep(backoff)
+		if backoff < 10*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// uploadStatusError is an unexpected HTTP status from the host.
+type uploadStatusError struct{ code int }
+
+func (e *uploadStatusError) Error() string { return fmt.Sprintf("http status %d", e.code) }
+
+func postChunk(hc *http.Client, sessURL string, chunk []byte, sum string, offset int64) error {
+	req, err := http.NewRequest(http.MethodPost, sessURL, bytes.NewReader(chunk))
+	if err != nil { return err }
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Upload-Offset", strconv.FormatInt(offset, 10))
+	req.Header.Set("X-Upload-SHA256", sum)
+	resp, err := hc.Do(req)
+	if err != nil { return err }
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnprocessableEntity:
+		return errChunkRejected
+	default:
+		return &uploadStatusError{resp.StatusCode}
+	}
+}
+
+// uploadParams asks the host for its chunk size and parallelism, falling
+// back to 2 MB chunks over 3 connections (the upload page's defaults).
+func uploadParams(hc *http.Client, rawURL string) (chunkSize, workers int) {
+	chunkSize, workers = 2<<20, 3
+	resp, err := hc.Get(uploadURL(rawURL, "manifest"))
+	if err != nil { return }
+	defer resp.Body.Close()
+	var m struct {
+		ChunkSize     int `json:"chunk_size"`
+		MaxConcurrent int `json:"max_concurrent"`
+	}
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&m) != nil {
+		return
+	}
+	if m.ChunkSize > 0 && m.ChunkSize <= 64<<20 {
+		chunkSize = m.ChunkSize
+	}
+	if m.MaxConcurrent > 0 && m.MaxConcurrent <= 16 {
+		workers = m.MaxConcurrent
+	}
+	return
+}
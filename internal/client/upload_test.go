@@ -0,0 +1,150 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/zulfikawr/warp/internal/protocol"
+)
+
+// fakeHost is a warp host's upload session API for one file, with a hook
+// deciding how each chunk post is answered.
+type fakeHost struct {
+	mu    sync.Mutex
+	data  []byte
+	have  []bool        // per chunk
+	posts map[int64]int // chunk posts by offset
+	chunk int64
+	// onChunk may answer a post itself: it returns false once it has
+	onChunk func(w http.ResponseWriter, offset int64, n int) bool
+}
+
+func newFakeHost(size int, chunk int64) *fakeHost {
+	return &fakeHost{
+		data:  make([]byte, size),
+		have:  make([]bool, (int64(size)+chunk-1)/chunk),
+		posts: make(map[int64]int),
+		chunk: chunk,
+	}
+}
+
+func (h *fakeHost) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/u/tok/manifest":
+		json.NewEncoder(w).Encode(map[string]int{"chunk_size": int(h.chunk), "max_concurrent": 2})
+	case "/u/tok/sessions":
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		sess := protocol.UploadSession{ID: "s1", Size: int64(len(h.data)), Missing: [][2]int64{}}
+		for i, ok := range h.have {
+			if !ok {
+				pos := int64(i) * h.chunk
+				sess.Missing = append(sess.Missing, [2]int64{pos, min(pos+h.chunk, int64(len(h.data))) - 1})
+			}
+		}
+		json.NewEncoder(w).Encode(sess)
+	case "/u/tok/sessions/s1":
+		offset, _ := strconv.ParseInt(r.Header.Get("X-Upload-Offset"), 10, 64)
+		h.mu.Lock()
+		h.posts[offset]++
+		n, hook := h.posts[offset], h.onChunk
+		h.mu.Unlock()
+		if hook != nil && !hook(w, offset, n) {
+			return
+		}
+		b, err := io.ReadAll(r.Body)
+		if err != nil { return }
+		sum := sha256.Sum256(b)
+		if hex.EncodeToString(sum[:]) != r.Header.Get("X-Upload-SHA256") {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+		h.mu.Lock()
+		copy(h.data[offset:], b)
+		h.have[offset/h.chunk] = true
+		h.mu.Unlock()
+	case "/u/tok/sessions/s1/finish":
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		for _, ok := range h.have {
+			if !ok {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeUploadSource(t *testing.T, size int) (string, []byte) {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	path := filepath.Join(t.TempDir(), "build.tar")
+	if err := os.WriteFile(path, data, 0o644); err != nil { t.Fatal(err) }
+	return path, data
+}
+
+func TestUploadResumesAfterInterruptedChunk(t *testing.T) {
+	path, data := writeUploadSource(t, 10<<10)
+	h := newFakeHost(len(data), 1<<10)
+	// An earlier attempt already delivered the first chunk
+	copy(h.data, data[:1<<10])
+	h.have[0] = true
+	// The connection drops during the first post of the third chunk
+	h.onChunk = func(w http.ResponseWriter, offset int64, n int) bool {
+		if offset == 2<<10 && n == 1 {
+			panic(http.ErrAbortHandler)
+		}
+		return true
+	}
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	if err := Upload(ts.URL+"/u/tok", path, ioutil.Discard); err != nil { t.Fatalf("Upload error: %v", err) }
+	if !bytes.Equal(h.data, data) {
+		t.Fatal("host holds different bytes than the source")
+	}
+	if h.posts[0] != 0 {
+		t.Fatalf("chunk the host already had was sent %d times", h.posts[0])
+	}
+	if h.posts[2<<10] != 2 {
+		t.Fatalf("interrupted chunk was posted %d times, want 2", h.posts[2<<10])
+	}
+}
+
+func TestUploadResendsRejectedChunk(t *testing.T) {
+	path, data := writeUploadSource(t, 5<<10)
+	h := newFakeHost(len(data), 1<<10)
+	// The host rejects the fourth chunk's first post as corrupt
+	h.onChunk = func(w http.ResponseWriter, offset int64, n int) bool {
+		if offset == 3<<10 && n == 1 {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return false
+		}
+		return true
+	}
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	if err := Upload(ts.URL+"/u/tok", path, ioutil.Discard); err != nil { t.Fatalf("Upload error: %v", err) }
+	if !bytes.Equal(h.data, data) {
+		t.Fatal("host holds different bytes than the source")
+	}
+	if h.posts[3<<10] != 2 {
+		t.Fatalf("rejected chunk was posted %d times, want 2", h.posts[3<<10])
+	}
+}
@@ -0,0 +1,90 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/zulfikawr/warp/internal/protocol"
+)
+
+// CorruptError reports the byte ranges of a received file that don't match
+// the sender's digest.
+type CorruptError struct {
+	Path   string
+	Ranges [][2]int64 // inclusive
+}
+
+func (e *CorruptError) Error() string {
+	var rs []string
+	for _, r := range e.Ranges {
+		rs = append(rs, fmt.Sprintf("%d-%d", r[0], r[1]))
+	}
+	return fmt.Sprintf("%s is corrupt: re-fetch bytes=%s", e.Path, strings.Join(rs, ","))
+}
+
+// verifyFile checks the file at path against the digest the sender
+// publishes for rawURL. Senders that publish none are trusted as before.
+func verifyFile(hc *http.Client, key []byte, rawURL, path string) error {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil { return err }
+	req.Header.Set("Accept", protocol.DigestMediaType)
+	resp, err := hc.Do(req)
+	if err != nil { return err }
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), protocol.DigestMediaType) {
+		return nil
+	}
+	body, err := openBody(resp, key, 0)
+	if err != nil { return err }
+	var d protocol.Digest
+	if err := json.NewDecoder(body).Decode(&d); err != nil {
+		return fmt.Errorf("invalid digest: %w", err)
+	}
+	if d.ChunkSize <= 0 || int64(len(d.Chunks)) != (d.Size+d.ChunkSize-1)/d.ChunkSize {
+		return fmt.Errorf("invalid digest: %d chunk hashes for %d bytes", len(d.Chunks), d.Size)
+	}
+
+	f, err := os.Open(path)
+	if err != nil { return err }
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil { return err }
+	if fi.Size() != d.Size {
+		return fmt.Errorf("%s is %d bytes, sender has %d; re-fetch with --force", path, fi.Size(), d.Size)
+	}
+
+	bad := &CorruptError{Path: path}
+	whole := sha256.New()
+	// The chunk size comes from the sender, so chunks stream through a
+	// fixed buffer rather than being read whole
+	buf := make([]byte, 1<<20)
+	for i, want := range d.Chunks {
+		h := sha256.New()
+		n, err := io.CopyBuffer(io.MultiWriter(h, whole), io.LimitReader(f, d.ChunkSize), buf)
+		if err != nil { return err }
+		if hex.EncodeToString(h.Sum(nil)) == want {
+			continue
+		}
+		start := int64(i) * d.ChunkSize
+		end := start + n - 1
+		// Merge neighbouring bad chunks into one range
+		if k := len(bad.Ranges); k > 0 && bad.Ranges[k-1][1] == start-1 {
+			bad.Ranges[k-1][1] = end
+		} else {
+			bad.Ranges = append(bad.Ranges, [2]int64{start, end})
+		}
+	}
+	if len(bad.Ranges) > 0 {
+		return bad
+	}
+	if hex.EncodeToString(whole.Sum(nil)) != d.SHA256 {
+		return fmt.Errorf("%s does not match the sender's SHA-256; re-fetch with --force", path)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// CodeWords is the number of words following the nameplate in a code.
+const CodeWords = 2
+
+// GenerateCode returns a short human-friendly code such as
+// "7-crossword-pumpkin". The leading number is a nameplate that receivers
+// use to find the sender via mDNS; the whole code is the PAKE password.
+func GenerateCode(randReader io.Reader) (string, error) {
+	if randReader == nil {
+		randReader = rand.Reader
+	}
+	n, err := rand.Int(randReader, big.NewInt(99))
+	if err != nil {
+		return "", err
+	}
+	parts := []string{strconv.FormatInt(n.Int64()+1, 10)}
+	b := make([]byte, CodeWords)
+	if _, err := io.ReadFull(randReader, b); err != nil {
+		return "", err
+	}
+	for _, i := range b {
+		parts = append(parts, codeWordlist[i])
+	}
+	return strings.Join(parts, "-"), nil
+}
+
+// ParseCode normalizes a code typed by a user and returns its nameplate.
+func ParseCode(code string) (normalized, nameplate string, err error) {
+	parts := strings.Split(strings.ToLower(strings.TrimSpace(code)), "-")
+	if len(parts) != CodeWords+1 {
+		return "", "", fmt.Errorf("invalid code %q: want <number>-<word>-<word>", code)
+	}
+	if n, err := strconv.Atoi(parts[0]); err != nil || n <= 0 {
+		return "", "", fmt.Errorf("invalid code %q: must start with a number", code)
+	}
+	for _, w := range parts[1:] {
+		if !isCodeWord(w) {
+			return "", "", fmt.Errorf("invalid code %q: unknown word %q", code, w)
+		}
+	}
+	return strings.Join(parts, "-"), parts[0], nil
+}
+
+func isCodeWord(w string) bool {
+	for _, c := range codeWordlist {
+		if c == w {
+			return true
+		}
+	}
+	return false
+}
+
+// codeWordlist holds 256 short, distinct words so each encodes one byte.
+var codeWordlist = [256]string{
+	"acid", "acorn", "actor", "adult", "agent", "alarm", "album", "alley",
+	"amber", "angle", "ankle", "apple", "apron", "arena", "armor", "arrow",
+	"aspen", "atlas", "attic", "audio", "autumn", "avenue", "bacon", "badge",
+	"bagel", "baker", "bamboo", "banana", "banjo", "barley", "barrel", "basil",
+	"basket", "beacon", "beaver", "bellow", "berry", "bicycle", "biscuit", "blanket",
+	"blossom", "bottle", "boulder", "bracket", "breeze", "bridge", "bronze", "bucket",
+	"buffalo", "bugle", "bundle", "butter", "button", "cabin", "cactus", "camera",
+	"candle", "canoe", "canyon", "carbon", "carpet", "castle", "cedar", "cellar",
+	"chalk", "cherry", "chimney", "cider", "cinema", "circus", "citrus", "clover",
+	"cobalt", "cocoa", "comet", "compass", "copper", "coral", "cotton", "cradle",
+	"crater", "crayon", "cricket", "crossword", "crystal", "cucumber", "curtain", "cypress",
+	"daisy", "dancer", "delta", "denim", "desert", "diamond", "dinner", "dolphin",
+	"donkey", "dragon", "drum", "eagle", "easel", "echo", "eclipse", "elbow",
+	"ember", "emerald", "engine", "falcon", "feather", "fennel", "ferry", "fiddle",
+	"fig", "flannel", "flute", "forest", "fossil", "fountain", "fox", "galaxy",
+	"garden", "garlic", "gazelle", "geyser", "ginger", "glacier", "globe", "goblet",
+	"granite", "grape", "gravel", "guitar", "hammer", "harbor", "harvest", "hazel",
+	"helmet", "hickory", "honey", "horizon", "husky", "igloo", "indigo", "island",
+	"ivory", "jacket", "jaguar", "jasmine", "jelly", "jigsaw", "jungle", "kayak",
+	"kernel", "kettle", "kitten", "koala", "ladder", "lagoon", "lantern", "laser",
+	"lava", "lemon", "lentil", "lily", "linen", "lizard", "locket", "lotus",
+	"magnet", "mango", "maple", "marble", "meadow", "melon", "meteor", "mitten",
+	"monsoon", "mosaic", "muffin", "mural", "nectar", "needle", "nickel", "noodle",
+	"nutmeg", "oasis", "oatmeal", "ocean", "olive", "onion", "opal", "orbit",
+	"orchid", "otter", "oyster", "paddle", "palace", "panda", "papaya", "parrot",
+	"pebble", "pepper", "pickle", "pigeon", "pilot", "planet", "plum", "pocket",
+	"polka", "pony", "poppy", "potato", "prism", "pumpkin", "puzzle", "quartz",
+	"quill", "rabbit", "radar", "radish", "raven", "ribbon", "river", "robin",
+	"rocket", "saddle", "saffron", "salmon", "sandal", "satin", "scarf", "shovel",
+	"silver", "sketch", "sparrow", "spider", "sponge", "stamp", "summit", "sunset",
+	"swan", "tango", "teapot", "temple", "thistle", "thunder", "tiger", "timber",
+	"tomato", "topaz", "tractor", "trumpet", "tulip", "tundra", "turtle", "tuxedo",
+}
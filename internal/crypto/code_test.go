@@ -0,0 +1,33 @@
+package crypto
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGenerateCodeRoundTrip(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, w := range codeWordlist {
+		if w == "" || seen[w] || strings.Contains(w, "-") {
+			t.Fatalf("bad or duplicate word %q", w)
+		}
+		seen[w] = true
+	}
+	for i := 0; i < 100; i++ {
+		code, err := GenerateCode(nil)
+		if err != nil { t.Fatal(err) }
+		norm, nameplate, err := ParseCode(" " + strings.ToUpper(code) + "\n")
+		if err != nil { t.Fatalf("ParseCode(%q): %v", code, err) }
+		if norm != code || !strings.HasPrefix(code, nameplate+"-") {
+			t.Fatalf("ParseCode(%q) = %q, %q", code, norm, nameplate)
+		}
+	}
+}
+
+func TestParseCodeRejectsMalformed(t *testing.T) {
+	for _, c := range []string{"", "7", "7-crossword", "x-crossword-pumpkin", "0-crossword-pumpkin", "7-crossword-notaword", "http://host/d/tok"} {
+		if _, _, err := ParseCode(c); err == nil {
+			t.Errorf("ParseCode(%q) accepted", c)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package crypto
+
+import (
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+)
+
+// SPAKE2 over the 2048-bit MODP group from RFC 3526. Both sides blind their
+// Diffie-Hellman share with the code, so a peer that does not know the code
+// learns nothing it could test guesses against offline; each exchange with
+// the server is worth exactly one online guess.
+
+// Role tells the two ends of the exchange apart.
+type Role byte
+
+const (
+	RoleClient Role = 'A'
+	RoleServer Role = 'B'
+)
+
+const modpHex = "FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD1" +
+	"29024E088A67CC74020BBEA63B139B22514A08798E3404DD" +
+	"EF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245" +
+	"E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED" +
+	"EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3D" +
+	"C2007CB8A163BF0598DA48361C55D39A69163FA8FD24CF5F" +
+	"83655D23DCA3AD961C62F356208552BB9ED529077096966D" +
+	"670C354E4ABC9804F1746C08CA18217C32905E462E36CE3B" +
+	"E39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9" +
+	"DE2BCBF6955817183995497CEA956AE515D2261898FA0510" +
+	"15728E5A8AACAA68FFFFFFFFFFFFFFFF"
+
+var (
+	pakeP, _ = new(big.Int).SetString(modpHex, 16)
+	pakeQ    = new(big.Int).Rsh(pakeP, 1) // p = 2q+1
+	pakeG    = big.NewInt(2)
+	pakeM    = hashToGroup("warp spake2 M")
+	pakeN    = hashToGroup("warp spake2 N")
+	pakeLen  = (pakeP.BitLen() + 7) / 8
+)
+
+// hashToGroup maps a label onto the order-q subgroup. Squaring lands in the
+// quadratic residues, and nobody knows the discrete log of the result.
+func hashToGroup(label string) *big.Int {
+	buf := make([]byte, 0, pakeLen+32)
+	for i := uint32(0); len(buf) < pakeLen+32; i++ {
+		var ctr [4]byte
+		binary.BigEndian.PutUint32(ctr[:], i)
+		h := sha256.Sum256(append([]byte(label), ctr[:]...))
+		buf = append(buf, h[:]...)
+	}
+	x := new(big.Int).SetBytes(buf)
+	x.Mod(x, pakeP)
+	return x.Exp(x, big.NewInt(2), pakeP)
+}
+
+// PAKE holds one side of a SPAKE2 exchange.
+type PAKE struct {
+	role Role
+	w    *big.Int
+	x    *big.Int
+	msg  []byte
+}
+
+// NewPAKE starts an exchange for the given role, keyed by a low-entropy code.
+func NewPAKE(role Role, code string, randReader io.Reader) (*PAKE, error) {
+	if role != RoleClient && role != RoleServer {
+		return nil, errors.New("invalid PAKE role")
+	}
+	if randReader == nil {
+		randReader = rand.Reader
+	}
+	wb, err := hkdf.Key(sha256.New, []byte(code), nil, "warp spake2 password", pakeLen+16)
+	if err != nil {
+		return nil, err
+	}
+	w := new(big.Int).SetBytes(wb)
+	w.Mod(w, pakeQ)
+
+	x, err := rand.Int(randReader, new(big.Int).Sub(pakeQ, big.NewInt(1)))
+	if err != nil {
+		return nil, err
+	}
+	x.Add(x, big.NewInt(1))
+
+	// X = g^x * M^w (client) or g^x * N^w (server)
+	blind := pakeM
+	if role == RoleServer {
+		blind = pakeN
+	}
+	pub := new(big.Int).Exp(pakeG, x, pakeP)
+	pub.Mul(pub, new(big.Int).Exp(blind, w, pakeP))
+	pub.Mod(pub, pakeP)
+
+	return &PAKE{role: role, w: w, x: x, msg: pub.FillBytes(make([]byte, pakeLen))}, nil
+}
+
+// Message returns the public value to send to the peer.
+func (p *PAKE) Message() []byte { return p.msg }
+
+// Finish consumes the peer's message and returns the 32-byte session key.
+// Both sides only end up with the same key if they used the same code.
+func (p *PAKE) Finish(peer []byte) ([]byte, error) {
+	if len(peer) != pakeLen {
+		return nil, errors.New("invalid PAKE message length")
+	}
+	y := new(big.Int).SetBytes(peer)
+	if y.Cmp(big.NewInt(1)) <= 0 || y.Cmp(new(big.Int).Sub(pakeP, big.NewInt(1))) >= 0 {
+		return nil, errors.New("invalid PAKE message")
+	}
+	if new(big.Int).Exp(y, pakeQ, pakeP).Cmp(big.NewInt(1)) != 0 {
+		return nil, errors.New("PAKE message outside the group")
+	}
+
+	// K = (Y / blind^w)^x, where the peer blinded with the other constant
+	blind := pakeN
+	if p.role == RoleServer {
+		blind = pakeM
+	}
+	unblind := new(big.Int).Exp(blind, p.w, pakeP)
+	unblind.ModInverse(unblind, pakeP)
+	k := new(big.Int).Mul(y, unblind)
+	k.Mod(k, pakeP)
+	k.Exp(k, p.x, pakeP)
+
+	clientMsg, serverMsg := p.msg, peer
+	if p.role == RoleServer {
+		clientMsg, serverMsg = peer, p.msg
+	}
+	h := sha256.New()
+	for _, part := range [][]byte{clientMsg, serverMsg, k.FillBytes(make([]byte, pakeLen)), p.w.Bytes()} {
+		var n [8]byte
+		binary.BigEndian.PutUint64(n[:], uint64(len(part)))
+		h.Write(n[:])
+		h.Write(part)
+	}
+	return h.Sum(nil), nil
+}
+
+// ConfirmMAC proves knowledge of the session key on behalf of role.
+func ConfirmMAC(key []byte, role Role) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte{'c', 'o', 'n', 'f', 'i', 'r', 'm', byte(role)})
+	return m.Sum(nil)
+}
+
+// CheckConfirmMAC reports whether mac was produced by role with key.
+func CheckConfirmMAC(key []byte, role Role, mac []byte) bool {
+	return hmac.Equal(ConfirmMAC(key, role), mac)
+}
+
+// SealBox encrypts a small message under the PAKE session key.
+func SealBox(key, plaintext []byte) ([]byte, error) {
+	aead, err := boxAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// OpenBox decrypts a message produced by SealBox.
+func OpenBox(key, box []byte) ([]byte, error) {
+	aead, err := boxAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(box) < aead.NonceSize() {
+		return nil, errors.New("box too short")
+	}
+	return aead.Open(nil, box[:aead.NonceSize()], box[aead.NonceSize():], nil)
+}
+
+func boxAEAD(key []byte) (cipher.AEAD, error) {
+	k, err := hkdf.Key(sha256.New, key, nil, "warp pake box", 32)
+	if err != nil {
+		return nil, err
+	}
+	return newGCM(k)
+}
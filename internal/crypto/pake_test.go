@@ -0,0 +1,61 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func exchange(t *testing.T, clientCode, serverCode string) (clientKey, serverKey []byte) {
+	t.Helper()
+	a, err := NewPAKE(RoleClient, clientCode, nil)
+	if err != nil { t.Fatal(err) }
+	b, err := NewPAKE(RoleServer, serverCode, nil)
+	if err != nil { t.Fatal(err) }
+	clientKey, err = a.Finish(b.Message())
+	if err != nil { t.Fatal(err) }
+	serverKey, err = b.Finish(a.Message())
+	if err != nil { t.Fatal(err) }
+	return clientKey, serverKey
+}
+
+func TestPAKEAgreesOnlyWithSameCode(t *testing.T) {
+	ck, sk := exchange(t, "7-crossword-pumpkin", "7-crossword-pumpkin")
+	if !bytes.Equal(ck, sk) {
+		t.Fatal("same code produced different keys")
+	}
+	if !CheckConfirmMAC(sk, RoleClient, ConfirmMAC(ck, RoleClient)) {
+		t.Fatal("confirmation rejected")
+	}
+	if CheckConfirmMAC(sk, RoleServer, ConfirmMAC(ck, RoleClient)) {
+		t.Fatal("confirmation accepted for the wrong role")
+	}
+
+	ck, sk = exchange(t, "7-crossword-pumpkin", "7-crossword-lemon")
+	if bytes.Equal(ck, sk) || CheckConfirmMAC(sk, RoleClient, ConfirmMAC(ck, RoleClient)) {
+		t.Fatal("different codes agreed on a key")
+	}
+}
+
+func TestPAKERejectsDegenerateMessages(t *testing.T) {
+	p, _ := NewPAKE(RoleServer, "1-acid-acid", nil)
+	one := make([]byte, pakeLen)
+	one[pakeLen-1] = 1
+	for _, msg := range [][]byte{nil, make([]byte, pakeLen), one, pakeP.FillBytes(make([]byte, pakeLen))} {
+		if _, err := p.Finish(msg); err == nil {
+			t.Fatalf("accepted degenerate message %x...", msg[:min(4, len(msg))])
+		}
+	}
+}
+
+func TestBoxRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	box, err := SealBox(key, []byte("ticket"))
+	if err != nil { t.Fatal(err) }
+	got, err := OpenBox(key, box)
+	if err != nil || string(got) != "ticket" {
+		t.Fatalf("OpenBox = %q, %v", got, err)
+	}
+	if _, err := OpenBox(bytes.Repeat([]byte{2}, 32), box); err == nil {
+		t.Fatal("box opened with the wrong key")
+	}
+}
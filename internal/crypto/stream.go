@@ -0,0 +1,249 @@
+package crypto
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Sealed streams split the payload into fixed-size chunks, each sealed with
+// AES-256-GCM. Every stream starts with a header carrying a random nonce
+// prefix and the plaintext offset the stream begins at, so ranged responses
+// are independent streams and a nonce is never reused under the same key.
+//
+//	header: "WRP1" | nonce prefix (8) | offset (8) | chunk size (4)
+//	chunk:  GCM(chunk), nonce = prefix | counter (4), aad = header | final
+const (
+	SealChunkSize  = 64 * 1024
+	sealMagic      = "WRP1"
+	sealHeaderSize = 4 + 8 + 8 + 4
+	sealTagSize    = 16
+)
+
+// ErrTruncated is returned when a sealed stream ends before its final chunk.
+var ErrTruncated = errors.New("sealed stream truncated")
+
+// SplitToken splits a hex token into the half used in URLs and the half kept
+// client-side (in the URL fragment) to derive the payload key.
+func SplitToken(token string) (id, secret string) {
+	half := len(token) / 2
+	return token[:half], token[half:]
+}
+
+// DeriveKey derives the 32-byte payload key from a token secret.
+func DeriveKey(secret string) ([]byte, error) {
+	if secret == "" {
+		return nil, errors.New("empty secret")
+	}
+	return hkdf.Key(sha256.New, []byte(secret), nil, "warp payload key v1", 32)
+}
+
+// SealedSize returns the length of a sealed stream carrying n plaintext bytes.
+func SealedSize(n int64) int64 {
+	chunks := (n + SealChunkSize - 1) / SealChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return sealHeaderSize + n + chunks*sealTagSize
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+type sealWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  []byte
+	buf     []byte
+	out     []byte
+	counter uint32
+	closed  bool
+}
+
+// NewSealWriter writes the stream header to w and returns a writer that
+// seals everything written to it. offset is the plaintext position of the
+// first byte. Close must be called to emit the final chunk.
+func NewSealWriter(w io.Writer, key []byte, offset int64) (io.WriteCloser, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, sealHeaderSize)
+	copy(header, sealMagic)
+	if _, err := io.ReadFull(rand.Reader, header[4:12]); err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint64(header[12:20], uint64(offset))
+	binary.BigEndian.PutUint32(header[20:24], SealChunkSize)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &sealWriter{
+		w:      w,
+		aead:   aead,
+		header: header,
+		buf:    make([]byte, 0, SealChunkSize),
+		out:    make([]byte, 0, SealChunkSize+sealTagSize),
+	}, nil
+}
+
+func (s *sealWriter) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, errors.New("write to closed sealed stream")
+	}
+	written := 0
+	for len(p) > 0 {
+		// A full buffer is only sealed once more data shows up, so the
+		// last chunk can always be marked final on Close.
+		if len(s.buf) == SealChunkSize {
+			if err := s.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(s.buf[len(s.buf):SealChunkSize], p)
+		s.buf = s.buf[:len(s.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (s *sealWriter) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.seal(true)
+}
+
+func (s *sealWriter) seal(final bool) error {
+	nonce := chunkNonce(s.header, s.counter)
+	s.out = s.aead.Seal(s.out[:0], nonce, s.buf, chunkAAD(s.header, final))
+	s.counter++
+	s.buf = s.buf[:0]
+	_, err := s.w.Write(s.out)
+	return err
+}
+
+// OpenReader decrypts a sealed stream.
+type OpenReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	header  []byte
+	offset  int64
+	chunk   []byte
+	buf     []byte
+	plain   []byte
+	counter uint32
+	done    bool
+}
+
+// NewOpenReader reads the stream header from r and returns a reader that
+// yields the authenticated plaintext.
+func NewOpenReader(r io.Reader, key []byte) (*OpenReader, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, sealHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("read sealed header: %w", err)
+	}
+	if string(header[:4]) != sealMagic {
+		return nil, errors.New("not a sealed stream")
+	}
+	chunkSize := binary.BigEndian.Uint32(header[20:24])
+	if chunkSize == 0 || chunkSize > 16<<20 {
+		return nil, fmt.Errorf("invalid sealed chunk size %d", chunkSize)
+	}
+	return &OpenReader{
+		r:      bufio.NewReaderSize(r, int(chunkSize)+sealTagSize),
+		aead:   aead,
+		header: header,
+		offset: int64(binary.BigEndian.Uint64(header[12:20])),
+		chunk:  make([]byte, int(chunkSize)+sealTagSize),
+		buf:    make([]byte, 0, chunkSize),
+	}, nil
+}
+
+// Offset reports the plaintext position the stream starts at.
+func (o *OpenReader) Offset() int64 { return o.offset }
+
+func (o *OpenReader) Read(p []byte) (int, error) {
+	for len(o.plain) == 0 {
+		if o.done {
+			return 0, io.EOF
+		}
+		if err := o.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, o.plain)
+	o.plain = o.plain[n:]
+	return n, nil
+}
+
+func (o *OpenReader) next() error {
+	n, err := io.ReadFull(o.r, o.chunk)
+	if err == io.EOF {
+		return ErrTruncated
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	final := err == io.ErrUnexpectedEOF
+	if !final {
+		if _, perr := o.r.Peek(1); perr == io.EOF {
+			final = true
+		} else if perr != nil {
+			return perr
+		}
+	}
+	if n < sealTagSize {
+		return ErrTruncated
+	}
+	nonce := chunkNonce(o.header, o.counter)
+	plain, err := o.aead.Open(o.buf[:0], nonce, o.chunk[:n], chunkAAD(o.header, final))
+	if err != nil {
+		if !final {
+			return errors.New("sealed stream: authentication failed")
+		}
+		// A stream cut at a chunk boundary decrypts as non-final.
+		if _, err2 := o.aead.Open(nil, nonce, o.chunk[:n], chunkAAD(o.header, false)); err2 == nil {
+			return ErrTruncated
+		}
+		return errors.New("sealed stream: authentication failed")
+	}
+	o.counter++
+	o.plain = plain
+	o.done = final
+	return nil
+}
+
+func chunkNonce(header []byte, counter uint32) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, header[4:12])
+	binary.BigEndian.PutUint32(nonce[8:], counter)
+	return nonce
+}
+
+func chunkAAD(header []byte, final bool) []byte {
+	flag := byte(0)
+	if final {
+		flag = 1
+	}
+	return append(bytes.Clone(header), flag)
+}
@@ -0,0 +1,62 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func sealBytes(t *testing.T, key, data []byte, offset int64) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	sw, err := NewSealWriter(&buf, key, offset)
+	if err != nil { t.Fatal(err) }
+	if _, err := sw.Write(data); err != nil { t.Fatal(err) }
+	if err := sw.Close(); err != nil { t.Fatal(err) }
+	return buf.Bytes()
+}
+
+func TestSealRoundTrip(t *testing.T) {
+	key, err := DeriveKey("secret")
+	if err != nil { t.Fatal(err) }
+	for _, n := range []int{0, 1, SealChunkSize, SealChunkSize + 1, 3*SealChunkSize + 7} {
+		data := bytes.Repeat([]byte{'z'}, n)
+		sealed := sealBytes(t, key, data, 42)
+		if int64(len(sealed)) != SealedSize(int64(n)) {
+			t.Fatalf("n=%d: sealed len %d, SealedSize %d", n, len(sealed), SealedSize(int64(n)))
+		}
+		or, err := NewOpenReader(bytes.NewReader(sealed), key)
+		if err != nil { t.Fatal(err) }
+		if or.Offset() != 42 { t.Fatalf("offset = %d, want 42", or.Offset()) }
+		got, err := io.ReadAll(or)
+		if err != nil { t.Fatalf("n=%d: %v", n, err) }
+		if !bytes.Equal(got, data) { t.Fatalf("n=%d: plaintext mismatch", n) }
+	}
+}
+
+func TestSealDetectsTamperingAndTruncation(t *testing.T) {
+	key, _ := DeriveKey("secret")
+	sealed := sealBytes(t, key, bytes.Repeat([]byte{'a'}, 2*SealChunkSize+10), 0)
+
+	// Cut at a chunk boundary: every remaining chunk authenticates, but the
+	// final marker is missing.
+	cut := sealed[:sealHeaderSize+SealChunkSize+sealTagSize]
+	or, _ := NewOpenReader(bytes.NewReader(cut), key)
+	if _, err := io.ReadAll(or); !errors.Is(err, ErrTruncated) {
+		t.Fatalf("truncated stream: err = %v, want ErrTruncated", err)
+	}
+
+	flipped := bytes.Clone(sealed)
+	flipped[sealHeaderSize+5] ^= 1
+	or, _ = NewOpenReader(bytes.NewReader(flipped), key)
+	if _, err := io.ReadAll(or); err == nil {
+		t.Fatal("tampered stream decrypted without error")
+	}
+
+	other, _ := DeriveKey("other")
+	or, _ = NewOpenReader(bytes.NewReader(sealed), other)
+	if _, err := io.ReadAll(or); err == nil {
+		t.Fatal("stream decrypted with the wrong key")
+	}
+}
@@ -2,11 +2,15 @@ package discovery
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/grandcat/zeroconf"
+	"github.com/zulfikawr/warp/internal/network"
 )
 
 // Advertiser represents an active mDNS advertisement.
@@ -16,19 +20,29 @@ type Advertiser struct {
 
 // Service describes a discovered warp endpoint.
 type Service struct {
-	Name  string
-	Mode  string // send|host
-	Token string
-	IP    net.IP
-	Port  int
-	URL   string
+	Name      string
+	Mode      string // send|host
+	Token     string
+	Nameplate string // set when the sender shares a short code instead of its token
+	// Fingerprint pins the TLS certificate of HTTPS services (hex SHA-256)
+	Fingerprint string
+	// FileName and Size describe what a sender shares; encrypted shares
+	// don't advertise them. Size is -1 when unknown.
+	FileName    string
+	Size        int64
+	Hostname    string
+	IP          net.IP
+	Zone        string // IPv6 zone for a link-local IP, as seen from this host
+	Port        int
+	URL         string
 }
 
 // Advertise publishes the service over mDNS.
 // mode: "send" or "host"
 // token: transfer token
 // path: URL path including leading slash (e.g., "/d/{token}")
-func Advertise(instance, mode, token, path string, ip net.IP, port int) (*Advertiser, error) {
+// extra: additional TXT records as key=value pairs
+func Advertise(instance, mode, token, path string, ip net.IP, port int, extra ...string) (*Advertiser, error) {
 	if ip == nil {
 		return nil, fmt.Errorf("ip is required")
 	}
@@ -39,6 +53,7 @@ func Advertise(instance, mode, token, path string, ip net.IP, port int) (*Advert
 		"path=" + path,
 		"ip=" + ip.String(),
 	}
+	txt = append(txt, extra...)
 
 	srv, err := zeroconf.Register(instance, "_warp._tcp", "local.", port, txt, nil)
 	if err != nil {
@@ -48,7 +63,7 @@ func Advertise(instance, mode, token, path string, ip net.IP, port int) (*Advert
 	return &Advertiser{server: srv}, nil
 }
 
-// Close stops advertising.
+// Close withdraws the advertisement, telling peers to forget it.
 func (a *Advertiser) Close() {
 	if a != nil && a.server != nil {
 		a.server.Shutdown()
@@ -58,50 +73,128 @@ func (a *Advertiser) Close() {
 // Browse discovers warp services via mDNS.
 // timeout defines how long to wait for responses.
 func Browse(ctx context.Context, timeout time.Duration) ([]Service, error) {
-	resolver, err := zeroconf.NewResolver(nil)
+	ifaces, err := net.Interfaces()
 	if err != nil {
 		return nil, err
 	}
 
-	entries := make(chan *zeroconf.ServiceEntry)
-	results := []Service{}
-
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	go func() {
-		for e := range entries {
-			if len(e.AddrIPv4) == 0 {
-				continue
-			}
-			ip := e.AddrIPv4[0]
-			mode := attr(e, "mode")
-			token := attr(e, "token")
-			path := attr(e, "path")
-			url := fmt.Sprintf("http://%s:%d%s", ip.String(), e.Port, path)
-			results = append(results, Service{
-				Name:  e.Instance,
-				Mode:  mode,
-				Token: token,
-				IP:    ip,
-				Port:  e.Port,
-				URL:   url,
-			})
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		seen    = map[string]bool{}
+		results = []Service{}
+	)
+	// One resolver per interface, so a link-local answer is dialled through
+	// the interface it arrived on
+	err = errors.New("no multicast interface to browse on")
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 {
+			continue
 		}
-	}()
-
-	err = resolver.Browse(ctx, "_warp._tcp", "local.", entries)
+		resolver, rerr := zeroconf.NewResolver(zeroconf.SelectIfaces([]net.Interface{iface}))
+		if rerr != nil {
+			err = rerr
+			continue
+		}
+		entries := make(chan *zeroconf.ServiceEntry)
+		if rerr := resolver.Browse(ctx, "_warp._tcp", "local.", entries); rerr != nil {
+			err = rerr
+			continue
+		}
+		err = nil
+		wg.Add(1)
+		go func(zone string) {
+			defer wg.Done()
+			// The resolver closes entries once ctx is done
+			for e := range entries {
+				svc, ok := entryService(e, zone)
+				if !ok {
+					continue
+				}
+				mu.Lock()
+				if !seen[svc.Name] {
+					seen[svc.Name] = true
+					results = append(results, svc)
+				}
+				mu.Unlock()
+			}
+		}(iface.Name)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	<-ctx.Done()
-	// allow goroutine to finish
-	time.Sleep(50 * time.Millisecond)
-
+	wg.Wait()
 	return results, nil
 }
 
+// entryService describes the service in e, answered on the interface named
+// zone.
+func entryService(e *zeroconf.ServiceEntry, zone string) (Service, bool) {
+	ip := entryIP(e)
+	// The server listens on the address it advertised, which may
+	// not be the first A or AAAA record on multi-homed hosts.
+	if txtIP := net.ParseIP(attr(e, "ip")); txtIP != nil {
+		ip = txtIP
+	}
+	if ip == nil {
+		return Service{}, false
+	}
+	// Only link-local peers need our interface to be reached
+	if ip.To4() != nil || !ip.IsLinkLocalUnicast() {
+		zone = ""
+	}
+	path := attr(e, "path")
+	scheme := attr(e, "scheme")
+	if scheme == "" {
+		scheme = "http"
+	}
+	fp := attr(e, "fp")
+	size, err := strconv.ParseInt(attr(e, "size"), 10, 64)
+	if err != nil {
+		size = -1
+	}
+	url := fmt.Sprintf("%s://%s%s", scheme, network.URLHost(ip, zone, e.Port), path)
+	if fp != "" {
+		url += "#fp=" + fp
+	}
+	return Service{
+		Name:        e.Instance,
+		Mode:        attr(e, "mode"),
+		Token:       attr(e, "token"),
+		Nameplate:   attr(e, "nameplate"),
+		Fingerprint: fp,
+		FileName:    attr(e, "name"),
+		Size:        size,
+		Hostname:    attr(e, "host"),
+		IP:          ip,
+		Zone:        zone,
+		Port:        e.Port,
+		URL:         url,
+	}, true
+}
+
+// entryIP picks an address from the A and AAAA records of e, preferring
+// IPv4, then routable IPv6, then link-local IPv6.
+func entryIP(e *zeroconf.ServiceEntry) net.IP {
+	if len(e.AddrIPv4) > 0 {
+		return e.AddrIPv4[0]
+	}
+	var local net.IP
+	for _, ip := range e.AddrIPv6 {
+		if !ip.IsLinkLocalUnicast() {
+			return ip
+		}
+		if local == nil {
+			local = ip
+		}
+	}
+	return local
+}
+
 func attr(e *zeroconf.ServiceEntry, key string) string {
 	prefix := key + "="
 	for _, t := range e.Text {
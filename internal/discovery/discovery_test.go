@@ -5,6 +5,8 @@ import (
 	"net"
 	"testing"
 	"time"
+
+	"github.com/grandcat/zeroconf"
 )
 
 func TestAdvertiseAndBrowse(t *testing.T) {
@@ -13,7 +15,7 @@ func TestAdvertiseAndBrowse(t *testing.T) {
 	token := "tokendiscovery"
 	path := "/d/" + token
 
-	adv, err := Advertise("warp-test-"+token[:6], "send", token, path, ip, port)
+	adv, err := Advertise("warp-test-"+token[:6], "send", token, path, ip, port, "name=report.pdf", "size=1234", "host=laptop")
 	if err != nil {
 		t.Fatalf("advertise failed: %v", err)
 	}
@@ -35,6 +37,9 @@ func TestAdvertiseAndBrowse(t *testing.T) {
 			if svc.URL == "" {
 				t.Fatalf("expected URL to be set")
 			}
+			if svc.FileName != "report.pdf" || svc.Size != 1234 || svc.Hostname != "laptop" {
+				t.Fatalf("unexpected description: %q %d %q", svc.FileName, svc.Size, svc.Hostname)
+			}
 			break
 		}
 	}
@@ -42,3 +47,27 @@ func TestAdvertiseAndBrowse(t *testing.T) {
 		t.Fatalf("expected to find advertised service")
 	}
 }
+
+func TestEntryServiceZone(t *testing.T) {
+	cases := []struct {
+		ip   string
+		want string
+	}{
+		{"fe80::1", "[fe80::1%25eth1]:9000"},
+		{"fd00::2", "[fd00::2]:9000"},
+		{"2001:db8::3", "[2001:db8::3]:9000"},
+		{"192.168.1.5", "192.168.1.5:9000"},
+	}
+	for _, c := range cases {
+		e := zeroconf.NewServiceEntry("warp-x", "_warp._tcp", "local.")
+		e.Port = 9000
+		e.Text = []string{"ip=" + c.ip, "path=/d/tok"}
+		svc, ok := entryService(e, "eth1")
+		if !ok {
+			t.Fatalf("%s: no service", c.ip)
+		}
+		if want := "http://" + c.want + "/d/tok"; svc.URL != want {
+			t.Errorf("%s: URL = %q, want %q", c.ip, svc.URL, want)
+		}
+	}
+}
@@ -3,15 +3,29 @@ package network
 import (
 	"errors"
 	"net"
+	"strconv"
 )
 
-// DiscoverLANIP finds a suitable IPv4 LAN address.
+// DiscoverLANIP finds a suitable LAN address, preferring private IPv4, then
+// IPv6 unique local, then global IPv6, then IPv6 link-local addresses.
 // If interfaceName is non-empty, only that interface is considered.
 func DiscoverLANIP(interfaceName string) (net.IP, error) {
+	addr, err := DiscoverLANAddr(interfaceName)
+	if err != nil {
+		return nil, err
+	}
+	return addr.IP, nil
+}
+
+// DiscoverLANAddr is DiscoverLANIP with the IPv6 zone, which link-local
+// addresses need to be dialled or bound.
+func DiscoverLANAddr(interfaceName string) (*net.IPAddr, error) {
 	ifs, err := net.Interfaces()
 	if err != nil {
 		return nil, err
 	}
+	var best *net.IPAddr
+	bestRank := 0
 	for _, iface := range ifs {
 		if interfaceName != "" && iface.Name != interfaceName {
 			continue
@@ -35,16 +49,53 @@ func DiscoverLANIP(interfaceName string) (net.IP, error) {
 			if ip == nil {
 				continue
 			}
-			ip4 := ip.To4()
-			if ip4 == nil {
-				continue // skip IPv6
+			// Lower rank wins; the first address of a rank is kept
+			rank := 0
+			switch {
+			case ip.To4() != nil && isPrivateIPv4(ip.To4()):
+				return &net.IPAddr{IP: ip.To4()}, nil
+			case ip.To4() != nil:
+				continue
+			case isULA(ip):
+				rank = 1
+			case ip.IsGlobalUnicast():
+				rank = 2
+			case ip.IsLinkLocalUnicast():
+				rank = 3
+			default:
+				continue
 			}
-			if isPrivateIPv4(ip4) {
-				return ip4, nil
+			if best == nil || rank < bestRank {
+				best = &net.IPAddr{IP: ip}
+				if rank == 3 {
+					best.Zone = iface.Name
+				}
+				bestRank = rank
 			}
 		}
 	}
-	return nil, errors.New("no suitable LAN IPv4 address found")
+	if best == nil {
+		return nil, errors.New("no suitable LAN IPv4 or IPv6 address found")
+	}
+	return best, nil
+}
+
+// URLHost formats ip, its zone (may be empty) and port as the host part of
+// a URL: IPv6 goes in brackets and the zone separator is escaped.
+func URLHost(ip net.IP, zone string, port int) string {
+	host := ip.String()
+	if ip.To4() != nil {
+		return host + ":" + strconv.Itoa(port)
+	}
+	if zone != "" {
+		host += "%25" + zone
+	}
+	return "[" + host + "]:" + strconv.Itoa(port)
+}
+
+// isULA reports whether ip is an IPv6 unique local address (fc00::/7).
+func isULA(ip net.IP) bool {
+	return ip.To4() == nil && len(ip) == net.IPv6len && ip[0]&0xfe == 0xfc
 }
 
 func isPrivateIPv4(ip net.IP) bool {
@@ -27,3 +27,23 @@ func TestIsPrivateIPv4(t *testing.T) {
 		}
 	}
 }
+
+func TestURLHost(t *testing.T) {
+	cases := []struct{
+		ip   string
+		zone string
+		want string
+	}{
+		{"192.168.1.5", "", "192.168.1.5:8080"},
+		{"fd00::2", "", "[fd00::2]:8080"},
+		{"fe80::1", "eth0", "[fe80::1%25eth0]:8080"},
+	}
+	for _, c := range cases {
+		if got := URLHost(net.ParseIP(c.ip), c.zone, 8080); got != c.want {
+			t.Errorf("URLHost(%s, %q) = %s, want %s", c.ip, c.zone, got, c.want)
+		}
+	}
+	if !isULA(net.ParseIP("fd12::1")) || isULA(net.ParseIP("fe80::1")) || isULA(net.ParseIP("10.0.0.1")) {
+		t.Error("isULA misclassified an address")
+	}
+}
@@ -0,0 +1,31 @@
+package protocol
+
+// FormatQuery is the query parameter that picks the archive format of a
+// directory download, e.g. ?format=tar. Receivers may instead name the
+// format's media type in Accept.
+const FormatQuery = "format"
+
+// Archive formats for directory downloads. Only zip downloads resume; the
+// tar formats keep Unix permissions, symlinks and mtimes.
+const (
+	FormatZip    = "zip"
+	FormatTar    = "tar"
+	FormatTarGz  = "tgz"
+	FormatTarZst = "zst"
+)
+
+// ArchiveMediaTypes maps each archive format to its Content-Type.
+var ArchiveMediaTypes = map[string]string{
+	FormatZip:    "application/zip",
+	FormatTar:    "application/x-tar",
+	FormatTarGz:  "application/gzip",
+	FormatTarZst: "application/zstd",
+}
+
+// ArchiveExtensions maps each archive format to its file name extension.
+var ArchiveExtensions = map[string]string{
+	FormatZip:    ".zip",
+	FormatTar:    ".tar",
+	FormatTarGz:  ".tar.gz",
+	FormatTarZst: ".tar.zst",
+}
@@ -0,0 +1,17 @@
+package protocol
+
+// DigestMediaType is the Content-Type of a file digest. Receivers ask for
+// it via Accept on any file URL to verify what they downloaded.
+const DigestMediaType = "application/vnd.warp.digest+json"
+
+// DigestChunkSize is the span of the file each chunk hash covers.
+const DigestChunkSize = 4 << 20
+
+// Digest holds the SHA-256 of a file and of each DigestChunkSize span of
+// it, so a mismatch can be narrowed down to the ranges to fetch again.
+type Digest struct {
+	Size      int64    `json:"size"`
+	ChunkSize int64    `json:"chunk_size"`
+	SHA256    string   `json:"sha256"`
+	Chunks    []string `json:"chunks"`
+}
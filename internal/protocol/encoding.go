@@ -0,0 +1,16 @@
+package protocol
+
+// Compressed downloads. A receiver lists the codings it decodes in
+// AcceptEncodingHeader, preferred first; the sender may then compress a
+// file body, naming the coding in EncodingHeader and the decoded length in
+// PlainLengthHeader. Unlike Content-Encoding, the coding applies to each
+// response on its own, after the range is taken, so Range and Content-Range
+// keep counting uncompressed bytes and compressed downloads resume and
+// split into segments as usual. Sealed bodies are compressed, then sealed.
+const (
+	AcceptEncodingHeader = "X-Warp-Accept-Encoding"
+	EncodingHeader       = "X-Warp-Encoding"
+
+	EncodingZstd = "zstd"
+	EncodingGzip = "gzip"
+)
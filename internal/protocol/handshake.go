@@ -7,9 +7,56 @@ const (
 	UploadPathPrefix = "/u/"
 )
 
+// Headers used when the payload is end-to-end encrypted.
+const (
+	// CipherHeader names the cipher sealing the response body.
+	CipherHeader = "X-Warp-Cipher"
+	// PlainLengthHeader carries the plaintext length of a sealed or
+	// compressed body.
+	PlainLengthHeader = "X-Warp-Length"
+	CipherAESGCM = "aes-256-gcm"
+	// KeyFragment is the URL fragment parameter holding the token secret.
+	// Fragments are never sent in HTTP requests.
+	KeyFragment = "key"
+	// FingerprintFragment is the URL fragment parameter pinning the
+	// server's TLS certificate (hex SHA-256 of its DER encoding).
+	FingerprintFragment = "fp"
+)
+
 var (
 	// Generous timeouts for large file transfers (gigabytes over slower connections)
 	ReadTimeout  = 10 * time.Minute
 	WriteTimeout = 15 * time.Minute
 	IdleTimeout  = 5 * time.Minute
 )
+
+// PakePathPrefix serves the short-code exchange: a receiver POSTs its SPAKE2
+// message to PakePathPrefix+"start", then proves it derived the same key at
+// PakePathPrefix+"confirm" and receives a PakeTicket sealed under that key.
+const PakePathPrefix = "/pake/"
+
+type PakeStart struct {
+	Msg []byte `json:"msg"`
+}
+
+type PakeReply struct {
+	ID  string `json:"id"`
+	Msg []byte `json:"msg"`
+}
+
+type PakeConfirm struct {
+	ID  string `json:"id"`
+	MAC []byte `json:"mac"`
+}
+
+type PakeGrant struct {
+	Box []byte `json:"box"`
+}
+
+// PakeTicket is what a successful exchange unlocks: the URL path token and
+// the payload secret.
+type PakeTicket struct {
+	Token       string `json:"token"`
+	Secret      string `json:"secret"`
+	Fingerprint string `json:"fp,omitempty"`
+}
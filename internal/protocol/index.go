@@ -0,0 +1,48 @@
+package protocol
+
+// IndexMediaType is the Content-Type of the JSON index a multi-item share
+// serves at PathPrefix+token. Receivers ask for it via Accept; browsers get
+// an HTML page instead.
+const IndexMediaType = "application/vnd.warp.index+json"
+
+// AllItemsPath is the item path serving every item as one archive.
+const AllItemsPath = "all"
+
+// Index lists the items of a share. URLs are absolute paths on the server.
+type Index struct {
+	Items []IndexItem `json:"items"`
+	All   string      `json:"all"`
+}
+
+type IndexItem struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	Dir  bool   `json:"dir,omitempty"`
+	URL  string `json:"url"`
+}
+
+// ManifestMediaType is the Content-Type of a directory manifest. Receivers
+// that send it in Accept get the manifest instead of a zip and fetch each
+// file on its own, so every file can resume independently.
+const ManifestMediaType = "application/vnd.warp.manifest+json"
+
+// Manifest lists the files and subdirectories of a shared directory, parents
+// before children.
+type Manifest struct {
+	Root  string          `json:"root"`
+	Files []ManifestEntry `json:"files"`
+}
+
+// ManifestEntry describes one file, subdirectory or symlink. Path is
+// slash-separated and relative to the directory; URL is an absolute path on
+// the server and empty for directories and symlinks. Link is a symlink's
+// target, as stored in the link.
+type ManifestEntry struct {
+	Path  string `json:"path"`
+	Dir   bool   `json:"dir,omitempty"`
+	Link  string `json:"link,omitempty"`
+	Size  int64  `json:"size"`
+	Mode  uint32 `json:"mode"`  // permission bits
+	MTime int64  `json:"mtime"` // Unix seconds
+	URL   string `json:"url,omitempty"`
+}
@@ -0,0 +1,26 @@
+package protocol
+
+// UploadSessionsPath is where upload sessions live, under
+// UploadPathPrefix+token+"/". POST to it with an UploadSessionRequest
+// creates a session, or resumes the one for the same file. Under
+// UploadSessionsPath+"/"+id, GET reports the session, POST with an
+// X-Upload-Offset header stores a chunk, and POST to .../finish moves the
+// completed file into place.
+const UploadSessionsPath = "sessions"
+
+type UploadSessionRequest struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"` // hex, required; checked on finish
+}
+
+// UploadSession reports an upload's progress. Missing lists the inclusive
+// byte ranges the host has yet to receive.
+type UploadSession struct {
+	ID       string     `json:"id"`
+	Name     string     `json:"name"`
+	Size     int64      `json:"size"`
+	Missing  [][2]int64 `json:"missing"`
+	Complete bool       `json:"complete"`
+	Filename string     `json:"filename,omitempty"` // final name, once finished
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"compress/gzip"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/zulfikawr/warp/internal/protocol"
+)
+
+const (
+	// minEncodeSize is the smallest body worth compressing.
+	minEncodeSize = 4 << 10
+	// encodeSamples and encodeSampleSize are how many stretches of a body,
+	// and how large, are trial-compressed before the whole of it is.
+	encodeSamples    = 4
+	encodeSampleSize = 16 << 10
+)
+
+var (
+	sampleEncoderOnce sync.Once
+	sampleEncoder     *zstd.Encoder // EncodeAll is safe for concurrent use
+	sampleEncoderErr  error
+)
+
+// newSampleEncoder returns the encoder that trial-compresses samples,
+// building it on first use.
+func newSampleEncoder() (*zstd.Encoder, error) {
+	sampleEncoderOnce.Do(func() {
+		sampleEncoder, sampleEncoderErr = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+		if sampleEncoderErr != nil {
+			log.Printf("compression disabled: %v", sampleEncoderErr)
+		}
+	})
+	return sampleEncoder, sampleEncoderErr
+}
+
+// negotiateEncoding picks how to compress bytes [start, start+n) of r for
+// the receiver of req: the coding it rates highest of those the sender
+// supports. Small bodies go out as they are, and so do bodies whose samples
+// don't shrink by a tenth, such as media and archives, which are
+// compressed already.
+func negotiateEncoding(req *http.Request, r io.ReaderAt, start, n int64) string {
+	if n < minEncodeSize {
+		return ""
+	}
+	coding := preferredCoding(req.Header.Get(protocol.AcceptEncodingHeader))
+	if coding == "" || !compressible(r, start, n) {
+		return ""
+	}
+	return coding
+}
+
+// preferredCoding returns the supported coding an Accept-Encoding style
+// list rates highest, the first listed on a tie, or "" when it accepts
+// none. A coding with q=0, or a q-value that doesn't parse, is refused.
+func preferredCoding(accept string) string {
+	best, bestQ := "", 0.0
+	for _, c := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(c, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != protocol.EncodingZstd && name != protocol.EncodingGzip {
+			continue
+		}
+		q := 1.0
+		for _, p := range strings.Split(params, ";") {
+			k, v, ok := strings.Cut(p, "=")
+			if !ok || !strings.EqualFold(strings.TrimSpace(k), "q") {
+				continue
+			}
+			f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				f = 0
+			}
+			q = f
+		}
+		if q > bestQ {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+// compressible trial-compresses stretches spread evenly over bytes
+// [start, start+n) of r.
+func compressible(r io.ReaderAt, start, n int64) bool {
+	size := min(n/encodeSamples, encodeSampleSize)
+	sample := make([]byte, encodeSamples*size)
+	for i := int64(0); i < encodeSamples; i++ {
+		off := start + i*(n-size)/(encodeSamples-1)
+		if _, err := io.ReadFull(io.NewSectionReader(r, off, size), sample[i*size:(i+1)*size]); err != nil {
+			return false
+		}
+	}
+	enc, err := newSampleEncoder()
+	if err != nil {
+		return false
+	}
+	return len(enc.EncodeAll(sample, nil)) < len(sample)*9/10
+}
+
+// newEncoder returns a writer compressing into w with coding, or w itself
+// when coding is empty.
+func newEncoder(w io.Writer, coding string) (io.WriteCloser, error) {
+	switch coding {
+	case protocol.EncodingZstd:
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	case protocol.EncodingGzip:
+		return gzip.NewWriterLevel(w, gzip.BestSpeed)
+	}
+	return nopWriteCloser{w}, nil
+}
+
+// writeBody answers with status and n bytes of r from start, compressed
+// with coding when it is set and sealed when the share is encrypted. It
+// returns how many of the bytes went out.
+func (s *Server) writeBody(w http.ResponseWriter, status int, r io.ReaderAt, start, n int64, coding string) (int64, error) {
+	w.Header().Add("Vary", protocol.AcceptEncodingHeader)
+	if coding == "" {
+		s.setBodyLength(w, n)
+	} else {
+		s.setBodyLength(w, -1)
+		w.Header().Set(protocol.EncodingHeader, coding)
+		w.Header().Set(protocol.PlainLengthHeader, strconv.FormatInt(n, 10))
+	}
+	w.WriteHeader(status)
+	body, err := s.bodyWriter(w, start)
+	if err != nil {
+		return 0, err
+	}
+	enc, err := newEncoder(body, coding)
+	if err != nil {
+		return 0, err
+	}
+	bufPtr := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(bufPtr)
+	var src io.Reader = io.NewSectionReader(r, start, n)
+	if coding != "" {
+		src = countBody(w, src)
+	}
+	copied, err := io.CopyBuffer(enc, src, *bufPtr)
+	if err != nil {
+		return copied, err
+	}
+	if copied != n {
+		// The file shrank; a final chunk would pass the stream off as whole
+		return copied, io.ErrUnexpectedEOF
+	}
+	if err := enc.Close(); err != nil {
+		return copied, err
+	}
+	return copied, body.Close()
+}
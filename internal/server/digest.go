@@ -0,0 +1,73 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/zulfikawr/warp/internal/protocol"
+)
+
+// cachedDigest is a file digest along with the file state it was taken of.
+type cachedDigest struct {
+	etag   string
+	digest protocol.Digest
+}
+
+// fileDigest hashes f, reusing the previous result while the file's ETag
+// is unchanged.
+func (s *Server) fileDigest(path string, f *os.File, fi os.FileInfo) (protocol.Digest, error) {
+	if v, ok := s.digests.Load(path); ok {
+		c := v.(*cachedDigest)
+		if c.etag == fileETag(fi) {
+			return c.digest, nil
+		}
+	}
+	d := protocol.Digest{Size: fi.Size(), ChunkSize: protocol.DigestChunkSize, Chunks: []string{}}
+	whole := sha256.New()
+	buf := make([]byte, protocol.DigestChunkSize)
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			sum := sha256.Sum256(buf[:n])
+			d.Chunks = append(d.Chunks, hex.EncodeToString(sum[:]))
+			whole.Write(buf[:n])
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return protocol.Digest{}, err
+		}
+	}
+	d.SHA256 = hex.EncodeToString(whole.Sum(nil))
+	s.digests.Store(path, &cachedDigest{etag: fileETag(fi), digest: d})
+	return d, nil
+}
+
+// serveDigest answers a digest request for an open file.
+func (s *Server) serveDigest(w http.ResponseWriter, path string, f *os.File, fi os.FileInfo) {
+	d, err := s.fileDigest(path, f, fi)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	data, err := json.Marshal(d)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", protocol.DigestMediaType)
+	w.Header().Set("Cache-Control", "no-store")
+	s.setBodyLength(w, int64(len(data)))
+	body, err := s.bodyWriter(w, 0)
+	if err != nil {
+		return
+	}
+	if _, err := body.Write(data); err == nil {
+		body.Close()
+	}
+}
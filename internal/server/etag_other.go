@@ -0,0 +1,10 @@
+//go:build !unix
+
+package server
+
+import "os"
+
+// fileID has no inode to offer here; ETags rely on size and mtime alone.
+func fileID(fi os.FileInfo) uint64 {
+	return 0
+}
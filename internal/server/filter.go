@@ -0,0 +1,149 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Exclude and include patterns, and .gitignore files, share gitignore
+// syntax: * and ? stop at slashes, ** spans them, a trailing slash matches
+// directories only, and a pattern with a slash elsewhere is anchored to the
+// directory it applies to while one without matches at any depth. A leading
+// ! re-includes what an earlier pattern matched.
+
+// pathRule is one compiled pattern.
+type pathRule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// compileRules compiles patterns, skipping blank ones.
+func compileRules(patterns []string) ([]pathRule, error) {
+	var rules []pathRule
+	for _, p := range patterns {
+		if strings.TrimSpace(p) == "" {
+			continue
+		}
+		r, err := compileRule(p)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func compileRule(pattern string) (pathRule, error) {
+	var r pathRule
+	p := pattern
+	if strings.HasPrefix(p, "!") {
+		r.negate, p = true, p[1:]
+	}
+	if strings.HasSuffix(p, "/") {
+		r.dirOnly, p = true, strings.TrimRight(p, "/")
+	}
+	var b strings.Builder
+	b.WriteString("^")
+	if !strings.Contains(p, "/") {
+		b.WriteString("(?:.*/)?")
+	}
+	rs := []rune(strings.TrimPrefix(p, "/"))
+	for i := 0; i < len(rs); i++ {
+		switch c := rs[i]; {
+		case c == '*' && i+1 < len(rs) && rs[i+1] == '*' && (i+2 == len(rs) || rs[i+2] == '/'):
+			if i+2 == len(rs) {
+				b.WriteString(".*")
+			} else {
+				b.WriteString("(?:.*/)?")
+			}
+			i += 2
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			// A ] right after the [ belongs to the class
+			end := -1
+			for j := i + 2; j < len(rs); j++ {
+				if rs[j] == ']' {
+					end = j
+					break
+				}
+			}
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := string(rs[i+1 : end])
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i = end
+		case c == '\\' && i+1 < len(rs):
+			i++
+			b.WriteString(regexp.QuoteMeta(string(rs[i])))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return r, fmt.Errorf("invalid pattern %q", pattern)
+	}
+	r.re = re
+	return r, nil
+}
+
+// applyRules returns whether rel (slash-separated) is matched by rules,
+// given whether it was matched before them. The last matching rule wins.
+func applyRules(rules []pathRule, rel string, dir, matched bool) bool {
+	for _, r := range rules {
+		if (!r.dirOnly || dir) && r.re.MatchString(rel) {
+			matched = !r.negate
+		}
+	}
+	return matched
+}
+
+// ignoreFile is the rules of one .gitignore, which apply below base.
+type ignoreFile struct {
+	base  string // slash-separated, relative to the walk's root
+	rules []pathRule
+}
+
+// readIgnoreFile reads the .gitignore in dir, if there is one. Malformed
+// patterns are skipped as git skips them.
+func readIgnoreFile(dir, base string) *ignoreFile {
+	data, err := os.ReadFile(filepath.Join(dir, ".gitignore"))
+	if err != nil {
+		return nil
+	}
+	f := &ignoreFile{base: base}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), " \r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if r, err := compileRule(line); err == nil {
+			f.rules = append(f.rules, r)
+		}
+	}
+	return f
+}
+
+// relTo returns rel relative to the directory base.
+func relTo(base, rel string) string {
+	if base == "." {
+		return rel
+	}
+	return strings.TrimPrefix(rel, base+"/")
+}
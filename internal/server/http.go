@@ -1,9 +1,12 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	_ "embed"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -17,11 +20,14 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/zulfikawr/warp/internal/crypto"
 	"github.com/zulfikawr/warp/internal/discovery"
 	"github.com/zulfikawr/warp/internal/network"
 	"github.com/zulfikawr/warp/internal/protocol"
+	"github.com/zulfikawr/warp/internal/ui"
 )
 
 //go:embed static/upload.html
@@ -40,15 +46,65 @@ type Server struct {
 	InterfaceName string
 	Token         string
 	SrcPath       string
+	// SrcPaths shares further paths in the same session. With more than one
+	// item, the token URL serves an index instead of the item itself.
+	SrcPaths      []string
+	items         []shareItem
 	// Host mode (reverse drop)
 	HostMode      bool
 	UploadDir     string
 	TextContent   string // If set, serves text instead of file
+	// ArchiveFormat is how directories download unless the receiver asks
+	// for another format: zip (the default), tar, tgz or zst.
+	ArchiveFormat string
+	// Symlinks is what happens to symlinks inside shared directories:
+	// SymlinksPreserve (the default), SymlinksFollow or SymlinksSkip.
+	Symlinks      string
+	// Exclude and Include filter what of a shared directory is sent, with
+	// gitignore-style patterns; GitIgnore also honours the directory's
+	// .gitignore files and leaves out .git.
+	Exclude       []string
+	Include       []string
+	GitIgnore     bool
+	tree          walkOptions
+	// MaxDownloads stops the share once that many receivers have it all;
+	// 0 means no limit. Expire stops it after that long; 0 means never.
+	MaxDownloads  int
+	Expire        time.Duration
+	limits        *limiter
+	// Secret enables end-to-end encryption: payloads are sealed with a key
+	// derived from it, and it travels to receivers only in the URL fragment.
+	Secret        string
+	// Code is a short code receivers authenticate with via PAKE to obtain
+	// Token and Secret. The token is then never advertised over mDNS.
+	Code          string
+	// TLS serves HTTPS with an ephemeral self-signed certificate whose
+	// fingerprint is pinned through the URL fragment.
+	TLS           bool
+	Fingerprint   string // hex SHA-256 of the certificate, set by Start
+	nameplate     string
+	pake          pakeState
+	key           []byte
 	ip            net.IP
+	// Port is the port to listen on; 0 picks a free one. Start sets it to
+	// the port in use.
 	Port          int
+	// ListenAddr is the IP address to bind, such as 0.0.0.0 or :: for every
+	// interface, or fe80::1%eth0 with a zone. Empty binds the LAN address
+	// only. URLs name the LAN address unless ListenAddr is a specific IP.
+	ListenAddr    string
 	httpServer    *http.Server
 	advertiser    *discovery.Advertiser
+	done          chan struct{}
+	stopOnce      sync.Once
+	stopErr       error
 	chunkTimes    sync.Map // filename -> *chunkStat
+	digests       sync.Map // path -> *cachedDigest
+	crcs          sync.Map // path -> *cachedCRC
+	itemSizes     sync.Map // item index -> int64
+	transfers     *transfers
+	sessions      map[string]*uploadSession
+	sessionsMu    sync.Mutex
 }
 
 type chunkStat struct {
@@ -82,11 +138,58 @@ func (ln tcpKeepAliveListener) Accept() (net.Conn, error) {
 
 // Start initializes and starts the HTTP server. It returns the accessible URL.
 func (s *Server) Start() (string, error) {
-	ip, err := network.DiscoverLANIP(s.InterfaceName)
-	if err != nil {
-		return "", err
+	var bind *net.IPAddr
+	if s.ListenAddr != "" {
+		// Link-local addresses carry their zone: fe80::1%eth0
+		host, zone, _ := strings.Cut(s.ListenAddr, "%")
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return "", fmt.Errorf("invalid listen address %q", s.ListenAddr)
+		}
+		bind = &net.IPAddr{IP: ip, Zone: zone}
+	}
+	if s.Port < 0 || s.Port > 65535 {
+		return "", fmt.Errorf("invalid port %d", s.Port)
+	}
+	addr := bind
+	if addr == nil || addr.IP.IsUnspecified() {
+		lan, err := network.DiscoverLANAddr(s.InterfaceName)
+		if err != nil {
+			return "", err
+		}
+		addr = lan
+	}
+	if bind == nil {
+		bind = addr
 	}
+	ip := addr.IP
 	s.ip = ip
+	var err error
+	s.done = make(chan struct{})
+	s.transfers = &transfers{byKey: make(map[transferKey]*transfer)}
+	if s.Code != "" {
+		if _, s.nameplate, err = crypto.ParseCode(s.Code); err != nil {
+			return "", err
+		}
+		if s.Secret == "" || s.HostMode {
+			return "", errors.New("short codes require an encrypted send")
+		}
+	}
+	if s.Secret != "" && !s.HostMode {
+		if s.key, err = crypto.DeriveKey(s.Secret); err != nil {
+			return "", err
+		}
+	}
+	if !s.HostMode && s.TextContent == "" {
+		if err := s.buildItems(); err != nil {
+			return "", err
+		}
+	}
+	if !s.HostMode && s.MaxDownloads > 0 {
+		if s.limits, err = s.newLimiter(); err != nil {
+			return "", err
+		}
+	}
 
 	mux := http.NewServeMux()
 	// Health endpoint for realtime status checks
@@ -96,6 +199,9 @@ func (s *Server) Start() (string, error) {
 	} else {
 		mux.HandleFunc(protocol.PathPrefix, s.handleDownload)
 	}
+	if s.Code != "" {
+		mux.HandleFunc(protocol.PakePathPrefix, s.handlePake)
+	}
 
 	s.httpServer = &http.Server{
 		ReadTimeout:       protocol.ReadTimeout,
@@ -109,9 +215,12 @@ func (s *Server) Start() (string, error) {
 	}
 
 	// Create standard TCP listener
-	ln, err := net.Listen("tcp", fmt.Sprintf("%s:0", ip.String()))
+	ln, err := net.Listen("tcp", net.JoinHostPort(bind.String(), strconv.Itoa(s.Port)))
 	if err != nil {
-		return "", err
+		if errors.Is(err, syscall.EADDRINUSE) {
+			return "", fmt.Errorf("port %d is already in use on %s; choose another with --port", s.Port, bind)
+		}
+		return "", fmt.Errorf("listen on %s port %d: %w", bind, s.Port, err)
 	}
 	
 	// Wrap with TCP optimizations
@@ -121,20 +230,26 @@ func (s *Server) Start() (string, error) {
 		return "", fmt.Errorf("expected TCP listener")
 	}
 	optimizedListener := tcpKeepAliveListener{tcpListener}
-	
-	addr := optimizedListener.Addr().String() // ip:port
-	parts := strings.Split(addr, ":")
-	if len(parts) < 2 {
-		_ = optimizedListener.Close()
-		return "", fmt.Errorf("unexpected listener addr: %s", addr)
+	var serveListener net.Listener = optimizedListener
+	scheme := "http"
+	if s.TLS {
+		cert, fp, err := generateCertificate(ip)
+		if err != nil {
+			_ = ln.Close()
+			return "", err
+		}
+		s.Fingerprint = fp
+		serveListener = tls.NewListener(optimizedListener, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		})
+		scheme = "https"
 	}
-	portStr := parts[len(parts)-1]
-	var port int
-	fmt.Sscanf(portStr, "%d", &port)
-	s.Port = port
+	
+	s.Port = optimizedListener.Addr().(*net.TCPAddr).Port
 
 	go func() {
-		_ = s.httpServer.Serve(optimizedListener)
+		_ = s.httpServer.Serve(serveListener)
 	}()
 
 	// Advertise via mDNS for discovery (best-effort)
@@ -145,17 +260,52 @@ func (s *Server) Start() (string, error) {
 		path = protocol.UploadPathPrefix + s.Token
 	}
 	instance := fmt.Sprintf("warp-%s", s.Token[:6])
-	adv, err := discovery.Advertise(instance, mode, s.Token, path, s.ip, s.Port)
+	advToken := s.Token
+	extra := s.describe()
+	if s.TLS {
+		extra = append(extra, "scheme="+scheme, "fp="+s.Fingerprint)
+	}
+	if s.nameplate != "" {
+		// Receivers get the token from the PAKE exchange, never from mDNS
+		instance = fmt.Sprintf("warp-%s-%d", s.nameplate, s.Port)
+		advToken = ""
+		path = protocol.PakePathPrefix
+		extra = append(extra, "nameplate="+s.nameplate)
+	}
+	adv, err := discovery.Advertise(instance, mode, advToken, path, s.ip, s.Port, extra...)
 	if err != nil {
 		log.Printf("mDNS advertise failed: %v", err)
 	} else {
 		s.advertiser = adv
 	}
 
+	// A zone names one of our own interfaces, which means nothing to the
+	// machine the URL is shared with
+	host := network.URLHost(ip, "", s.Port)
+	u := fmt.Sprintf("%s://%s%s%s", scheme, host, protocol.PathPrefix, s.Token)
 	if s.HostMode {
-		return fmt.Sprintf("http://%s:%d%s%s", ip.String(), s.Port, protocol.UploadPathPrefix, s.Token), nil
+		u = fmt.Sprintf("%s://%s%s%s", scheme, host, protocol.UploadPathPrefix, s.Token)
+	}
+	frag := url.Values{}
+	if s.key != nil {
+		frag.Set(protocol.KeyFragment, s.Secret)
+	}
+	if s.Fingerprint != "" {
+		frag.Set(protocol.FingerprintFragment, s.Fingerprint)
+	}
+	if len(frag) > 0 {
+		u += "#" + frag.Encode()
 	}
-	return fmt.Sprintf("http://%s:%d%s%s", ip.String(), s.Port, protocol.PathPrefix, s.Token), nil
+	if s.Expire > 0 && !s.HostMode {
+		go func() {
+			select {
+			case <-time.After(s.Expire):
+				s.stop(ErrExpired)
+			case <-s.done:
+			}
+		}()
+	}
+	return u, nil
 }
 
 // handleHealth returns a simple JSON payload indicating the server is alive.
@@ -189,73 +339,201 @@ func (s *Server) handleManifest(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request) {
-	// Expect /d/{token}
+	// Expect /d/{token}, /d/{token}/{n} or /d/{token}/all
 	p := strings.TrimPrefix(r.URL.Path, protocol.PathPrefix)
-	if p != s.Token {
+	tok, sub, _ := strings.Cut(p, "/")
+	if tok != s.Token {
 		http.Error(w, "forbidden", http.StatusForbidden)
 		return
 	}
+	if s.limits != nil {
+		defer s.limits.track()()
+	}
+	pw := &progressWriter{ResponseWriter: w}
+	defer pw.finish()
+	w = pw
 
 	// If TextContent is set, serve text securely
 	if s.TextContent != "" {
+		if sub != "" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(s.TextContent)))
 		// Prevent caching of sensitive text content
 		w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
 		w.Header().Set("Pragma", "no-cache")
 		w.Header().Set("Expires", "0")
-		w.Write([]byte(s.TextContent))
+		if !s.admit(w, r) {
+			return
+		}
+		text := strings.NewReader(s.TextContent)
+		s.sending(w, r, "text", text.Size(), ".", 0, text.Size())
+		sent, err := s.writeBody(w, http.StatusOK, text, 0, text.Size(), negotiateEncoding(r, text, 0, text.Size()))
+		s.deliveredFile(r, payloadKey{0, "."}, 0, text.Size(), sent, err)
 		return
 	}
 
-	fi, err := os.Stat(s.SrcPath)
+	switch {
+	case sub == "" && len(s.items) == 1:
+		s.serveItem(w, r, 1)
+	case sub == "":
+		s.handleIndex(w, r)
+	case sub == protocol.AllItemsPath:
+		s.serveAll(w, r)
+	default:
+		// {n} is an item, {n}/{path} a file inside a directory item
+		ns, rel, _ := strings.Cut(sub, "/")
+		n, err := strconv.Atoi(ns)
+		if err != nil || n < 1 || n > len(s.items) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if rel != "" {
+			s.serveTreeFile(w, r, s.items[n-1], rel)
+			return
+		}
+		s.serveItem(w, r, n)
+	}
+}
+
+// serveItem serves the n-th shared path (1-based): a file with Range
+// support, or a directory as a manifest or an archive.
+func (s *Server) serveItem(w http.ResponseWriter, r *http.Request, n int) {
+	it := s.items[n-1]
+	fi, err := os.Stat(it.Path)
 	if err != nil {
 		http.Error(w, "not found", http.StatusNotFound)
 		return
 	}
 	if fi.IsDir() {
-		w.Header().Set("Content-Type", "application/zip")
-		name := filepath.Base(s.SrcPath) + ".zip"
-		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", name))
-		if err := ZipDirectory(w, s.SrcPath); err != nil {
-			http.Error(w, "zip error", http.StatusInternalServerError)
+		if strings.Contains(r.Header.Get("Accept"), protocol.ManifestMediaType) {
+			s.serveManifest(w, r, n)
+			return
 		}
+		s.serveArchive(w, r, []shareItem{it}, false, it.Name)
 		return
 	}
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filepath.Base(s.SrcPath)))
-	
+	s.serveFile(w, r, it.Path, it.Name, payloadKey{it.Index, "."})
+}
+
+// serveFile serves a regular file, known to download limits as key, with
+// Range support, or its digest when asked for one.
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, path, name string, key payloadKey) {
 	// Support resumable downloads via Range headers
-	f, err := os.Open(s.SrcPath)
+	f, err := os.Open(path)
 	if err != nil {
 		http.Error(w, "not found", http.StatusNotFound)
 		return
 	}
 	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if strings.Contains(r.Header.Get("Accept"), protocol.DigestMediaType) {
+		s.serveDigest(w, path, f, fi)
+		return
+	}
+	if !s.admit(w, r) {
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", name))
 	
+	w.Header().Set("Accept-Ranges", "bytes")
+	// Receivers keep the ETag with a partial download and resume only while
+	// it still matches. If-Range with anything else, such as a date too
+	// coarse to tell a replaced file apart, gets them the whole file
+	etag := fileETag(fi)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", fi.ModTime().UTC().Format(http.TimeFormat))
 	rangeHeader := r.Header.Get("Range")
-	if rangeHeader != "" && strings.HasPrefix(rangeHeader, "bytes=") {
-		// Parse Range: bytes=start-end
-		rangeSpec := strings.TrimPrefix(rangeHeader, "bytes=")
-		var start int64
-		if _, err := fmt.Sscanf(rangeSpec, "%d-", &start); err == nil && start > 0 {
-			if _, err := f.Seek(start, 0); err == nil {
-				w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, fi.Size()-1, fi.Size()))
-				w.Header().Set("Content-Length", fmt.Sprintf("%d", fi.Size()-start))
-				w.WriteHeader(http.StatusPartialContent)
-				io.Copy(w, f)
-				log.Printf("Resumed download from byte %d for %s", start, filepath.Base(s.SrcPath))
-				return
-			}
+	if ir := r.Header.Get("If-Range"); ir != "" && ir != etag {
+		// ServeContent would otherwise match it against the mtime itself
+		rangeHeader = ""
+		r.Header.Del("Range")
+	}
+	if strings.Contains(rangeHeader, ",") {
+		// Several ranges go out as multipart/byteranges from ServeContent
+		// below, or as the whole file where it can't serve the payload
+		rangeHeader = ""
+	}
+	// Empty files have no range to serve and go out whole
+	if rangeHeader != "" && strings.HasPrefix(rangeHeader, "bytes=") && fi.Size() > 0 {
+		start, end, ok := parseRange(strings.TrimPrefix(rangeHeader, "bytes="), fi.Size())
+		if !ok {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", fi.Size()))
+			http.Error(w, "invalid range", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, fi.Size()))
+		s.sending(w, r, s.items[key.item].Name, s.itemSize(key.item), key.rel, start, end-start+1)
+		sent, err := s.writeBody(w, http.StatusPartialContent, f, start, end-start+1, negotiateEncoding(r, f, start, end-start+1))
+		s.deliveredFile(r, key, start, end-start+1, sent, err)
+		if start > 0 && end == fi.Size()-1 {
+			log.Printf("Resumed download from byte %d for %s", start, name)
 		}
+		return
 	}
-	
+
+	s.sending(w, r, s.items[key.item].Name, s.itemSize(key.item), key.rel, 0, fi.Size())
+	// Sealed and compressed payloads can't go through ServeContent, which
+	// writes the raw file, and limited ones must be counted
+	coding := negotiateEncoding(r, f, 0, fi.Size())
+	if s.key != nil || coding != "" || s.limits != nil {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		sent, err := s.writeBody(w, http.StatusOK, f, 0, fi.Size(), coding)
+		s.deliveredFile(r, key, 0, fi.Size(), sent, err)
+		return
+	}
+
 	// Normal full file download
-	http.ServeFile(w, r, s.SrcPath)
+	http.ServeContent(w, r, name, fi.ModTime(), f)
+}
+
+// fileETag is a strong validator for a file's current content: its inode,
+// size and mtime.
+func fileETag(fi os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x-%x"`, fileID(fi), fi.Size(), fi.ModTime().UnixNano())
+}
+
+// parseRange parses a single "start-", "start-end" or suffix "-n" byte
+// range against a file of the given size, clamping it to the file. Multiple
+// ranges are not supported.
+func parseRange(spec string, size int64) (start, end int64, ok bool) {
+	first, last, found := strings.Cut(spec, "-")
+	if !found || strings.Contains(last, ",") {
+		return 0, 0, false
+	}
+	if first == "" {
+		// The last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 || size <= 0 {
+			return 0, 0, false
+		}
+		return max(size-n, 0), size - 1, true
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	end = size - 1
+	if last != "" {
+		e, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || e < start {
+			return 0, 0, false
+		}
+		if e < end {
+			end = e
+		}
+	}
+	return start, end, true
 }
 
 // handleUpload serves a simple HTML form on GET and accepts multipart file uploads on POST.
 func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
-	// Expect /u/{token} or /u/{token}/manifest
+	// Expect /u/{token}, /u/{token}/manifest or /u/{token}/sessions/...
 	seg := strings.TrimPrefix(r.URL.Path, protocol.UploadPathPrefix)
 	seg = strings.TrimPrefix(seg, "/")
 	parts := strings.Split(seg, "/")
@@ -268,6 +546,10 @@ func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
 		s.handleManifest(w, r)
 		return
 	}
+	if len(parts) > 1 && parts[1] == protocol.UploadSessionsPath {
+		s.handleSessions(w, r, parts[2:])
+		return
+	}
 
 	if r.Method == http.MethodGet {
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -345,8 +627,8 @@ func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 
-		outPath := filepath.Join(dest, name)
-		out, err := os.OpenFile(outPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+		// Stage the part and move it to a free name once it has arrived
+		out, err := os.CreateTemp(dest, ".warp-*.part")
 		if err != nil {
 			log.Printf("Failed to create file %s: %v", name, err)
 			part.Close()
@@ -357,23 +639,34 @@ func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
 		// Use pooled buffer to reduce GC pressure
 		bufPtr := bufferPool.Get().(*[]byte)
 		buf := *bufPtr
-		n, err := io.CopyBuffer(out, part, buf)
+		fl := s.receiving(r, name, -1, 0, -1)
+		n, err := io.CopyBuffer(out, &flowReader{r: part, f: fl}, buf)
 		bufferPool.Put(bufPtr)
 		cerr := out.Close()
 		part.Close()
+		fl.finish(err == nil && cerr == nil)
 
 		if err != nil || cerr != nil {
+			os.Remove(out.Name())
 			log.Printf("Failed to write file %s: write_err=%v, close_err=%v", name, err, cerr)
 			http.Error(w, "write error", http.StatusInternalServerError)
 			return
 		}
+		outPath, err := moveToUniqueName(out.Name(), dest, name)
+		if err != nil {
+			os.Remove(out.Name())
+			log.Printf("Failed to move %s into place: %v", name, err)
+			http.Error(w, "write error", http.StatusInternalServerError)
+			return
+		}
+		name = filepath.Base(outPath)
 
 		duration := time.Since(requestStart).Seconds()
 		mbps := 0.0
 		if duration > 0 {
 			mbps = (float64(n) * 8) / (duration * 1_000_000)
 		}
-		log.Printf("%s, %s received in %.2fs (%.1f Mbps)", name, formatBytes(n), duration, mbps)
+		log.Printf("%s, %s received in %.2fs (%.1f Mbps)", name, ui.FormatBytes(n), duration, mbps)
 		saved = append(saved, savedInfo{Name: name, Size: n})
 		requestStart = time.Now() // Reset for next file
 	}
@@ -389,28 +682,33 @@ func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write([]byte("ok"))
 }
 
-// findUniqueFilename prevents file overwrites by appending (1), (2), etc.
-func findUniqueFilename(dir, name string) string {
+// moveToUniqueName moves the staged file tmp to name in dir, appending
+// (1), (2), etc. instead of overwriting. Each name is claimed with a hard
+// link, which fails if the name exists, so concurrent uploads can't pick
+// the same one.
+func moveToUniqueName(tmp, dir, name string) (string, error) {
 	ext := filepath.Ext(name)
 	base := strings.TrimSuffix(name, ext)
-	
-	// First try: exact match
-	path := filepath.Join(dir, name)
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		return path
-	}
-
-	// Collision found: try "file (1).ext", "file (2).ext", etc.
-	for i := 1; i < 1000; i++ {
-		newName := fmt.Sprintf("%s (%d)%s", base, i, ext)
-		path = filepath.Join(dir, newName)
-		if _, err := os.Stat(path); os.IsNotExist(err) {
-			return path
+	for i := 0; ; i++ {
+		candidate := name
+		switch {
+		case i >= 1000:
+			// Fallback: use a timestamp after 1000 collisions (unlikely)
+			candidate = fmt.Sprintf("%s_%d%s", base, time.Now().UnixNano(), ext)
+		case i > 0:
+			candidate = fmt.Sprintf("%s (%d)%s", base, i, ext)
+		}
+		path := filepath.Join(dir, candidate)
+		err := os.Link(tmp, path)
+		if os.IsExist(err) {
+			continue
 		}
+		if err != nil {
+			return "", err
+		}
+		os.Remove(tmp)
+		return path, nil
 	}
-	
-	// Fallback: Use timestamp if 1000 collisions (unlikely)
-	return filepath.Join(dir, fmt.Sprintf("%s_%d%s", base, time.Now().UnixNano(), ext))
 }
 
 // handleRawUpload processes raw binary stream uploads (A+ tier performance)
@@ -418,12 +716,11 @@ func findUniqueFilename(dir, name string) string {
 func (s *Server) handleRawUpload(w http.ResponseWriter, r *http.Request, encodedFilename string) {
 	requestStart := time.Now()
 
-	const MaxUploadSize = 10 << 30 // 10GB
-	if r.ContentLength > MaxUploadSize {
+	if r.ContentLength > maxUploadSize {
 		http.Error(w, "file too large", http.StatusRequestEntityTooLarge)
 		return
 	}
-	r.Body = http.MaxBytesReader(w, r.Body, MaxUploadSize)
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
 	
 	// Decode filename from URL encoding
 	filename, err := url.QueryUnescape(encodedFilename)
@@ -454,6 +751,7 @@ func (s *Server) handleRawUpload(w http.ResponseWriter, r *http.Request, encoded
 	chunked := offsetHeader != ""
 	var uploadOffset int64
 	var totalSize int64
+	nonce := r.Header.Get("X-Upload-ID")
 	if chunked {
 		var err error
 		uploadOffset, err = strconv.ParseInt(offsetHeader, 10, 64)
@@ -461,131 +759,157 @@ func (s *Server) handleRawUpload(w http.ResponseWriter, r *http.Request, encoded
 			http.Error(w, "invalid offset", http.StatusBadRequest)
 			return
 		}
-		if totalHeader := r.Header.Get("X-Upload-Total"); totalHeader != "" {
-			if total, err := strconv.ParseInt(totalHeader, 10, 64); err == nil && total > 0 {
-				totalSize = total
-			}
+		// Chunks are staged in an upload session, which needs the file
+		// size and the client's ID for the file
+		totalSize, err = strconv.ParseInt(r.Header.Get("X-Upload-Total"), 10, 64)
+		if err != nil || totalSize < 0 || totalSize > maxUploadSize {
+			http.Error(w, "chunked uploads need a valid X-Upload-Total", http.StatusBadRequest)
+			return
+		}
+		if nonce == "" {
+			http.Error(w, "chunked uploads need an X-Upload-ID", http.StatusBadRequest)
+			return
 		}
 	}
 
-	// Resolve destination path
-	var outPath string
-	var actualFilename string
-	if chunked {
-		outPath = filepath.Join(dest, name)
-		actualFilename = filepath.Base(outPath)
-	} else {
-		outPath = findUniqueFilename(dest, name)
-		actualFilename = filepath.Base(outPath)
+	// Optional body digest via X-Upload-SHA256 (hex); corrupt bodies are rejected
+	var wantSum []byte
+	if sumHeader := r.Header.Get("X-Upload-SHA256"); sumHeader != "" {
+		wantSum, err = hex.DecodeString(sumHeader)
+		if err != nil || len(wantSum) != sha256.Size {
+			http.Error(w, "invalid digest", http.StatusBadRequest)
+			return
+		}
 	}
 
-	// Open file
-	flags := os.O_CREATE | os.O_WRONLY
-	if !chunked {
-		flags |= os.O_TRUNC
+	if chunked {
+		s.handleChunkUpload(w, r, name, uploadOffset, totalSize, nonce, wantSum, requestStart)
+		return
 	}
-	f, err := os.OpenFile(outPath, flags, 0o600)
+
+	// Stage the body next to its destination and move it into place only
+	// once it has fully arrived
+	f, err := os.CreateTemp(dest, ".warp-*.part")
 	if err != nil {
-		log.Printf("Failed to open file %s: %v", actualFilename, err)
+		log.Printf("Failed to open file %s: %v", name, err)
 		http.Error(w, "disk error", http.StatusInternalServerError)
 		return
 	}
-
-	// Clean-up only for non-chunked uploads
 	success := false
 	defer func() {
-		f.Close()
-		if !success && !chunked {
-			os.Remove(outPath)
-			log.Printf("Upload canceled/failed: deleted incomplete file %s", actualFilename)
+		if !success {
+			f.Close()
+			os.Remove(f.Name())
+			log.Printf("Upload canceled/failed: deleted incomplete file %s", name)
 		}
 	}()
 
-	// Pre-allocate when possible
-	if chunked {
-		if totalSize > 0 && uploadOffset == 0 {
-			_ = f.Truncate(totalSize)
-		}
-		if _, err := f.Seek(uploadOffset, 0); err != nil {
-			http.Error(w, "seek error", http.StatusInternalServerError)
-			return
-		}
-	}
-	if !chunked && r.ContentLength > 0 {
+	if r.ContentLength > 0 {
 		if err := f.Truncate(r.ContentLength); err != nil {
-			log.Printf("Failed to pre-allocate space for %s: %v", actualFilename, err)
+			log.Printf("Failed to pre-allocate space for %s: %v", name, err)
 		}
 	}
+	fl := s.receiving(r, name, r.ContentLength, 0, r.ContentLength)
+	defer func() { fl.finish(success) }()
 
 	bufPtr := bufferPool.Get().(*[]byte)
 	defer bufferPool.Put(bufPtr)
 	buf := *bufPtr
 
-	if chunked && uploadOffset == 0 {
-		if totalSize > 0 {
-			log.Printf("receiving %s (%s)", actualFilename, formatBytes(totalSize))
-		} else {
-			log.Printf("receiving %s", actualFilename)
-		}
-	}
-	if !chunked {
-		if r.ContentLength > 0 {
-			log.Printf("receiving %s (%s)", actualFilename, formatBytes(r.ContentLength))
-		} else {
-			log.Printf("receiving %s", actualFilename)
-		}
-	}
-
-	n, err := io.CopyBuffer(f, r.Body, buf)
+	hasher := sha256.New()
+	n, err := io.CopyBuffer(f, io.TeeReader(&flowReader{r: r.Body, f: fl}, hasher), buf)
 	ctxErr := r.Context().Err()
 	if err != nil {
 		if ctxErr != nil || errors.Is(err, context.Canceled) {
-			log.Printf("receiving paused %s", actualFilename)
 			return
 		}
-		log.Printf("Upload stream failed for %s: %v", actualFilename, err)
+		log.Printf("Upload stream failed for %s: %v", name, err)
 		http.Error(w, "stream error", http.StatusInternalServerError)
 		return
 	}
-
+	if wantSum != nil && !bytes.Equal(hasher.Sum(nil), wantSum) {
+		log.Printf("digest mismatch for %s, bytes 0-%d; rejected", name, n-1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprintf(w, `{"success":false,"error":"digest mismatch","offset":0,"length":%d}`, n)
+		return
+	}
+	if err := f.Close(); err != nil {
+		log.Printf("Failed to write file %s: %v", name, err)
+		http.Error(w, "write error", http.StatusInternalServerError)
+		return
+	}
+	outPath, err := moveToUniqueName(f.Name(), dest, name)
+	if err != nil {
+		log.Printf("Failed to move %s into place: %v", name, err)
+		http.Error(w, "disk error", http.StatusInternalServerError)
+		return
+	}
 	success = true
+	actualFilename := filepath.Base(outPath)
 
 	dur := time.Since(requestStart)
 	mbps := 0.0
 	if dur.Seconds() > 0 {
 		mbps = (float64(n) * 8) / (dur.Seconds() * 1_000_000)
 	}
-
-	if chunked {
-		totalDur := s.addChunkDuration(actualFilename, dur)
-		if totalSize > 0 && uploadOffset+n >= totalSize {
-			log.Printf("received %s in %.2fs", actualFilename, totalDur.Seconds())
-		}
-	} else {
-		log.Printf("received %s in %.2fs (%.1f Mbps)", actualFilename, dur.Seconds(), mbps)
-	}
+	log.Printf("received %s in %.2fs (%.1f Mbps)", actualFilename, dur.Seconds(), mbps)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	if chunked {
-		fmt.Fprintf(w, `{"success":true,"filename":"%s","received":%d}`, actualFilename, n)
-	} else {
-		fmt.Fprintf(w, `{"success":true,"filename":"%s","size":%d}`, actualFilename, n)
-	}
+	fmt.Fprintf(w, `{"success":true,"filename":"%s","size":%d}`, actualFilename, n)
 }
 
-// formatBytes formats bytes into human-readable string
-func formatBytes(bytes int64) string {
-	const unit = 1024
-	if bytes < unit {
-		return fmt.Sprintf("%d B", bytes)
+// handleChunkUpload stores one chunk of an X-File-Name upload in the
+// upload session for the file, finishing it with the last missing chunk.
+func (s *Server) handleChunkUpload(w http.ResponseWriter, r *http.Request, name string, offset, total int64, nonce string, wantSum []byte, requestStart time.Time) {
+	u, err := s.openSession(name, total, "", nonce)
+	if err != nil {
+		log.Printf("Failed to open upload session for %s: %v", name, err)
+		http.Error(w, "disk error", http.StatusInternalServerError)
+		return
+	}
+	fl := s.receiving(r, name, total, offset, r.ContentLength)
+	n, err := u.write(offset, &flowReader{r: r.Body, f: fl}, wantSum)
+	fl.finish(err == nil)
+	switch {
+	case errors.Is(err, errDigestMismatch):
+		// The bad bytes aren't journaled, so the range stays missing until re-sent
+		log.Printf("digest mismatch for %s, bytes %d-%d; rejected", name, offset, offset+n-1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprintf(w, `{"success":false,"error":"digest mismatch","offset":%d,"length":%d}`, offset, n)
+		return
+	case errors.Is(err, errOutOfRange):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, errChunkTooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	case err != nil:
+		if r.Context().Err() != nil || errors.Is(err, context.Canceled) {
+			return
+		}
+		log.Printf("Upload stream failed for %s: %v", name, err)
+		http.Error(w, "stream error", http.StatusInternalServerError)
+		return
 	}
-	div, exp := int64(unit), 0
-	for n := bytes / unit; n >= unit; n /= unit {
-		div *= unit
-		exp++
+
+	totalDur := s.addChunkDuration(name, time.Since(requestStart))
+	filename := name
+	if len(u.missing()) == 0 {
+		filename, err = u.finish()
+		if err != nil {
+			log.Printf("Failed to finish upload of %s: %v", name, err)
+			http.Error(w, "disk error", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("received %s in %.2fs", filename, totalDur.Seconds())
 	}
-	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `{"success":true,"filename":"%s","received":%d}`, filename, n)
 }
 
 func (s *Server) addChunkDuration(name string, d time.Duration) time.Duration {
@@ -606,13 +930,73 @@ func (c *chunkStat) add(d time.Duration) time.Duration {
 	return res
 }
 
-// Shutdown stops the server.
+// Shutdown stops the server at once, cutting transfers in flight.
 func (s *Server) Shutdown() error {
 	if s.httpServer == nil {
 		return nil
 	}
+	var err error
+	s.stopOnce.Do(func() {
+		if s.advertiser != nil {
+			s.advertiser.Close()
+		}
+		err = s.httpServer.Close()
+		close(s.done)
+	})
+	return err
+}
+
+// Drain stops the server gracefully: it withdraws the mDNS advertisement,
+// stops accepting connections and waits for transfers in flight to finish.
+// Those still running when ctx is done are cut, and ctx's error returned.
+func (s *Server) Drain(ctx context.Context) error {
+	if s.httpServer == nil {
+		return nil
+	}
+	var err error
+	s.stopOnce.Do(func() {
+		err = s.drain(ctx)
+		close(s.done)
+	})
+	return err
+}
+
+// stop shuts the server down on its own initiative, letting in-flight
+// responses finish. reason is reported by Err.
+func (s *Server) stop(reason error) {
+	s.stopOnce.Do(func() {
+		s.stopErr = reason
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = s.drain(ctx)
+		close(s.done)
+	})
+}
+
+// drain withdraws the advertisement and shuts httpServer down, closing the
+// connections still active when ctx is done.
+func (s *Server) drain(ctx context.Context) error {
 	if s.advertiser != nil {
 		s.advertiser.Close()
 	}
-	return s.httpServer.Close()
-}
\ No newline at end of file
+	err := s.httpServer.Shutdown(ctx)
+	if err != nil {
+		_ = s.httpServer.Close()
+	}
+	return err
+}
+
+// Done is closed once the server has stopped.
+func (s *Server) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err reports why the server stopped on its own, or nil.
+func (s *Server) Err() error {
+	select {
+	case <-s.done:
+		return s.stopErr
+	default:
+		return nil
+	}
+}
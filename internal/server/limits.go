@@ -0,0 +1,299 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Err reports these when the share stopped because it reached MaxDownloads
+// or Expire.
+var (
+	ErrDownloadLimit = errors.New("download limit reached; share closed")
+	ErrExpired       = errors.New("share expired")
+)
+
+// A share that reached its download limit lingers until it has been idle
+// for limitGrace, so the last receiver can still verify what it got, but
+// stops limitDeadline after the limit was hit however busy it is.
+const (
+	limitGrace    = 2 * time.Second
+	limitDeadline = 5 * time.Second
+)
+
+// A download counts once its receiver has every byte of the share: each
+// file of every item, through any mix of whole, ranged and resumed
+// requests, or archives holding them. What a failed response got across is
+// unknown, as written bytes may die in socket buffers, so it is credited
+// only when the receiver resumes from inside it. Receivers are told apart
+// by address, so a download resumed from the same address completes the one
+// it started instead of counting again, and each counts at most once: its
+// follow-up requests are still served until the limit is reached, and
+// after that only digests are. Payloads go to at most as many other
+// receivers as there are downloads left.
+
+// payloadKey names a file of the share.
+type payloadKey struct {
+	item int    // index into the share's items
+	rel  string // slash-separated path in a directory item, "." for the item itself
+}
+
+// receipt is what one receiver has been sent.
+type receipt struct {
+	files    map[payloadKey]*coverage
+	complete map[payloadKey]bool  // files delivered whole
+	zips     map[string]*coverage // by ETag
+	done     []int                // files delivered whole, per item
+	had      []bool               // items delivered whole in archives
+}
+
+// coverage is what a receiver has of one payload, as half-open ranges.
+type coverage struct {
+	got     [][2]int64 // delivered
+	unknown [][2]int64 // written by failed responses
+}
+
+// record notes a response for [start, start+n) that wrote sent bytes. Its
+// request confirms the part of an earlier failed response it resumes; other
+// requests, such as a probe of the first byte, leave that part unknown.
+func (c *coverage) record(start, n, sent int64, err error) {
+	kept := c.unknown[:0]
+	for _, u := range c.unknown {
+		if start > u[0] && start <= u[1] {
+			c.got = addRange(c.got, u[0], start)
+			continue
+		}
+		kept = append(kept, u)
+	}
+	c.unknown = kept
+	switch {
+	case err != nil && sent > 0:
+		c.unknown = append(c.unknown, [2]int64{start, start + sent})
+	case err == nil && n > 0:
+		c.got = addRange(c.got, start, start+n)
+	}
+}
+
+// covers reports whether c spans [0, size).
+func (c *coverage) covers(size int64) bool {
+	return size == 0 || len(c.got) == 1 && c.got[0][0] == 0 && c.got[0][1] >= size
+}
+
+// limiter counts completed downloads.
+type limiter struct {
+	mu       sync.Mutex
+	max      int
+	sizes    []map[string]int64 // per item, the size of every file it sends
+	receipts map[string]*receipt
+	finished map[string]bool // receivers whose download counted
+	count    int
+	closed   bool
+	inflight int
+	last     time.Time
+}
+
+// newLimiter lists what a download of the share has to deliver.
+func (s *Server) newLimiter() (*limiter, error) {
+	l := &limiter{max: s.MaxDownloads, receipts: make(map[string]*receipt), finished: make(map[string]bool)}
+	if s.TextContent != "" {
+		l.sizes = []map[string]int64{{".": int64(len(s.TextContent))}}
+		return l, nil
+	}
+	for _, it := range s.items {
+		sizes := make(map[string]int64)
+		err := walkShare(it.Path, s.tree, func(_, rel string, info os.FileInfo) error {
+			if info.Mode().IsRegular() {
+				sizes[rel] = info.Size()
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		l.sizes = append(l.sizes, sizes)
+	}
+	return l, nil
+}
+
+// receiver identifies who sent r.
+func receiver(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// admit reports whether r's sender may be sent payload, answering 410 Gone
+// when not.
+func (s *Server) admit(w http.ResponseWriter, r *http.Request) bool {
+	l := s.limits
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	who := receiver(r)
+	if l.finished[who] && !l.closed {
+		return true
+	}
+	if _, ok := l.receipts[who]; !ok && !l.finished[who] && l.count+len(l.receipts) < l.max {
+		l.receipts[who] = &receipt{
+			files:    make(map[payloadKey]*coverage),
+			complete: make(map[payloadKey]bool),
+			zips:     make(map[string]*coverage),
+			done:     make([]int, len(l.sizes)),
+			had:      make([]bool, len(l.sizes)),
+		}
+	}
+	if _, ok := l.receipts[who]; !ok {
+		http.Error(w, "this share is no longer available", http.StatusGone)
+		return false
+	}
+	return true
+}
+
+// deliveredFile records a response to r's sender for bytes [start,
+// start+n) of the file at key, which wrote sent of them and failed with err.
+func (s *Server) deliveredFile(r *http.Request, key payloadKey, start, n, sent int64, err error) {
+	l := s.limits
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rc := l.receipts[receiver(r)]
+	size, ok := l.sizes[key.item][key.rel]
+	if rc == nil || !ok || rc.complete[key] {
+		return
+	}
+	c := rc.files[key]
+	if c == nil {
+		c = new(coverage)
+		rc.files[key] = c
+	}
+	c.record(start, n, sent, err)
+	if c.covers(size) && (size > 0 || err == nil) {
+		rc.complete[key] = true
+		rc.done[key.item]++
+		s.checkReceipt(r, rc)
+	}
+}
+
+// deliveredZip records a response to r's sender for bytes [start,
+// start+n) of the zip of items with the given ETag and size, as
+// deliveredFile does.
+func (s *Server) deliveredZip(r *http.Request, items []shareItem, etag string, size, start, n, sent int64, err error) {
+	l := s.limits
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rc := l.receipts[receiver(r)]
+	if rc == nil {
+		return
+	}
+	c := rc.zips[etag]
+	if c == nil {
+		c = new(coverage)
+		rc.zips[etag] = c
+	}
+	c.record(start, n, sent, err)
+	if c.covers(size) {
+		for _, it := range items {
+			rc.had[it.Index] = true
+		}
+	}
+	s.checkReceipt(r, rc)
+}
+
+// deliveredItems records that whole items went to r's sender in one
+// archive stream.
+func (s *Server) deliveredItems(r *http.Request, items []shareItem) {
+	l := s.limits
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rc := l.receipts[receiver(r)]
+	if rc == nil {
+		return
+	}
+	for _, it := range items {
+		rc.had[it.Index] = true
+	}
+	s.checkReceipt(r, rc)
+}
+
+// checkReceipt counts rc's download once it holds the whole share, and
+// closes the share when that was the last one. l.mu is held.
+func (s *Server) checkReceipt(r *http.Request, rc *receipt) {
+	l := s.limits
+	for i, sizes := range l.sizes {
+		if !rc.had[i] && rc.done[i] < len(sizes) {
+			return
+		}
+	}
+	delete(l.receipts, receiver(r))
+	l.finished[receiver(r)] = true
+	l.count++
+	log.Printf("Download %d of %d complete (%s)", l.count, l.max, receiver(r))
+	if l.count >= l.max && !l.closed {
+		l.closed = true
+		go s.linger()
+	}
+}
+
+// countWriter counts the bytes written through it.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// track notes a request in flight until the returned func is called.
+func (l *limiter) track() func() {
+	l.mu.Lock()
+	l.inflight++
+	l.mu.Unlock()
+	return func() {
+		l.mu.Lock()
+		l.inflight--
+		l.last = time.Now()
+		l.mu.Unlock()
+	}
+}
+
+// linger stops the server with ErrDownloadLimit once no request has been
+// in flight for limitGrace, or at limitDeadline.
+func (s *Server) linger() {
+	deadline := time.Now().Add(limitDeadline)
+	t := time.NewTicker(limitGrace / 4)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-t.C:
+		}
+		s.limits.mu.Lock()
+		idle := s.limits.inflight == 0 && time.Since(s.limits.last) >= limitGrace
+		s.limits.mu.Unlock()
+		if idle || time.Now().After(deadline) {
+			s.stop(ErrDownloadLimit)
+			return
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zulfikawr/warp/internal/crypto"
+	"github.com/zulfikawr/warp/internal/protocol"
+)
+
+// ErrWrongCode is reported by Err when a receiver failed the PAKE exchange.
+var ErrWrongCode = errors.New("a receiver used the wrong code; share stopped")
+
+// ErrCodeUnconfirmed is reported by Err when a receiver started the PAKE
+// exchange and never confirmed it.
+var ErrCodeUnconfirmed = errors.New("a receiver started the code exchange but never finished it; share stopped")
+
+// pakeConfirmTimeout is how long a started exchange may go unconfirmed.
+var pakeConfirmTimeout = 30 * time.Second
+
+// pakeState tracks the single exchange a short code is good for.
+type pakeState struct {
+	mu        sync.Mutex
+	started   bool
+	confirmed bool
+	id        string
+	key       []byte
+}
+
+// handlePake runs the short-code exchange. A code buys exactly one attempt:
+// a second start is refused and a failed confirmation stops the server, so
+// an attacker gets a single online guess. A start left unconfirmed stops it
+// too, rather than leaving the share waiting on a spent code.
+func (s *Server) handlePake(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	r.Body = http.MaxBytesReader(w, r.Body, 64<<10)
+
+	switch strings.TrimPrefix(r.URL.Path, protocol.PakePathPrefix) {
+	case "start":
+		s.handlePakeStart(w, r)
+	case "confirm":
+		s.handlePakeConfirm(w, r)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func (s *Server) handlePakeStart(w http.ResponseWriter, r *http.Request) {
+	var req protocol.PakeStart
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	st := &s.pake
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.started {
+		http.Error(w, "code already used", http.StatusConflict)
+		return
+	}
+	st.started = true
+	peer := r.RemoteAddr
+	time.AfterFunc(pakeConfirmTimeout, func() {
+		st.mu.Lock()
+		confirmed := st.confirmed
+		st.mu.Unlock()
+		if !confirmed {
+			log.Printf("code exchange from %s never confirmed; stopping", peer)
+			s.stop(ErrCodeUnconfirmed)
+		}
+	})
+
+	p, err := crypto.NewPAKE(crypto.RoleServer, s.Code, nil)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	key, err := p.Finish(req.Msg)
+	if err != nil {
+		http.Error(w, "invalid PAKE message", http.StatusBadRequest)
+		go s.stop(ErrWrongCode)
+		return
+	}
+	id, err := crypto.GenerateToken(nil)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	st.id = id[:16]
+	st.key = key
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(protocol.PakeReply{ID: st.id, Msg: p.Message()})
+}
+
+func (s *Server) handlePakeConfirm(w http.ResponseWriter, r *http.Request) {
+	var req protocol.PakeConfirm
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	st := &s.pake
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.key == nil || st.confirmed || req.ID != st.id {
+		http.Error(w, "no exchange in progress", http.StatusConflict)
+		return
+	}
+	st.confirmed = true
+	if !crypto.CheckConfirmMAC(st.key, crypto.RoleClient, req.MAC) {
+		log.Printf("wrong code from %s; stopping", r.RemoteAddr)
+		http.Error(w, "wrong code", http.StatusForbidden)
+		go s.stop(ErrWrongCode)
+		return
+	}
+
+	ticket, _ := json.Marshal(protocol.PakeTicket{Token: s.Token, Secret: s.Secret, Fingerprint: s.Fingerprint})
+	box, err := crypto.SealBox(st.key, ticket)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(protocol.PakeGrant{Box: box})
+}
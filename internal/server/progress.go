@@ -0,0 +1,339 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Transfer is a snapshot of a payload moving between the server and one
+// peer, over however many requests that takes.
+type Transfer struct {
+	Peer      string // remote IP
+	UserAgent string
+	Name      string // the shared item, archive or uploaded file
+	Upload    bool   // received from the peer rather than sent to it
+	Size      int64  // -1 when unknown
+	Bytes     int64  // how much of it the peer has, or has sent
+	Moved     int64  // bytes moved so far, counting repeats
+	Started   time.Time
+	Updated   time.Time // last activity, or now while Active
+	Active    bool      // requests are in flight
+	Done      bool      // all of it has arrived
+	Failed    bool      // the last request broke off
+}
+
+// Rate returns the average speed of t in bytes per second.
+func (t Transfer) Rate() float64 {
+	d := t.Updated.Sub(t.Started).Seconds()
+	if d <= 0 {
+		return 0
+	}
+	return float64(t.Moved) / d
+}
+
+// ETA estimates how long t has left, or returns -1 when it can't tell.
+func (t Transfer) ETA() time.Duration {
+	rate := t.Rate()
+	if !t.Active || t.Size < 0 || rate <= 0 {
+		return -1
+	}
+	return time.Duration(float64(t.Size-t.Bytes) / rate * float64(time.Second))
+}
+
+// maxTransfers bounds how many finished transfers are remembered.
+const maxTransfers = 100
+
+// errFlowBroken marks a request that ended before its payload did.
+var errFlowBroken = errors.New("transfer broke off")
+
+// transfers tracks what moves to and from each peer.
+type transfers struct {
+	mu    sync.Mutex
+	rows  []*transfer
+	byKey map[transferKey]*transfer
+}
+
+type transferKey struct {
+	peer, agent, name string
+	upload            bool
+}
+
+// transfer is one row of transfers. Its parts are the files it spans,
+// each covered as download limits cover them.
+type transfer struct {
+	Transfer
+	parts map[string]*coverage
+	flows map[*flow]bool
+}
+
+// flow is one request's share of a transfer: bytes [start, start+n) of a
+// part, n being -1 for streams of unknown length.
+type flow struct {
+	ts       *transfers
+	t        *transfer
+	part     string
+	start, n int64
+	moved    atomic.Int64
+	last     atomic.Int64 // UnixNano of the last bytes moved
+}
+
+// open starts a flow of r's peer for the transfer named name.
+func (ts *transfers) open(r *http.Request, name string, upload bool, size int64, part string, start, n int64) *flow {
+	key := transferKey{receiver(r), r.UserAgent(), name, upload}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	t := ts.byKey[key]
+	if t == nil {
+		t = &transfer{
+			Transfer: Transfer{Peer: key.peer, UserAgent: key.agent, Name: name, Upload: upload, Size: size, Started: time.Now()},
+			parts:    make(map[string]*coverage),
+			flows:    make(map[*flow]bool),
+		}
+		ts.byKey[key] = t
+		ts.rows = append(ts.rows, t)
+		ts.prune()
+	}
+	c := t.parts[part]
+	if c == nil {
+		c = new(coverage)
+		t.parts[part] = c
+	}
+	// A request resuming an earlier one confirms what that one got across
+	c.record(start, 0, 0, nil)
+	f := &flow{ts: ts, t: t, part: part, start: start, n: n}
+	f.last.Store(time.Now().UnixNano())
+	t.flows[f] = true
+	return f
+}
+
+// prune forgets the oldest idle transfers beyond maxTransfers. ts.mu is
+// held.
+func (ts *transfers) prune() {
+	for i := 0; len(ts.rows) > maxTransfers && i < len(ts.rows); {
+		t := ts.rows[i]
+		if len(t.flows) > 0 {
+			i++
+			continue
+		}
+		delete(ts.byKey, transferKey{t.Peer, t.UserAgent, t.Name, t.Upload})
+		ts.rows = append(ts.rows[:i], ts.rows[i+1:]...)
+	}
+}
+
+func (f *flow) add(n int64) {
+	if n > 0 {
+		f.moved.Add(n)
+		f.last.Store(time.Now().UnixNano())
+	}
+}
+
+// finish ends f, crediting its bytes to the transfer when ok.
+func (f *flow) finish(ok bool) {
+	ts, t := f.ts, f.t
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if !t.flows[f] {
+		return
+	}
+	delete(t.flows, f)
+	moved, n := f.moved.Load(), f.n
+	if n < 0 {
+		n = moved
+	}
+	var err error
+	if !ok {
+		err = errFlowBroken
+	}
+	t.parts[f.part].record(f.start, n, moved, err)
+	t.Moved += moved
+	t.Updated = time.Unix(0, f.last.Load())
+	t.Failed = !ok
+}
+
+// snapshot returns t as it stands. ts.mu is held.
+func (t *transfer) snapshot(now time.Time) Transfer {
+	out := t.Transfer
+	var have int64
+	for _, c := range t.parts {
+		for _, g := range c.got {
+			have += g[1] - g[0]
+		}
+		// What broken-off requests wrote probably arrived, mostly
+		for _, u := range c.unknown {
+			out.Bytes += u[1] - u[0]
+		}
+	}
+	out.Bytes += have
+	for f := range t.flows {
+		moved := f.moved.Load()
+		out.Bytes += moved
+		out.Moved += moved
+	}
+	out.Active = len(t.flows) > 0
+	if out.Active {
+		out.Updated = now
+		out.Failed = false
+	}
+	if out.Size >= 0 && out.Bytes > out.Size {
+		out.Bytes = out.Size
+	}
+	out.Done = !out.Active && !out.Failed && out.Moved > 0 && (out.Size < 0 || have >= out.Size)
+	return out
+}
+
+// Transfers lists what has moved to and from each peer, oldest first.
+func (s *Server) Transfers() []Transfer {
+	ts := s.transfers
+	if ts == nil {
+		return nil
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	now := time.Now()
+	out := make([]Transfer, 0, len(ts.rows))
+	for _, t := range ts.rows {
+		out = append(out, t.snapshot(now))
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Started.Before(out[j].Started) })
+	return out
+}
+
+// progressWriter counts the payload bytes of a download response, once
+// sending names what the response carries.
+type progressWriter struct {
+	http.ResponseWriter
+	flow   *flow
+	counts bool // the body's reader counts instead, as Write sees compressed bytes
+	broken bool
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.ResponseWriter.Write(b)
+	if p.flow != nil && !p.counts {
+		p.flow.add(int64(n))
+	}
+	if err != nil {
+		p.broken = true
+	}
+	return n, err
+}
+
+// progressChunk is how much ReadFrom hands to the connection at a time.
+const progressChunk = 1 << 20
+
+// ReadFrom keeps sendfile for plain files, counting one chunk at a time.
+// sendfile looks through a single LimitedReader only, so one around src is
+// replaced by the chunks'.
+func (p *progressWriter) ReadFrom(src io.Reader) (int64, error) {
+	rf, ok := p.ResponseWriter.(io.ReaderFrom)
+	if !ok {
+		return io.Copy(struct{ io.Writer }{p}, src)
+	}
+	inner, left := src, int64(-1)
+	lr, limited := src.(*io.LimitedReader)
+	if limited {
+		inner, left = lr.R, lr.N
+	}
+	var total int64
+	var err error
+	for left != 0 {
+		chunk := int64(progressChunk)
+		if left > 0 && left < chunk {
+			chunk = left
+		}
+		var n int64
+		n, err = rf.ReadFrom(&io.LimitedReader{R: inner, N: chunk})
+		total += n
+		if left > 0 {
+			left -= n
+		}
+		if p.flow != nil && !p.counts {
+			p.flow.add(n)
+		}
+		if err != nil {
+			p.broken = true
+			break
+		}
+		if n < chunk {
+			break
+		}
+	}
+	if limited {
+		lr.N = max(left, 0)
+	}
+	return total, err
+}
+
+func (p *progressWriter) Unwrap() http.ResponseWriter {
+	return p.ResponseWriter
+}
+
+// finish ends the response's flow: it succeeded if nothing failed to write
+// and all it was to carry went out.
+func (p *progressWriter) finish() {
+	if f := p.flow; f != nil {
+		f.finish(!p.broken && (f.n < 0 || f.moved.Load() >= f.n))
+	}
+}
+
+// sending notes that the response to r carries bytes [start, start+n) of
+// part of the payload name, size bytes in all.
+func (s *Server) sending(w http.ResponseWriter, r *http.Request, name string, size int64, part string, start, n int64) {
+	p, ok := w.(*progressWriter)
+	if !ok || p.flow != nil || r.Method == http.MethodHead {
+		return
+	}
+	p.flow = s.transfers.open(r, name, false, size, part, start, n)
+}
+
+// countBody makes the plaintext read from body count as the progress of
+// the response w, for bodies that are compressed on the way out.
+func countBody(w http.ResponseWriter, body io.Reader) io.Reader {
+	p, ok := w.(*progressWriter)
+	if !ok || p.flow == nil {
+		return body
+	}
+	p.counts = true
+	return &flowReader{r: body, f: p.flow}
+}
+
+// receiving starts tracking bytes [start, start+n) of the upload name,
+// size bytes in all, from r's peer.
+func (s *Server) receiving(r *http.Request, name string, size, start, n int64) *flow {
+	return s.transfers.open(r, name, true, size, "", start, n)
+}
+
+// flowReader counts what is read through it as progress of f.
+type flowReader struct {
+	r io.Reader
+	f *flow
+}
+
+func (fr *flowReader) Read(b []byte) (int, error) {
+	n, err := fr.r.Read(b)
+	fr.f.add(int64(n))
+	return n, err
+}
+
+// itemSize returns the payload size of the i-th item, walking a directory
+// once.
+func (s *Server) itemSize(i int) int64 {
+	if v, ok := s.itemSizes.Load(i); ok {
+		return v.(int64)
+	}
+	it := s.items[i]
+	var n int64
+	if it.Dir {
+		n = treeSize(it.Path, s.tree)
+	} else if fi, err := os.Stat(it.Path); err == nil {
+		n = fi.Size()
+	}
+	s.itemSizes.Store(i, n)
+	return n
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/zulfikawr/warp/internal/crypto"
+	"github.com/zulfikawr/warp/internal/protocol"
+)
+
+// setBodyLength sets the length headers for a body of n plaintext bytes
+// (n < 0 when unknown). Sealed bodies advertise both the wire length and
+// the plaintext length so receivers can track progress.
+func (s *Server) setBodyLength(w http.ResponseWriter, n int64) {
+	h := w.Header()
+	if s.key == nil {
+		if n >= 0 {
+			h.Set("Content-Length", strconv.FormatInt(n, 10))
+		}
+		return
+	}
+	h.Set(protocol.CipherHeader, protocol.CipherAESGCM)
+	if n >= 0 {
+		h.Set("Content-Length", strconv.FormatInt(crypto.SealedSize(n), 10))
+		h.Set(protocol.PlainLengthHeader, strconv.FormatInt(n, 10))
+	}
+}
+
+// bodyWriter returns the writer the payload should go through. When
+// encryption is enabled it seals the stream; offset is the plaintext
+// position of the first byte. The returned writer must be closed after a
+// successful write so the final chunk is emitted.
+func (s *Server) bodyWriter(w io.Writer, offset int64) (io.WriteCloser, error) {
+	if s.key == nil {
+		return nopWriteCloser{w}, nil
+	}
+	return crypto.NewSealWriter(w, s.key, offset)
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
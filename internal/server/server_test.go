@@ -1,12 +1,24 @@
 package server
 
 import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/zulfikawr/warp/internal/crypto"
+	"github.com/zulfikawr/warp/internal/protocol"
 )
 
 func TestServerValidAndInvalidToken(t *testing.T) {
@@ -38,3 +50,416 @@ func TestServerValidAndInvalidToken(t *testing.T) {
 	}
 	resp2.Body.Close()
 }
+
+func TestServerFixedPort(t *testing.T) {
+	tok, _ := crypto.GenerateToken(nil)
+	a := &Server{Token: tok, TextContent: "hi", ListenAddr: "0.0.0.0"}
+	if _, err := a.Start(); err != nil { t.Fatal(err) }
+	defer a.Shutdown()
+
+	// Every interface is bound, loopback included
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/d/%s", a.Port, tok))
+	if err != nil { t.Fatal(err) }
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+
+	// The same port can't be taken twice
+	b := &Server{Token: tok, TextContent: "hi", ListenAddr: "0.0.0.0", Port: a.Port}
+	_, err = b.Start()
+	if err == nil || !strings.Contains(err.Error(), "already in use") {
+		t.Fatalf("expected busy port error, got %v", err)
+	}
+}
+
+func TestZipLayoutRanges(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.txt":           "alpha",
+		"empty":           "",
+		"nested/deep.bin": strings.Repeat("0123456789", 50000),
+		"nested/ünï.txt":  "unicode",
+	}
+	for name, data := range files {
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o755)
+		os.WriteFile(filepath.Join(dir, name), []byte(data), 0o640)
+	}
+	os.Symlink("a.txt", filepath.Join(dir, "link"))
+	os.Mkdir(filepath.Join(dir, "void"), 0o755)
+	want := map[string]string{"dir/": "", "dir/nested/": "", "dir/void/": "", "dir/link": "a.txt"}
+	for name, data := range files {
+		want["dir/"+name] = data
+	}
+	defer func(v int64) { zip64Limit = v }(zip64Limit)
+	for _, limit := range []int64{zip64Limit, 1} {
+		zip64Limit = limit
+		l, err := newZipLayout([]shareItem{{Path: dir, Name: "dir"}}, true, walkOptions{})
+		if err != nil { t.Fatal(err) }
+		var full bytes.Buffer
+		if err := (&Server{}).writeZip(&full, l, 0, l.size-1); err != nil { t.Fatal(err) }
+		if int64(full.Len()) != l.size {
+			t.Fatalf("limit %d: wrote %d bytes, layout says %d", limit, full.Len(), l.size)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(full.Bytes()), l.size)
+		if err != nil { t.Fatalf("limit %d: %v", limit, err) }
+		if len(zr.File) != len(want) {
+			t.Fatalf("limit %d: %d entries, want %d", limit, len(zr.File), len(want))
+		}
+		for _, f := range zr.File {
+			rc, err := f.Open()
+			if err != nil { t.Fatal(err) }
+			got, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil { t.Fatalf("limit %d: %s: %v", limit, f.Name, err) }
+			if data, ok := want[f.Name]; !ok || string(got) != data {
+				t.Fatalf("limit %d: %s content mismatch", limit, f.Name)
+			}
+			var ok bool
+			switch {
+			case strings.HasSuffix(f.Name, "/"):
+				ok = f.Mode().IsDir()
+			case f.Name == "dir/link":
+				ok = f.Mode()&os.ModeSymlink != 0
+			default:
+				ok = f.Mode().IsRegular() && f.Mode().Perm() == 0o640
+			}
+			if !ok {
+				t.Fatalf("limit %d: %s mode %v", limit, f.Name, f.Mode())
+			}
+		}
+
+		// Any range matches the full archive, even with no CRCs cached
+		for _, rg := range [][2]int64{{0, 10}, {40, 300000}, {250000, l.size - 1}, {l.cdOffset - 3, l.size - 5}} {
+			var part bytes.Buffer
+			if err := (&Server{}).writeZip(&part, l, rg[0], rg[1]); err != nil { t.Fatal(err) }
+			if !bytes.Equal(part.Bytes(), full.Bytes()[rg[0]:rg[1]+1]) {
+				t.Fatalf("limit %d: range %v differs from the full archive", limit, rg)
+			}
+		}
+	}
+}
+
+func TestWalkSharePolicies(t *testing.T) {
+	dir, outside := t.TempDir(), t.TempDir()
+	os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("x"), 0o644)
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0o644)
+	os.Symlink("a.txt", filepath.Join(dir, "file-link"))
+	os.Symlink(outside, filepath.Join(dir, "dir-link"))
+	os.Symlink(".", filepath.Join(dir, "loop"))
+	os.Symlink("missing", filepath.Join(dir, "broken"))
+
+	for policy, want := range map[string]string{
+		SymlinksPreserve: ".,a.txt,broken@,dir-link@,file-link@,loop@",
+		SymlinksFollow:   ".,a.txt,dir-link/,dir-link/secret.txt,file-link",
+		SymlinksSkip:     ".,a.txt",
+	} {
+		var got []string
+		err := walkShare(dir, walkOptions{symlinks: policy}, func(p, rel string, info os.FileInfo) error {
+			switch {
+			case info.Mode()&os.ModeSymlink != 0:
+				rel += "@"
+			case info.IsDir() && rel != ".":
+				rel += "/"
+			}
+			got = append(got, rel)
+			return nil
+		})
+		if err != nil { t.Fatal(err) }
+		if strings.Join(got, ",") != want {
+			t.Errorf("%s: walked %v, want %s", policy, got, want)
+		}
+	}
+}
+
+func TestPathRules(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, rel string
+		dir, want    bool
+	}{
+		{"*.log", "a.log", false, true},
+		{"*.log", "deep/in/b.log", false, true},
+		{"*.log", "a.log.txt", false, false},
+		{"build/", "build", true, true},
+		{"build/", "build", false, false},
+		{"build/", "src/build", true, true},
+		{"/build", "src/build", true, false},
+		{"docs/*.pdf", "docs/a.pdf", false, true},
+		{"docs/*.pdf", "docs/x/a.pdf", false, false},
+		{"docs/**/*.pdf", "docs/x/y/a.pdf", false, true},
+		{"docs/**/*.pdf", "docs/a.pdf", false, true},
+		{"**/tmp", "a/b/tmp", true, true},
+		{"out/**", "out/x/y", false, true},
+		{"out/**", "out", true, false},
+		{"file[0-9].txt", "file7.txt", false, true},
+		{"file[!0-9].txt", "file7.txt", false, false},
+		{"ü?.txt", "üb.txt", false, true},
+		{`\#notes`, "#notes", false, true},
+	} {
+		r, err := compileRule(tc.pattern)
+		if err != nil { t.Fatal(err) }
+		if got := applyRules([]pathRule{r}, tc.rel, tc.dir, false); got != tc.want {
+			t.Errorf("%q on %q (dir=%v) = %v, want %v", tc.pattern, tc.rel, tc.dir, got, tc.want)
+		}
+	}
+}
+
+func TestWalkShareFilters(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"main.go", "debug.log", "keep.log", "node_modules/x/index.js", "src/util.go", "src/gen/out.bin", ".git/HEAD", "docs/readme.md"} {
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o755)
+		os.WriteFile(filepath.Join(dir, name), []byte(name), 0o644)
+	}
+	os.WriteFile(filepath.Join(dir, ".gitignore"), []byte("# build output\n*.log\n!keep.log\nnode_modules/\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "src", ".gitignore"), []byte("/gen\n"), 0o644)
+
+	walk := func(exclude, include []string, gitignore bool) string {
+		opts, err := (&Server{Exclude: exclude, Include: include, GitIgnore: gitignore}).newWalkOptions()
+		if err != nil { t.Fatal(err) }
+		var got []string
+		err = walkShare(dir, opts, func(p, rel string, info os.FileInfo) error {
+			if rel != "." {
+				if info.IsDir() {
+					rel += "/"
+				}
+				got = append(got, rel)
+			}
+			if rel != "." && !info.IsDir() && !opts.admits(dir, rel) {
+				t.Errorf("%s walked but not admitted", rel)
+			}
+			return nil
+		})
+		if err != nil { t.Fatal(err) }
+		return strings.Join(got, ",")
+	}
+	if got, want := walk(nil, nil, true), ".gitignore,docs/,docs/readme.md,keep.log,main.go,src/,src/.gitignore,src/util.go"; got != want {
+		t.Errorf("gitignore: %s, want %s", got, want)
+	}
+	if got, want := walk([]string{"node_modules", ".*", "docs/"}, []string{"*.go"}, false), "main.go,src/,src/util.go"; got != want {
+		t.Errorf("exclude and include: %s, want %s", got, want)
+	}
+	opts, _ := (&Server{GitIgnore: true}).newWalkOptions()
+	for _, rel := range []string{"debug.log", "node_modules/x/index.js", "src/gen/out.bin", ".git/HEAD"} {
+		if opts.admits(dir, rel) {
+			t.Errorf("%s admitted", rel)
+		}
+	}
+	if _, err := (&Server{Exclude: []string{"[z-a]"}}).newWalkOptions(); err == nil {
+		t.Error("invalid pattern accepted")
+	}
+}
+
+func TestDownloadLimits(t *testing.T) {
+	tok, _ := crypto.GenerateToken(nil)
+	s := &Server{Token: tok, TextContent: strings.Repeat("x", 1000), MaxDownloads: 2}
+	if _, err := s.Start(); err != nil { t.Fatal(err) }
+	defer s.Shutdown()
+	from := func(addr string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = addr
+		return r
+	}
+	admitted := func(addr string) bool {
+		return s.admit(httptest.NewRecorder(), from(addr))
+	}
+	key := payloadKey{0, "."}
+	cut := io.ErrUnexpectedEOF
+
+	if !admitted("10.0.0.1:1000") || !admitted("10.0.0.2:1000") {
+		t.Fatal("first two receivers refused")
+	}
+	if admitted("10.0.0.3:1000") {
+		t.Fatal("third receiver admitted while two downloads are pending")
+	}
+
+	// A failed response counts for nothing until a resume confirms it
+	s.deliveredFile(from("10.0.0.1:1000"), key, 0, 1000, 1000, cut)
+	s.deliveredFile(from("10.0.0.1:1001"), key, 0, 1000, 600, cut)
+	if s.limits.count != 0 {
+		t.Fatalf("count %d after failed responses", s.limits.count)
+	}
+	s.deliveredFile(from("10.0.0.1:1002"), key, 400, 600, 600, nil)
+	if s.limits.count != 1 {
+		t.Fatalf("count %d after a resumed download, want 1", s.limits.count)
+	}
+	// Counted receivers are served again, but not counted again
+	if !admitted("10.0.0.1:1003") {
+		t.Fatal("finished receiver refused before the share closed")
+	}
+	s.deliveredFile(from("10.0.0.1:1003"), key, 0, 1000, 1000, nil)
+	if s.limits.count != 1 || admitted("10.0.0.3:1000") {
+		t.Fatalf("count %d; a new receiver must wait for the pending one", s.limits.count)
+	}
+
+	// A request in flight holds the share open until limitDeadline at most
+	release := s.limits.track()
+	defer release()
+	s.deliveredFile(from("10.0.0.2:1000"), key, 0, 1000, 1000, nil)
+	if admitted("10.0.0.1:1004") || admitted("10.0.0.2:1001") {
+		t.Fatal("payload served again after the limit was reached")
+	}
+	select {
+	case <-s.Done():
+	case <-time.After(limitDeadline + 2*time.Second):
+		t.Fatal("server still up after its last download")
+	}
+	if s.Err() != ErrDownloadLimit {
+		t.Fatalf("Err() = %v, want ErrDownloadLimit", s.Err())
+	}
+}
+
+func TestUnconfirmedCodeExchange(t *testing.T) {
+	defer func(d time.Duration) { pakeConfirmTimeout = d }(pakeConfirmTimeout)
+	pakeConfirmTimeout = 200 * time.Millisecond
+
+	code, _ := crypto.GenerateCode(nil)
+	tok, _ := crypto.GenerateToken(nil)
+	id, secret := crypto.SplitToken(tok)
+	s := &Server{Token: id, Secret: secret, Code: code, TextContent: "via code"}
+	if _, err := s.Start(); err != nil { t.Fatal(err) }
+	defer s.Shutdown()
+	p, err := crypto.NewPAKE(crypto.RoleClient, code, nil)
+	if err != nil { t.Fatal(err) }
+	body, _ := json.Marshal(protocol.PakeStart{Msg: p.Message()})
+	w := httptest.NewRecorder()
+	s.handlePake(w, httptest.NewRequest(http.MethodPost, protocol.PakePathPrefix+"start", bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("start: status %d", w.Code)
+	}
+
+	// The receiver goes quiet instead of confirming
+	select {
+	case <-s.Done():
+	case <-time.After(pakeConfirmTimeout + 5*time.Second):
+		t.Fatal("server kept running on an unconfirmed exchange")
+	}
+	if s.Err() != ErrCodeUnconfirmed {
+		t.Fatalf("Err() = %v", s.Err())
+	}
+}
+
+func TestPreferredCoding(t *testing.T) {
+	for _, tc := range []struct{ accept, want string }{
+		{"", ""},
+		{"zstd, gzip", "zstd"},
+		{"br, gzip", "gzip"},
+		{"zstd;q=0.5, gzip", "gzip"},
+		{"zstd;q=0, gzip;q=0", ""},
+		{"gzip;q=0.8, zstd;q=0.8", "gzip"},
+		{"GZIP ; Q=1", "gzip"},
+		{"zstd;q=bad", ""},
+	} {
+		if got := preferredCoding(tc.accept); got != tc.want {
+			t.Errorf("preferredCoding(%q) = %q, want %q", tc.accept, got, tc.want)
+		}
+	}
+}
+
+func TestSessionRejectsChunksBeforeWriting(t *testing.T) {
+	dir := t.TempDir()
+	u, err := createSession(dir, sessionID("ten.bin", 10, "", "n1"), "ten.bin", 10, "")
+	if err != nil { t.Fatal(err) }
+	sumOf := func(s string) []byte {
+		h := sha256.Sum256([]byte(s))
+		return h[:]
+	}
+
+	// An oversize chunk leaves no byte behind
+	if _, err := u.write(0, strings.NewReader("0123456789X"), nil); err != errOutOfRange {
+		t.Fatalf("oversize chunk: err = %v", err)
+	}
+	if _, err := u.write(0, strings.NewReader("01234"), sumOf("01234")); err != nil { t.Fatal(err) }
+	// A bad re-send of a received range keeps the good bytes
+	if _, err := u.write(0, strings.NewReader("XXXXX"), sumOf("01234")); err != errDigestMismatch {
+		t.Fatalf("corrupt re-send: err = %v", err)
+	}
+	if _, err := u.write(5, strings.NewReader("56789"), sumOf("56789")); err != nil { t.Fatal(err) }
+	name, err := u.finish()
+	if err != nil { t.Fatal(err) }
+	if b, _ := os.ReadFile(filepath.Join(dir, name)); string(b) != "0123456789" {
+		t.Fatalf("finished file = %q", b)
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	for _, tc := range []struct {
+		spec       string
+		start, end int64
+		ok         bool
+	}{
+		{"0-", 0, 99, true},
+		{"10-19", 10, 19, true},
+		{"90-200", 90, 99, true},
+		{"-10", 90, 99, true},
+		{"-500", 0, 99, true},
+		{"-0", 0, 0, false},
+		{"100-", 0, 0, false},
+		{"20-10", 0, 0, false},
+		{"0-1,5-6", 0, 0, false},
+		{"x-", 0, 0, false},
+	} {
+		start, end, ok := parseRange(tc.spec, 100)
+		if ok != tc.ok || ok && (start != tc.start || end != tc.end) {
+			t.Errorf("parseRange(%q) = %d, %d, %v", tc.spec, start, end, ok)
+		}
+	}
+}
+
+func TestTarStreamAbortsOnError(t *testing.T) {
+	tok, _ := crypto.GenerateToken(nil)
+	s := &Server{Token: tok, TextContent: "x"}
+	if _, err := s.Start(); err != nil { t.Fatal(err) }
+	defer s.Shutdown()
+	items := []shareItem{{Name: "gone", Path: filepath.Join(t.TempDir(), "gone"), Dir: true}}
+
+	// A clean end would pass the truncated tarball off as complete
+	defer func() {
+		if v := recover(); v != http.ErrAbortHandler {
+			t.Fatalf("recovered %v, want http.ErrAbortHandler", v)
+		}
+	}()
+	r := httptest.NewRequest(http.MethodGet, "/?"+protocol.FormatQuery+"="+protocol.FormatTar, nil)
+	s.serveArchive(httptest.NewRecorder(), r, items, true, "gone")
+}
+
+func TestMoveToUniqueNameConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "report.pdf"), []byte("original"), 0o644); err != nil { t.Fatal(err) }
+
+	const n = 8
+	var wg sync.WaitGroup
+	paths := make([]string, n)
+	for i := 0; i < n; i++ {
+		tmp, err := os.CreateTemp(dir, ".warp-*.part")
+		if err != nil { t.Fatal(err) }
+		fmt.Fprintf(tmp, "upload %d", i)
+		tmp.Close()
+		wg.Add(1)
+		go func(i int, tmp string) {
+			defer wg.Done()
+			p, err := moveToUniqueName(tmp, dir, "report.pdf")
+			if err != nil {
+				t.Error(err)
+			}
+			paths[i] = p
+		}(i, tmp.Name())
+	}
+	wg.Wait()
+
+	if b, _ := os.ReadFile(filepath.Join(dir, "report.pdf")); string(b) != "original" {
+		t.Fatalf("existing file overwritten: %q", b)
+	}
+	seen := map[string]bool{}
+	for i, p := range paths {
+		if seen[p] {
+			t.Fatalf("two uploads claimed %s", p)
+		}
+		seen[p] = true
+		if b, _ := os.ReadFile(p); string(b) != fmt.Sprintf("upload %d", i) {
+			t.Fatalf("%s holds %q", p, b)
+		}
+	}
+	if left, _ := filepath.Glob(filepath.Join(dir, ".warp-*.part")); len(left) != 0 {
+		t.Fatalf("staged files left behind: %v", left)
+	}
+}
@@ -0,0 +1,448 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/zulfikawr/warp/internal/protocol"
+	"github.com/zulfikawr/warp/internal/ui"
+)
+
+// Upload sessions stage a file as .warp-{id}.part in the upload directory
+// and journal every range that arrives in .warp-{id}.journal, so uploads
+// resume after either side restarts. Only a complete file is renamed into
+// place; the destination never holds a partial one.
+
+var (
+	errDigestMismatch = errors.New("digest mismatch")
+	errOutOfRange     = errors.New("chunk extends past the end of the file")
+	errChunkTooLarge  = errors.New("chunk too large")
+	errIncomplete     = errors.New("upload is incomplete")
+)
+
+// maxUploadSize caps a single uploaded file.
+const maxUploadSize = 10 << 30 // 10GB
+
+// maxChunkSize caps one chunk of a session, which is held in memory until
+// it checks out.
+const maxChunkSize = 64 << 20
+
+type uploadSession struct {
+	id   string
+	dir  string
+	name string
+	size int64
+	sum  string // hex SHA-256 of the whole file, if the client sent one
+
+	// rw is held shared by chunk writes and exclusively by finish, which
+	// closes the files.
+	rw       sync.RWMutex
+	mu       sync.Mutex // guards received and the journal
+	received [][2]int64 // half-open ranges, sorted and merged
+	part     *os.File
+	journal  *os.File
+	filename string // final name once finished
+}
+
+// sessionID names the session for a file, so a client that restarts finds
+// its session again by describing the same file. Name and size alone would
+// merge two different files into one, so the key also holds the file's
+// SHA-256 or, for uploads without one, the nonce the client picked for it.
+func sessionID(name string, size int64, sum, nonce string) string {
+	h := sha256.Sum256([]byte(name + "\x00" + strconv.FormatInt(size, 10) + "\x00" + sum + "\x00" + nonce))
+	return hex.EncodeToString(h[:16])
+}
+
+func (s *Server) uploadDir() string {
+	if s.UploadDir == "" {
+		return "."
+	}
+	return s.UploadDir
+}
+
+// openSession returns the unfinished session for a file, loading it from
+// its journal or creating it as needed.
+func (s *Server) openSession(name string, size int64, sum, nonce string) (*uploadSession, error) {
+	id := sessionID(name, size, sum, nonce)
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	if u, ok := s.sessions[id]; ok && u.filename == "" {
+		return u, nil
+	}
+	u, err := loadSession(s.uploadDir(), id)
+	if errors.Is(err, fs.ErrNotExist) {
+		u, err = createSession(s.uploadDir(), id, name, size, sum)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.sessions == nil {
+		s.sessions = make(map[string]*uploadSession)
+	}
+	s.sessions[id] = u
+	return u, nil
+}
+
+// lookupSession finds a session by id, in memory or on disk.
+func (s *Server) lookupSession(id string) (*uploadSession, error) {
+	if b, err := hex.DecodeString(id); err != nil || len(b) != 16 {
+		return nil, fs.ErrNotExist
+	}
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	if u, ok := s.sessions[id]; ok {
+		return u, nil
+	}
+	u, err := loadSession(s.uploadDir(), id)
+	if err != nil {
+		return nil, err
+	}
+	if s.sessions == nil {
+		s.sessions = make(map[string]*uploadSession)
+	}
+	s.sessions[id] = u
+	return u, nil
+}
+
+func (s *Server) dropSession(u *uploadSession) {
+	s.sessionsMu.Lock()
+	delete(s.sessions, u.id)
+	s.sessionsMu.Unlock()
+	u.discard()
+}
+
+func sessionPaths(dir, id string) (part, journal string) {
+	base := filepath.Join(dir, ".warp-"+id)
+	return base + ".part", base + ".journal"
+}
+
+func createSession(dir, id, name string, size int64, sum string) (*uploadSession, error) {
+	partPath, journalPath := sessionPaths(dir, id)
+	part, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err := part.Truncate(size); err != nil {
+		part.Close()
+		return nil, err
+	}
+	journal, err := os.OpenFile(journalPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		part.Close()
+		return nil, err
+	}
+	header, _ := json.Marshal(protocol.UploadSessionRequest{Name: name, Size: size, SHA256: sum})
+	if _, err := journal.Write(append(header, '\n')); err != nil {
+		part.Close()
+		journal.Close()
+		return nil, err
+	}
+	return &uploadSession{id: id, dir: dir, name: name, size: size, sum: sum, part: part, journal: journal}, nil
+}
+
+// loadSession reopens a session from its journal: a JSON header line, then
+// one "start end" line per received range.
+func loadSession(dir, id string) (*uploadSession, error) {
+	partPath, journalPath := sessionPaths(dir, id)
+	data, err := os.ReadFile(journalPath)
+	if err != nil {
+		return nil, err
+	}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	var hdr protocol.UploadSessionRequest
+	if !sc.Scan() || json.Unmarshal(sc.Bytes(), &hdr) != nil {
+		return nil, fmt.Errorf("corrupt upload journal %s", journalPath)
+	}
+	u := &uploadSession{id: id, dir: dir, name: hdr.Name, size: hdr.Size, sum: hdr.SHA256}
+	for sc.Scan() {
+		var a, b int64
+		// A torn last line from a crash is simply not counted
+		if _, err := fmt.Sscanf(sc.Text(), "%d %d", &a, &b); err != nil || a < 0 || b > u.size || a >= b {
+			continue
+		}
+		u.received = addRange(u.received, a, b)
+	}
+	if u.part, err = os.OpenFile(partPath, os.O_RDWR, 0); err != nil {
+		return nil, err
+	}
+	if fi, err := u.part.Stat(); err != nil || fi.Size() != u.size {
+		u.part.Close()
+		return nil, fmt.Errorf("upload staging file %s has the wrong size", partPath)
+	}
+	if u.journal, err = os.OpenFile(journalPath, os.O_WRONLY|os.O_APPEND, 0); err != nil {
+		u.part.Close()
+		return nil, err
+	}
+	return u, nil
+}
+
+// write stores a chunk at offset and journals it. The chunk is read whole
+// and checked against the file's size and wantSum (when given) first, so a
+// rejected one never touches bytes already received.
+func (u *uploadSession) write(offset int64, body io.Reader, wantSum []byte) (int64, error) {
+	u.rw.RLock()
+	defer u.rw.RUnlock()
+	if u.part == nil {
+		return 0, errors.New("upload session is closed")
+	}
+	if offset > u.size {
+		return 0, errOutOfRange
+	}
+	// One byte past the limit is read so oversize chunks are caught
+	limit := min(u.size-offset, maxChunkSize)
+	chunk, err := io.ReadAll(io.LimitReader(body, limit+1))
+	n := int64(len(chunk))
+	if err != nil {
+		return n, err
+	}
+	switch {
+	case n > u.size-offset:
+		return n, errOutOfRange
+	case n > limit:
+		return n, errChunkTooLarge
+	}
+	if sum := sha256.Sum256(chunk); wantSum != nil && !bytes.Equal(sum[:], wantSum) {
+		return n, errDigestMismatch
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	if _, err := u.part.WriteAt(chunk, offset); err != nil {
+		return 0, err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if _, err := fmt.Fprintf(u.journal, "%d %d\n", offset, offset+n); err != nil {
+		return n, err
+	}
+	u.received = addRange(u.received, offset, offset+n)
+	return n, nil
+}
+
+// missing returns the inclusive byte ranges not yet received.
+func (u *uploadSession) missing() [][2]int64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	gaps := [][2]int64{}
+	var pos int64
+	for _, r := range u.received {
+		if r[0] > pos {
+			gaps = append(gaps, [2]int64{pos, r[0] - 1})
+		}
+		pos = r[1]
+	}
+	if pos < u.size {
+		gaps = append(gaps, [2]int64{pos, u.size - 1})
+	}
+	return gaps
+}
+
+func (u *uploadSession) status() protocol.UploadSession {
+	missing := u.missing()
+	u.rw.RLock()
+	defer u.rw.RUnlock()
+	return protocol.UploadSession{
+		ID:       u.id,
+		Name:     u.name,
+		Size:     u.size,
+		Missing:  missing,
+		Complete: len(missing) == 0,
+		Filename: u.filename,
+	}
+}
+
+// finish verifies a complete upload and renames it into place under a name
+// that doesn't clobber existing files. It returns the final file name.
+func (u *uploadSession) finish() (string, error) {
+	u.rw.Lock()
+	defer u.rw.Unlock()
+	if u.filename != "" {
+		return u.filename, nil
+	}
+	if u.part == nil {
+		return "", errors.New("upload session is closed")
+	}
+	u.mu.Lock()
+	complete := u.size == 0 || (len(u.received) == 1 && u.received[0] == [2]int64{0, u.size})
+	u.mu.Unlock()
+	if !complete {
+		return "", errIncomplete
+	}
+	if u.sum != "" {
+		h := sha256.New()
+		if _, err := io.Copy(h, io.NewSectionReader(u.part, 0, u.size)); err != nil {
+			return "", err
+		}
+		if hex.EncodeToString(h.Sum(nil)) != u.sum {
+			return "", errDigestMismatch
+		}
+	}
+	partPath, journalPath := sessionPaths(u.dir, u.id)
+	u.part.Close()
+	u.journal.Close()
+	u.part, u.journal = nil, nil
+	final, err := moveToUniqueName(partPath, u.dir, u.name)
+	if err != nil {
+		return "", err
+	}
+	os.Remove(journalPath)
+	u.filename = filepath.Base(final)
+	return u.filename, nil
+}
+
+// discard closes the session and deletes its staging files.
+func (u *uploadSession) discard() {
+	u.rw.Lock()
+	defer u.rw.Unlock()
+	if u.part != nil {
+		u.part.Close()
+		u.journal.Close()
+		u.part, u.journal = nil, nil
+	}
+	partPath, journalPath := sessionPaths(u.dir, u.id)
+	os.Remove(partPath)
+	os.Remove(journalPath)
+}
+
+// addRange adds the half-open range [a, b) to a sorted, merged range list.
+func addRange(rs [][2]int64, a, b int64) [][2]int64 {
+	rs = append(rs, [2]int64{a, b})
+	sort.Slice(rs, func(i, j int) bool { return rs[i][0] < rs[j][0] })
+	merged := rs[:1]
+	for _, r := range rs[1:] {
+		last := &merged[len(merged)-1]
+		if r[0] <= last[1] {
+			if r[1] > last[1] {
+				last[1] = r[1]
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// handleSessions serves the upload session API below
+// /u/{token}/sessions; rest holds the path elements after it.
+func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request, rest []string) {
+	w.Header().Set("Cache-Control", "no-store")
+	if len(rest) == 0 || rest[0] == "" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req protocol.UploadSessionRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		name := filepath.Base(req.Name)
+		if name == "." || name == ".." || name == "" || name == string(filepath.Separator) || req.Size < 0 {
+			http.Error(w, "invalid file", http.StatusBadRequest)
+			return
+		}
+		if req.Size > maxUploadSize {
+			http.Error(w, "file too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		// The digest keys the session, so only the same file resumes it
+		if b, err := hex.DecodeString(req.SHA256); err != nil || len(b) != sha256.Size {
+			http.Error(w, "invalid digest", http.StatusBadRequest)
+			return
+		}
+		if err := os.MkdirAll(s.uploadDir(), 0o755); err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		u, err := s.openSession(name, req.Size, req.SHA256, "")
+		if err != nil {
+			log.Printf("Failed to open upload session for %s: %v", name, err)
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, u.status())
+		return
+	}
+
+	u, err := s.lookupSession(rest[0])
+	if err != nil {
+		http.Error(w, "no such upload session", http.StatusNotFound)
+		return
+	}
+	switch {
+	case len(rest) == 1 && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, u.status())
+	case len(rest) == 1 && r.Method == http.MethodPost:
+		offset, err := strconv.ParseInt(r.Header.Get("X-Upload-Offset"), 10, 64)
+		if err != nil || offset < 0 {
+			http.Error(w, "invalid offset", http.StatusBadRequest)
+			return
+		}
+		var wantSum []byte
+		if h := r.Header.Get("X-Upload-SHA256"); h != "" {
+			if wantSum, err = hex.DecodeString(h); err != nil || len(wantSum) != sha256.Size {
+				http.Error(w, "invalid digest", http.StatusBadRequest)
+				return
+			}
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+		fl := s.receiving(r, u.name, u.size, offset, r.ContentLength)
+		n, err := u.write(offset, &flowReader{r: r.Body, f: fl}, wantSum)
+		fl.finish(err == nil)
+		switch {
+		case errors.Is(err, errDigestMismatch):
+			log.Printf("digest mismatch for %s, bytes %d-%d; rejected", u.name, offset, offset+n-1)
+			writeJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{"success": false, "error": "digest mismatch", "offset": offset, "length": n})
+		case errors.Is(err, errOutOfRange):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, errChunkTooLarge):
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		case err != nil:
+			if r.Context().Err() == nil {
+				log.Printf("Upload stream failed for %s: %v", u.name, err)
+				http.Error(w, "stream error", http.StatusInternalServerError)
+			}
+		default:
+			writeJSON(w, http.StatusOK, u.status())
+		}
+	case len(rest) == 2 && rest[1] == "finish" && r.Method == http.MethodPost:
+		name, err := u.finish()
+		switch {
+		case errors.Is(err, errIncomplete):
+			writeJSON(w, http.StatusConflict, u.status())
+		case errors.Is(err, errDigestMismatch):
+			// Can't tell which range is bad; the client starts over
+			log.Printf("digest mismatch for %s; upload discarded", u.name)
+			s.dropSession(u)
+			http.Error(w, "file digest mismatch; upload again", http.StatusUnprocessableEntity)
+		case err != nil:
+			log.Printf("Failed to finish upload of %s: %v", u.name, err)
+			http.Error(w, "server error", http.StatusInternalServerError)
+		default:
+			log.Printf("received %s (%s)", name, ui.FormatBytes(u.size))
+			writeJSON(w, http.StatusOK, u.status())
+		}
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
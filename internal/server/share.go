@@ -0,0 +1,269 @@
+package server
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/zulfikawr/warp/internal/protocol"
+	"github.com/zulfikawr/warp/internal/ui"
+)
+
+//go:embed static/index.html
+var indexPageHTML string
+
+var indexPage = template.Must(template.New("index").Parse(indexPageHTML))
+
+// shareItem is one path shared in a send session.
+type shareItem struct {
+	Name  string // unique display name, used in archives and downloads
+	Path  string
+	Dir   bool
+	Index int // position in the share, from 0
+}
+
+// buildItems resolves SrcPath and SrcPaths into share items.
+func (s *Server) buildItems() error {
+	paths := s.SrcPaths
+	if s.SrcPath != "" {
+		paths = append([]string{s.SrcPath}, paths...)
+	}
+	if len(paths) == 0 {
+		return errors.New("nothing to share")
+	}
+	seen := make(map[string]int)
+	s.items = s.items[:0]
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		name := filepath.Base(filepath.Clean(p))
+		if n := seen[name]; n > 0 {
+			ext := filepath.Ext(name)
+			name = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), n, ext)
+		}
+		seen[filepath.Base(filepath.Clean(p))]++
+		s.items = append(s.items, shareItem{Name: name, Path: p, Dir: fi.IsDir(), Index: len(s.items)})
+	}
+	var err error
+	s.tree, err = s.newWalkOptions()
+	return err
+}
+
+// itemPath returns the URL path of the n-th item (1-based).
+func (s *Server) itemPath(n int) string {
+	return protocol.PathPrefix + s.Token + "/" + strconv.Itoa(n)
+}
+
+// index describes every item of the share.
+func (s *Server) index() protocol.Index {
+	idx := protocol.Index{All: protocol.PathPrefix + s.Token + "/" + protocol.AllItemsPath}
+	for i, it := range s.items {
+		idx.Items = append(idx.Items, protocol.IndexItem{
+			Name: it.Name,
+			Size: treeSize(it.Path, s.tree),
+			Dir:  it.Dir,
+			URL:  s.itemPath(i + 1),
+		})
+	}
+	return idx
+}
+
+// handleIndex lists the items of a multi-item share: JSON for receivers
+// that ask for it (and always when encrypted), HTML for browsers.
+func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
+	idx := s.index()
+	w.Header().Set("Cache-Control", "no-store")
+	if s.key == nil && !strings.Contains(r.Header.Get("Accept"), protocol.IndexMediaType) {
+		type row struct {
+			protocol.IndexItem
+			SizeText string
+		}
+		var rows []row
+		for _, it := range idx.Items {
+			rows = append(rows, row{it, ui.FormatBytes(it.Size)})
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_ = indexPage.Execute(w, struct {
+			Items []row
+			All   string
+		}{rows, idx.All})
+		return
+	}
+
+	data, err := json.Marshal(idx)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", protocol.IndexMediaType)
+	s.setBodyLength(w, int64(len(data)))
+	body, err := s.bodyWriter(w, 0)
+	if err != nil {
+		return
+	}
+	if _, err := body.Write(data); err == nil {
+		body.Close()
+	}
+}
+
+// serveAll streams every item as a single archive.
+func (s *Server) serveAll(w http.ResponseWriter, r *http.Request) {
+	s.serveArchive(w, r, s.items, true, "warp-"+s.Token[:6])
+}
+
+// manifest lists the tree of the n-th item (1-based), which must be a
+// directory. Only what passes the share's filters is listed; symlinks
+// are listed, followed or skipped by the Symlinks policy, and sockets,
+// devices and pipes are skipped.
+func (s *Server) manifest(n int) (protocol.Manifest, error) {
+	it := s.items[n-1]
+	m := protocol.Manifest{Root: it.Name, Files: []protocol.ManifestEntry{}}
+	err := walkShare(it.Path, s.tree, func(p, rel string, info os.FileInfo) error {
+		if rel == "." {
+			return nil
+		}
+		e := protocol.ManifestEntry{
+			Path:  rel,
+			Dir:   info.IsDir(),
+			Mode:  uint32(info.Mode().Perm()),
+			MTime: info.ModTime().Unix(),
+		}
+		switch {
+		case e.Dir:
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			e.Link = target
+		case info.Mode().IsRegular():
+			e.Size = info.Size()
+			var segs []string
+			for _, seg := range strings.Split(e.Path, "/") {
+				segs = append(segs, url.PathEscape(seg))
+			}
+			e.URL = s.itemPath(n) + "/" + strings.Join(segs, "/")
+		default:
+			return nil
+		}
+		m.Files = append(m.Files, e)
+		return nil
+	})
+	return m, err
+}
+
+// serveManifest lists a directory item for receivers that mirror the tree
+// file by file instead of taking a zip.
+func (s *Server) serveManifest(w http.ResponseWriter, r *http.Request, n int) {
+	m, err := s.manifest(n)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", protocol.ManifestMediaType)
+	w.Header().Set("Cache-Control", "no-store")
+	s.setBodyLength(w, int64(len(data)))
+	body, err := s.bodyWriter(w, 0)
+	if err != nil {
+		return
+	}
+	if _, err := body.Write(data); err == nil {
+		body.Close()
+	}
+}
+
+// serveTreeFile serves the file at rel (slash-separated) inside a directory
+// item. Paths escaping the directory or left out by the share's filters
+// are refused, and so are paths through symlinks unless the Symlinks policy
+// follows them.
+func (s *Server) serveTreeFile(w http.ResponseWriter, r *http.Request, it shareItem, rel string) {
+	clean := path.Clean("/" + rel)[1:]
+	if !it.Dir || clean == "" || clean != rel {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	root, err := filepath.EvalSymlinks(it.Path)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if !s.tree.admits(root, clean) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	p := filepath.Join(root, filepath.FromSlash(clean))
+	if s.Symlinks != SymlinksFollow {
+		if real, err := filepath.EvalSymlinks(p); err != nil || real != p {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+	}
+	s.serveFile(w, r, p, path.Base(clean), payloadKey{it.Index, clean})
+}
+
+// describe returns the TXT records that let receivers pick this server
+// from a list: the sender's hostname and, unless the share is encrypted,
+// what is shared and its size.
+func (s *Server) describe() []string {
+	var txt []string
+	if h, err := os.Hostname(); err == nil {
+		txt = append(txt, "host="+truncate(h, 63))
+	}
+	if s.HostMode || s.key != nil {
+		return txt
+	}
+	if s.TextContent != "" {
+		return append(txt, "name=text", "size="+strconv.Itoa(len(s.TextContent)))
+	}
+	name := fmt.Sprintf("%d items", len(s.items))
+	if len(s.items) == 1 {
+		name = s.items[0].Name
+	}
+	var size int64
+	for _, it := range s.items {
+		size += treeSize(it.Path, s.tree)
+	}
+	return append(txt, "name="+truncate(name, 200), "size="+strconv.FormatInt(size, 10))
+}
+
+// truncate shortens s to at most n bytes without splitting a UTF-8 rune,
+// keeping TXT records within their 255-byte limit.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// treeSize returns the size of a file, or the total size of the regular
+// files a walk of the directory with opts sends.
+func treeSize(root string, opts walkOptions) int64 {
+	var total int64
+	_ = walkShare(root, opts, func(_, _ string, info os.FileInfo) error {
+		if info.Mode().IsRegular() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/zulfikawr/warp/internal/protocol"
+)
+
+// negotiateFormat picks the archive format of a directory download: the
+// format query parameter, else an archive media type named in Accept, else
+// the sender's ArchiveFormat. ok is false for an unknown format parameter.
+func (s *Server) negotiateFormat(r *http.Request) (format string, ok bool) {
+	if f := r.URL.Query().Get(protocol.FormatQuery); f != "" {
+		_, ok := protocol.ArchiveMediaTypes[f]
+		return f, ok
+	}
+	accept := r.Header.Get("Accept")
+	for _, f := range []string{protocol.FormatZip, protocol.FormatTar, protocol.FormatTarGz, protocol.FormatTarZst} {
+		if strings.Contains(accept, protocol.ArchiveMediaTypes[f]) {
+			return f, true
+		}
+	}
+	if s.ArchiveFormat != "" {
+		return s.ArchiveFormat, true
+	}
+	return protocol.FormatZip, true
+}
+
+// serveArchive serves items as one archive in the negotiated format, named
+// base plus the format's extension. Zip entries go under each item's share
+// name when prefixed is set; tar entries always do, as tarballs
+// conventionally hold the directory itself.
+func (s *Server) serveArchive(w http.ResponseWriter, r *http.Request, items []shareItem, prefixed bool, base string) {
+	format, ok := s.negotiateFormat(r)
+	if !ok {
+		http.Error(w, "unknown archive format", http.StatusBadRequest)
+		return
+	}
+	if !s.admit(w, r) {
+		return
+	}
+	name := base + protocol.ArchiveExtensions[format]
+	if format == protocol.FormatZip {
+		s.serveZip(w, r, items, prefixed, name)
+		return
+	}
+	w.Header().Set("Content-Type", protocol.ArchiveMediaTypes[format])
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", name))
+	s.setBodyLength(w, -1)
+	s.sending(w, r, name, -1, "", 0, -1)
+	body, err := s.bodyWriter(w, 0)
+	if err != nil {
+		http.Error(w, "server error", http.StatusInternalServerError)
+		return
+	}
+	var out io.WriteCloser = nopWriteCloser{body}
+	switch format {
+	case protocol.FormatTarGz:
+		out = gzip.NewWriter(body)
+	case protocol.FormatTarZst:
+		if out, err = zstd.NewWriter(body); err != nil {
+			http.Error(w, "server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	err = writeTar(out, items, s.tree)
+	if err == nil {
+		if err = out.Close(); err == nil {
+			err = body.Close()
+		}
+	}
+	if err != nil {
+		// The stream has no length, so ending it cleanly would pass a
+		// truncated tarball off as complete; breaking the connection won't
+		log.Printf("Archive stream of %s failed: %v", name, err)
+		panic(http.ErrAbortHandler)
+	}
+	s.deliveredItems(r, items)
+}
+
+// writeTar streams a tar of items to w, each under its share name, with
+// directories walked by opts. Unlike zip, tar keeps Unix permissions,
+// symlinks and mtimes.
+func writeTar(w io.Writer, items []shareItem, opts walkOptions) error {
+	tw := tar.NewWriter(w)
+	for _, it := range items {
+		if err := addTarTree(tw, it.Path, it.Name, opts); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// addTarTree adds root (a file or directory) to tw as prefix. Sockets,
+// devices and pipes are skipped.
+func addTarTree(tw *tar.Writer, root, prefix string, opts walkOptions) error {
+	return walkShare(root, opts, func(p, rel string, info os.FileInfo) error {
+		var link string
+		var err error
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		case !info.IsDir() && !info.Mode().IsRegular():
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = path.Join(prefix, rel)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		// PAX keeps long names and sub-second mtimes
+		hdr.Format = tar.FormatPAX
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		bufPtr := bufferPool.Get().(*[]byte)
+		defer bufferPool.Put(bufPtr)
+		_, err = io.CopyBuffer(tw, io.LimitReader(f, info.Size()), *bufPtr)
+		return err
+	})
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Symlink policies for shared directories, set through Server.Symlinks.
+const (
+	SymlinksPreserve = "preserve" // send links as links (the default)
+	SymlinksFollow   = "follow"   // send what links point to
+	SymlinksSkip     = "skip"     // leave links out
+)
+
+// walkOptions says what of a shared directory is sent.
+type walkOptions struct {
+	symlinks  string
+	exclude   []pathRule
+	include   []pathRule // when set, only matching entries are sent
+	gitignore bool       // honour .gitignore files and leave out .git
+}
+
+// newWalkOptions compiles the Server's tree settings.
+func (s *Server) newWalkOptions() (walkOptions, error) {
+	o := walkOptions{symlinks: s.Symlinks, gitignore: s.GitIgnore}
+	var err error
+	if o.exclude, err = compileRules(s.Exclude); err != nil {
+		return o, err
+	}
+	o.include, err = compileRules(s.Include)
+	return o, err
+}
+
+// walkFunc is called for every entry of a shared tree with its path, its
+// slash-separated name relative to the root ("." for the root itself) and
+// its info. Symlinks kept by the policy arrive with os.ModeSymlink set.
+type walkFunc func(p, rel string, info os.FileInfo) error
+
+// walker walks one shared tree.
+type walker struct {
+	walkOptions
+	fn      walkFunc
+	walking map[string]bool // directories being walked, to stop link loops
+	ignores []*ignoreFile   // .gitignore rules in force, outermost first
+	pending []walkedDir     // directories reported once something in them is
+}
+
+type walkedDir struct {
+	p, rel string
+	info   os.FileInfo
+}
+
+// walkShare walks the tree at root in lexical order, directories before
+// their contents, calling fn for every entry that passes opts. Excluded
+// and ignored directories are not entered. With include patterns, a
+// directory is reported only when something inside it is, unless it
+// matches itself. Under the follow policy, broken links and links back
+// into a directory being walked are skipped.
+func walkShare(root string, opts walkOptions, fn walkFunc) error {
+	info, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	w := &walker{walkOptions: opts, fn: fn, walking: make(map[string]bool)}
+	return w.walk(root, ".", info, len(opts.include) == 0)
+}
+
+// walk visits p. included is set when an ancestor matched an include
+// pattern, or there are none.
+func (w *walker) walk(p, rel string, info os.FileInfo, included bool) error {
+	if info.Mode()&os.ModeSymlink != 0 {
+		switch w.symlinks {
+		case SymlinksSkip:
+			return nil
+		case SymlinksFollow:
+			target, err := os.Stat(p)
+			if err != nil {
+				return nil
+			}
+			info = target
+		}
+	}
+	if rel != "." {
+		if w.ignored(rel, info.IsDir()) {
+			return nil
+		}
+		included = included || applyRules(w.include, rel, info.IsDir(), false)
+	}
+	if !info.IsDir() {
+		if !included {
+			return nil
+		}
+		return w.report(p, rel, info)
+	}
+	real, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return err
+	}
+	if w.walking[real] {
+		return nil
+	}
+	w.walking[real] = true
+	defer delete(w.walking, real)
+	if included || rel == "." {
+		if err := w.report(p, rel, info); err != nil {
+			return err
+		}
+	} else {
+		w.pending = append(w.pending, walkedDir{p, rel, info})
+		defer func() {
+			if n := len(w.pending); n > 0 && w.pending[n-1].rel == rel {
+				w.pending = w.pending[:n-1]
+			}
+		}()
+	}
+	if w.gitignore {
+		if f := readIgnoreFile(p, rel); f != nil {
+			w.ignores = append(w.ignores, f)
+			defer func() { w.ignores = w.ignores[:len(w.ignores)-1] }()
+		}
+	}
+	entries, err := os.ReadDir(p)
+	if err != nil {
+		return err
+	}
+	for _, d := range entries {
+		child := filepath.Join(p, d.Name())
+		ci, err := os.Lstat(child)
+		if err != nil {
+			return err
+		}
+		if err := w.walk(child, path.Join(rel, d.Name()), ci, included); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// report calls fn for the directories waiting on an entry, then the entry.
+func (w *walker) report(p, rel string, info os.FileInfo) error {
+	for _, d := range w.pending {
+		if err := w.fn(d.p, d.rel, d.info); err != nil {
+			return err
+		}
+	}
+	w.pending = w.pending[:0]
+	return w.fn(p, rel, info)
+}
+
+// ignored reports whether rel is excluded or, with gitignore, ignored.
+func (w *walker) ignored(rel string, dir bool) bool {
+	if applyRules(w.exclude, rel, dir, false) {
+		return true
+	}
+	if !w.gitignore {
+		return false
+	}
+	if dir && path.Base(rel) == ".git" {
+		return true
+	}
+	ignored := false
+	for _, f := range w.ignores {
+		if f.base == "." || strings.HasPrefix(rel, f.base+"/") {
+			ignored = applyRules(f.rules, relTo(f.base, rel), dir, ignored)
+		}
+	}
+	return ignored
+}
+
+// admits reports whether the walk of root would send the entry at rel,
+// checking the filters against rel and each directory above it.
+func (o walkOptions) admits(root, rel string) bool {
+	w := &walker{walkOptions: o}
+	included := len(o.include) == 0
+	p := root
+	parts := strings.Split(rel, "/")
+	for i := range parts {
+		if o.gitignore {
+			if f := readIgnoreFile(p, path.Join(append([]string{"."}, parts[:i]...)...)); f != nil {
+				w.ignores = append(w.ignores, f)
+			}
+		}
+		sub := strings.Join(parts[:i+1], "/")
+		dir := i < len(parts)-1
+		if w.ignored(sub, dir) {
+			return false
+		}
+		included = included || applyRules(o.include, sub, dir, false)
+		p = filepath.Join(p, parts[i])
+	}
+	return included
+}
@@ -1,43 +1,498 @@
 package server
 
 import (
-	"archive/zip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
+	"log"
+	"net/http"
 	"os"
-	"path/filepath"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/zulfikawr/warp/internal/protocol"
 )
 
-// ZipDirectory streams a zip of srcDir to w.
-func ZipDirectory(w io.Writer, srcDir string) error {
-	zw := zip.NewWriter(w)
-	defer zw.Close()
-	return filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+// Directories download as stored (uncompressed) zips whose byte layout
+// follows from file names and sizes alone. Archives therefore have a
+// Content-Length, and any byte range can be produced on demand, so an
+// interrupted download resumes. Each entry's CRC-32 goes in a data
+// descriptor after its data: it is computed as the file streams, or read
+// ahead when a range starts past it. Directories get entries of their own,
+// so empty ones survive, and symlinks are stored as links holding their
+// target, with Unix modes in the external attributes. Zip64 records take over where sizes,
+// offsets or counts don't fit the classic fields.
+
+const (
+	zipLocalHeaderLen   = 30
+	zipCentralHeaderLen = 46
+	zipEndLen           = 22
+	zip64EndLen         = 56
+	zip64LocatorLen     = 20
+	zipExtTimeLen       = 9 // extended timestamp extra field, mtime only
+
+	zipFlags  = 0x8 | 0x800 // data descriptor, UTF-8 names
+	uint16max = 1<<16 - 1
+	uint32max = 1<<32 - 1
+)
+
+// zip64Limit is the size or offset from which Zip64 fields are used.
+var zip64Limit int64 = uint32max
+
+var errZipChanged = errors.New("file changed while being archived")
+
+type zipEntry struct {
+	name   string
+	path   string
+	size   int64
+	mtime  time.Time
+	mode   os.FileMode
+	etag   string
+	data   []byte // content of entries without one in a file: a link's target
+	offset int64  // of the local header
+}
+
+func (e *zipEntry) zip64Size() bool   { return e.size >= zip64Limit }
+func (e *zipEntry) zip64Offset() bool { return e.offset >= zip64Limit }
+
+func (e *zipEntry) version() uint16 {
+	if e.zip64Size() || e.zip64Offset() {
+		return 45
+	}
+	return 20
+}
+
+// externalAttrs holds the entry's Unix type and permissions in the high
+// half, and the MS-DOS directory bit for directories.
+func (e *zipEntry) externalAttrs() uint32 {
+	switch {
+	case e.mode.IsDir():
+		return (0x4000|uint32(e.mode.Perm()))<<16 | 0x10
+	case e.mode&os.ModeSymlink != 0:
+		return (0xa000 | uint32(e.mode.Perm())) << 16
+	}
+	return (0x8000 | uint32(e.mode.Perm())) << 16
+}
+
+func (e *zipEntry) localLen() int64 {
+	n := zipLocalHeaderLen + len(e.name) + zipExtTimeLen
+	if e.zip64Size() {
+		n += 20
+	}
+	return int64(n)
+}
+
+func (e *zipEntry) descriptorLen() int64 {
+	if e.zip64Size() {
+		return 24
+	}
+	return 16
+}
+
+// span is how many bytes the entry takes before the central directory.
+func (e *zipEntry) span() int64 { return e.localLen() + e.size + e.descriptorLen() }
+
+func (e *zipEntry) localHeader() []byte {
+	b := make([]byte, 0, e.localLen())
+	b = le32(b, 0x04034b50)
+	b = le16(b, e.version())
+	b = le16(b, zipFlags)
+	b = le16(b, 0) // stored
+	b = appendDOSTime(b, e.mtime)
+	b = le32(b, 0) // CRC-32 follows the data
+	if e.zip64Size() {
+		b = le32(le32(b, uint32max), uint32max)
+	} else {
+		b = le32(le32(b, 0), 0)
+	}
+	b = le16(b, uint16(len(e.name)))
+	b = le16(b, uint16(e.localLen()-zipLocalHeaderLen-int64(len(e.name))))
+	b = append(b, e.name...)
+	if e.zip64Size() {
+		b = le64(le64(le16(le16(b, 0x0001), 16), 0), 0)
+	}
+	return appendExtTime(b, e.mtime)
+}
+
+func (e *zipEntry) descriptor(crc uint32) []byte {
+	b := le32(le32(make([]byte, 0, e.descriptorLen()), 0x08074b50), crc)
+	if e.zip64Size() {
+		return le64(le64(b, uint64(e.size)), uint64(e.size))
+	}
+	return le32(le32(b, uint32(e.size)), uint32(e.size))
+}
+
+func (e *zipEntry) centralLen() int64 {
+	n := zipCentralHeaderLen + len(e.name) + zipExtTimeLen
+	if f := e.zip64Fields(); f > 0 {
+		n += 4 + 8*f
+	}
+	return int64(n)
+}
+
+// zip64Fields counts the values the central Zip64 extra field carries.
+func (e *zipEntry) zip64Fields() int {
+	n := 0
+	if e.zip64Size() {
+		n += 2
+	}
+	if e.zip64Offset() {
+		n++
+	}
+	return n
+}
+
+func (e *zipEntry) centralHeader(crc uint32) []byte {
+	b := make([]byte, 0, e.centralLen())
+	b = le32(b, 0x02014b50)
+	b = le16(b, 3<<8|e.version()) // made by Unix
+	b = le16(b, e.version())
+	b = le16(b, zipFlags)
+	b = le16(b, 0)
+	b = appendDOSTime(b, e.mtime)
+	b = le32(b, crc)
+	if e.zip64Size() {
+		b = le32(le32(b, uint32max), uint32max)
+	} else {
+		b = le32(le32(b, uint32(e.size)), uint32(e.size))
+	}
+	b = le16(b, uint16(len(e.name)))
+	b = le16(b, uint16(e.centralLen()-zipCentralHeaderLen-int64(len(e.name))))
+	b = le16(le16(le16(b, 0), 0), 0) // comment length, disk, internal attributes
+	b = le32(b, e.externalAttrs())
+	if e.zip64Offset() {
+		b = le32(b, uint32max)
+	} else {
+		b = le32(b, uint32(e.offset))
+	}
+	b = append(b, e.name...)
+	if f := e.zip64Fields(); f > 0 {
+		b = le16(le16(b, 0x0001), uint16(8*f))
+		if e.zip64Size() {
+			b = le64(le64(b, uint64(e.size)), uint64(e.size))
+		}
+		if e.zip64Offset() {
+			b = le64(b, uint64(e.offset))
+		}
+	}
+	return appendExtTime(b, e.mtime)
+}
+
+// zipLayout is the byte layout of a stored zip of a set of files.
+type zipLayout struct {
+	entries  []*zipEntry
+	cdOffset int64
+	cdSize   int64
+	size     int64
+	etag     string
+}
+
+// newZipLayout lays out a zip of every item, each under its share name
+// when prefixed is set and at the archive root otherwise, with directories
+// walked by opts.
+func newZipLayout(items []shareItem, prefixed bool, opts walkOptions) (*zipLayout, error) {
+	l := &zipLayout{}
+	for _, it := range items {
+		prefix := ""
+		if prefixed {
+			prefix = it.Name
+		}
+		if err := l.addTree(it.Path, prefix, opts); err != nil {
+			return nil, err
 		}
-		if info.IsDir() {
+	}
+	h := sha256.New()
+	var off int64
+	for _, e := range l.entries {
+		e.offset = off
+		off += e.span()
+		fmt.Fprintf(h, "%s\x00%s\x00", e.name, e.etag)
+	}
+	l.cdOffset = off
+	for _, e := range l.entries {
+		l.cdSize += e.centralLen()
+	}
+	l.size = l.cdOffset + l.cdSize + l.endLen()
+	l.etag = `"z-` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+	return l, nil
+}
+
+// addTree adds the tree at root (a file or directory). Entry names are
+// relative to root and placed under prefix when it is non-empty; a plain
+// file is stored as prefix itself. Sockets, devices and pipes are skipped.
+func (l *zipLayout) addTree(root, prefix string, opts walkOptions) error {
+	return walkShare(root, opts, func(p, rel string, info os.FileInfo) error {
+		name := path.Join(prefix, rel)
+		e := &zipEntry{
+			path:  p,
+			mtime: info.ModTime(),
+			mode:  info.Mode(),
+			etag:  fileETag(info),
+		}
+		switch {
+		case info.IsDir():
+			if prefix == "" && rel == "." {
+				return nil
+			}
+			name += "/"
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			e.data = []byte(target)
+			e.size = int64(len(target))
+			e.etag += "-" + target
+		case info.Mode().IsRegular():
+			e.size = info.Size()
+		default:
 			return nil
 		}
-		rel, err := filepath.Rel(srcDir, path)
-		if err != nil {
-			return err
+		if len(name) > uint16max {
+			return fmt.Errorf("name too long for a zip: %s", name)
 		}
-		fh, err := zip.FileInfoHeader(info)
-		if err != nil {
-			return err
+		e.name = name
+		l.entries = append(l.entries, e)
+		return nil
+	})
+}
+
+func (l *zipLayout) zip64End() bool {
+	return len(l.entries) >= uint16max || l.cdOffset >= zip64Limit || l.cdSize >= zip64Limit
+}
+
+func (l *zipLayout) endLen() int64 {
+	if l.zip64End() {
+		return zip64EndLen + zip64LocatorLen + zipEndLen
+	}
+	return zipEndLen
+}
+
+func (l *zipLayout) end() []byte {
+	b := make([]byte, 0, l.endLen())
+	n := uint64(len(l.entries))
+	if l.zip64End() {
+		end64 := l.cdOffset + l.cdSize
+		b = le32(b, 0x06064b50)
+		b = le64(b, zip64EndLen-12)
+		b = le16(le16(b, 3<<8|45), 45)
+		b = le32(le32(b, 0), 0)
+		b = le64(le64(b, n), n)
+		b = le64(le64(b, uint64(l.cdSize)), uint64(l.cdOffset))
+		b = le32(le32(b, 0x07064b50), 0)
+		b = le32(le64(b, uint64(end64)), 1)
+		b = le32(b, 0x06054b50)
+		b = le16(le16(b, 0), 0)
+		b = le16(le16(b, uint16max), uint16max)
+		b = le32(le32(b, uint32max), uint32max)
+		return le16(b, 0)
+	}
+	b = le32(b, 0x06054b50)
+	b = le16(le16(b, 0), 0)
+	b = le16(le16(b, uint16(n)), uint16(n))
+	b = le32(le32(b, uint32(l.cdSize)), uint32(l.cdOffset))
+	return le16(b, 0)
+}
+
+// serveZip serves a stored zip of items with Range support.
+func (s *Server) serveZip(w http.ResponseWriter, r *http.Request, items []shareItem, prefixed bool, name string) {
+	if strings.Contains(r.Header.Get("Accept"), protocol.DigestMediaType) {
+		// Archives are checked through their entries' CRC-32s instead
+		http.Error(w, "no digest for archives", http.StatusNotAcceptable)
+		return
+	}
+	l, err := newZipLayout(items, prefixed, s.tree)
+	if err != nil {
+		http.Error(w, "zip error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", name))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("ETag", l.etag)
+	start, end := int64(0), l.size-1
+	status := http.StatusOK
+	rangeHeader := r.Header.Get("Range")
+	// Several ranges get the whole archive
+	if ir := r.Header.Get("If-Range"); (ir != "" && ir != l.etag) || strings.Contains(rangeHeader, ",") {
+		rangeHeader = ""
+	}
+	if strings.HasPrefix(rangeHeader, "bytes=") {
+		var ok bool
+		start, end, ok = parseRange(strings.TrimPrefix(rangeHeader, "bytes="), l.size)
+		if !ok {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", l.size))
+			http.Error(w, "invalid range", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, l.size))
+		status = http.StatusPartialContent
+	}
+	s.setBodyLength(w, end-start+1)
+	w.WriteHeader(status)
+	s.sending(w, r, name, l.size, "", start, end-start+1)
+	body, err := s.bodyWriter(w, start)
+	if err != nil {
+		return
+	}
+	cw := &countWriter{w: body}
+	err = s.writeZip(cw, l, start, end)
+	s.deliveredZip(r, items, l.etag, l.size, start, end-start+1, cw.n, err)
+	if err != nil {
+		log.Printf("Zip stream of %s failed: %v", name, err)
+		return
+	}
+	body.Close()
+	if start > 0 && end == l.size-1 {
+		log.Printf("Resumed download from byte %d for %s", start, name)
+	}
+}
+
+// writeZip writes bytes [start, end] of the zip laid out by l.
+func (s *Server) writeZip(w io.Writer, l *zipLayout, start, end int64) error {
+	var pos int64
+	// overlaps reports whether the next n bytes are wanted
+	overlaps := func(n int64) bool { return pos <= end && pos+n > start }
+	emit := func(b []byte) error {
+		defer func() { pos += int64(len(b)) }()
+		lo, hi := max(start-pos, 0), min(end+1-pos, int64(len(b)))
+		if lo >= hi {
+			return nil
+		}
+		_, err := w.Write(b[lo:hi])
+		return err
+	}
+	for _, e := range l.entries {
+		if pos > end {
+			return nil
+		}
+		if overlaps(e.localLen()) {
+			if err := emit(e.localHeader()); err != nil {
+				return err
+			}
+		} else {
+			pos += e.localLen()
+		}
+		if overlaps(e.size) {
+			if err := s.writeZipData(w, e, max(start-pos, 0), min(end+1-pos, e.size)); err != nil {
+				return err
+			}
+		}
+		pos += e.size
+		if overlaps(e.descriptorLen()) {
+			crc, err := s.zipCRC(e)
+			if err != nil {
+				return err
+			}
+			if err := emit(e.descriptor(crc)); err != nil {
+				return err
+			}
+		} else {
+			pos += e.descriptorLen()
 		}
-		fh.Name = rel
-		fh.Method = zip.Deflate
-		f, err := zw.CreateHeader(fh)
+	}
+	for _, e := range l.entries {
+		if pos > end {
+			return nil
+		}
+		if !overlaps(e.centralLen()) {
+			pos += e.centralLen()
+			continue
+		}
+		crc, err := s.zipCRC(e)
 		if err != nil {
 			return err
 		}
-		file, err := os.Open(path)
-		if err != nil {
+		if err := emit(e.centralHeader(crc)); err != nil {
 			return err
 		}
-		defer file.Close()
-		_, err = io.Copy(f, file)
+	}
+	return emit(l.end())
+}
+
+// writeZipData writes bytes [lo, hi) of e's file, noting its CRC-32 when
+// the whole file went through.
+func (s *Server) writeZipData(w io.Writer, e *zipEntry, lo, hi int64) error {
+	if !e.mode.IsRegular() {
+		_, err := w.Write(e.data[lo:hi])
 		return err
-	})
+	}
+	f, err := os.Open(e.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fileETag(fi) != e.etag {
+		return fmt.Errorf("%s: %w", e.name, errZipChanged)
+	}
+	bufPtr := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(bufPtr)
+	if lo > 0 {
+		_, err := io.CopyBuffer(w, io.NewSectionReader(f, lo, hi-lo), *bufPtr)
+		return err
+	}
+	h := crc32.NewIEEE()
+	n, err := io.CopyBuffer(w, io.TeeReader(io.NewSectionReader(f, 0, hi), h), *bufPtr)
+	if err != nil {
+		return err
+	}
+	if n != hi {
+		return fmt.Errorf("%s: %w", e.name, errZipChanged)
+	}
+	if hi == e.size {
+		s.crcs.Store(e.path, &cachedCRC{etag: e.etag, crc: h.Sum32()})
+	}
+	return nil
+}
+
+// cachedCRC is a file's CRC-32 along with the ETag it was taken at.
+type cachedCRC struct {
+	etag string
+	crc  uint32
+}
+
+// zipCRC returns the CRC-32 of e's file, reading it unless a stream of the
+// unchanged file already produced it.
+func (s *Server) zipCRC(e *zipEntry) (uint32, error) {
+	if !e.mode.IsRegular() {
+		return crc32.ChecksumIEEE(e.data), nil
+	}
+	if v, ok := s.crcs.Load(e.path); ok && v.(*cachedCRC).etag == e.etag {
+		return v.(*cachedCRC).crc, nil
+	}
+	if err := s.writeZipData(io.Discard, e, 0, e.size); err != nil {
+		return 0, err
+	}
+	v, _ := s.crcs.Load(e.path)
+	return v.(*cachedCRC).crc, nil
+}
+
+func le16(b []byte, v uint16) []byte { return binary.LittleEndian.AppendUint16(b, v) }
+func le32(b []byte, v uint32) []byte { return binary.LittleEndian.AppendUint32(b, v) }
+func le64(b []byte, v uint64) []byte { return binary.LittleEndian.AppendUint64(b, v) }
+
+// appendDOSTime appends t as MS-DOS time and date fields.
+func appendDOSTime(b []byte, t time.Time) []byte {
+	if t.Year() < 1980 {
+		t = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return le16(le16(b, uint16(t.Second()/2+t.Minute()<<5+t.Hour()<<11)),
+		uint16(t.Day()+int(t.Month())<<5+(t.Year()-1980)<<9))
+}
+
+// appendExtTime appends an extended timestamp extra field holding t, which
+// unlike the DOS fields is exact to the second and in UTC.
+func appendExtTime(b []byte, t time.Time) []byte {
+	b = le16(le16(b, 0x5455), 5)
+	b = append(b, 1)
+	return le32(b, uint32(t.Unix()))
 }
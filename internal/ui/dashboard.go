@@ -0,0 +1,178 @@
+package ui
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Row is one transfer on a Dashboard.
+type Row struct {
+	Peer   string // remote address
+	Agent  string // user agent
+	Name   string
+	Upload bool
+	Bytes  int64
+	Size   int64         // -1 when unknown
+	Rate   float64       // bytes per second
+	ETA    time.Duration // -1 when unknown
+	State  string        // such as "sending", "done" or "broken off"
+}
+
+// dashboardRows is how many transfers a Dashboard shows, latest last.
+const dashboardRows = 8
+
+// Dashboard keeps a table of transfers at the bottom of a terminal,
+// redrawing it in place. Text written to it, such as log output, scrolls
+// above the table.
+type Dashboard struct {
+	mu    sync.Mutex
+	out   io.Writer
+	width int
+	rows  []Row
+	drawn int // lines of the table on screen
+}
+
+// NewDashboard returns a Dashboard drawing to out, a terminal as wide as
+// $COLUMNS or 80 columns.
+func NewDashboard(out io.Writer) *Dashboard {
+	width, err := strconv.Atoi(os.Getenv("COLUMNS"))
+	if err != nil || width < 40 {
+		width = 80
+	}
+	return &Dashboard{out: out, width: width}
+}
+
+// Update redraws the table with rows.
+func (d *Dashboard) Update(rows []Row) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(rows) > dashboardRows {
+		rows = rows[len(rows)-dashboardRows:]
+	}
+	d.rows = rows
+	d.clear()
+	d.draw()
+}
+
+// Write prints p above the table.
+func (d *Dashboard) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.clear()
+	n, err := d.out.Write(p)
+	d.draw()
+	return n, err
+}
+
+// clear erases the table, leaving the cursor where it began.
+func (d *Dashboard) clear() {
+	if d.drawn > 0 {
+		fmt.Fprintf(d.out, "\033[%dF\033[J", d.drawn)
+		d.drawn = 0
+	}
+}
+
+func (d *Dashboard) draw() {
+	if len(d.rows) == 0 {
+		return
+	}
+	var b strings.Builder
+	b.WriteString("\n")
+	for _, r := range d.rows {
+		b.WriteString(clip(formatRow(r, d.width), d.width-1))
+		b.WriteString("\n")
+	}
+	io.WriteString(d.out, b.String())
+	d.drawn = len(d.rows) + 1
+}
+
+// formatRow lays r out as direction, peer, agent, name, completion, bytes,
+// rate and ETA or state, with a progress bar when width leaves room.
+func formatRow(r Row, width int) string {
+	dir := "↓"
+	if r.Upload {
+		dir = "↑"
+	}
+	pct := "    "
+	progress := ""
+	if r.Size >= 0 {
+		p := 100.0
+		if r.Size > 0 {
+			p = float64(r.Bytes) / float64(r.Size) * 100
+		}
+		pct = fmt.Sprintf("%3.0f%%", p)
+		progress = fmt.Sprintf("[%-20s] ", bar(p))
+	}
+	if width < 104 {
+		progress = ""
+	} else if progress == "" {
+		progress = strings.Repeat(" ", 23)
+	}
+	tail := r.State
+	if r.ETA >= 0 {
+		tail = "ETA " + formatETA(r.ETA)
+	}
+	return fmt.Sprintf("%s %-15s %-8s %-16s %s%s %9s %8s/s  %s",
+		dir, clip(r.Peer, 15), clip(agentName(r.Agent), 8), clip(r.Name, 16),
+		progress, pct, FormatBytes(r.Bytes), FormatBytes(int64(r.Rate)), tail)
+}
+
+// agentName shortens a user agent to the browser or tool behind it.
+func agentName(ua string) string {
+	// Browsers name the engines they are compatible with too, so the most
+	// specific token goes first
+	for _, b := range []struct{ token, name string }{
+		{"Edg/", "Edge"}, {"OPR/", "Opera"}, {"Firefox/", "Firefox"}, {"Chrome/", "Chrome"}, {"Safari/", "Safari"},
+	} {
+		if strings.Contains(ua, b.token) {
+			return b.name
+		}
+	}
+	if name, _, ok := strings.Cut(ua, "/"); ok {
+		return name
+	}
+	if ua == "" {
+		return "-"
+	}
+	return ua
+}
+
+// formatETA formats d as m:ss, or h:mm:ss past an hour.
+func formatETA(d time.Duration) string {
+	s := int64(d.Round(time.Second) / time.Second)
+	if s >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+	}
+	return fmt.Sprintf("%d:%02d", s/60, s%60)
+}
+
+// clip cuts s to at most n runes, marking the cut with an ellipsis.
+func clip(s string, n int) string {
+	rs := []rune(s)
+	if len(rs) <= n {
+		return s
+	}
+	if n < 1 {
+		return ""
+	}
+	return string(rs[:n-1]) + "…"
+}
+
+// FormatBytes formats n bytes with a binary unit, as in 1.5 MB.
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,44 @@
+package ui
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Pick prints options as a numbered list and reads the user's choice from
+// in, asking again until it gets a valid number. It returns the index of
+// the chosen option.
+func Pick(in *bufio.Reader, out io.Writer, prompt string, options []string) (int, error) {
+	if len(options) == 0 {
+		return 0, errors.New("nothing to pick from")
+	}
+	for i, o := range options {
+		fmt.Fprintf(out, "  %d) %s\n", i+1, o)
+	}
+	for {
+		fmt.Fprintf(out, "%s [1-%d]: ", prompt, len(options))
+		line, err := in.ReadString('\n')
+		n, perr := strconv.Atoi(strings.TrimSpace(line))
+		if perr == nil && n >= 1 && n <= len(options) {
+			return n - 1, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		fmt.Fprintln(out, "Please enter one of the numbers above.")
+	}
+}
+
+// Ask prints prompt and returns the trimmed line the user enters.
+func Ask(in *bufio.Reader, out io.Writer, prompt string) (string, error) {
+	fmt.Fprintf(out, "%s: ", prompt)
+	line, err := in.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
@@ -3,6 +3,7 @@ package ui
 import (
     "bufio"
     "fmt"
+    "io"
     "os"
     "strconv"
     "strings"
@@ -12,6 +13,11 @@ import (
 
 // PrintQR renders a QR code to the terminal as compact ASCII blocks.
 func PrintQR(s string) error {
+    return FprintQR(os.Stdout, s)
+}
+
+// FprintQR renders a QR code to w as PrintQR does.
+func FprintQR(w io.Writer, s string) error {
     // CHANGE 1: Use qrcode.Low instead of Medium.
     // This produces the smallest possible matrix dimension for the data.
     qr, err := qrcode.New(s, qrcode.Low)
@@ -27,14 +33,14 @@ func PrintQR(s string) error {
     // CHANGE 2: Removed addQuietZone call.
     // We rely on the terminal's natural background for contrast to save space.
 
-    w := len(bm[0])
+    width := len(bm[0])
     cols := detectTerminalColumns()
     
-    if cols > 0 && w > cols {
-        fmt.Fprintf(os.Stdout, "(QR width %d exceeds terminal columns %d)\n", w, cols)
+    if cols > 0 && width > cols {
+        fmt.Fprintf(w, "(QR width %d exceeds terminal columns %d)\n", width, cols)
     }
 
-    out := bufio.NewWriter(os.Stdout)
+    out := bufio.NewWriter(w)
     defer out.Flush()
 
     h := len(bm)
@@ -42,7 +48,7 @@ func PrintQR(s string) error {
     // Render logic remains the same (Half-blocks)
     for y := 0; y < h; y += 2 {
         var b strings.Builder
-        for x := 0; x < w; x++ {
+        for x := 0; x < width; x++ {
             top := bm[y][x]
             bottom := false
             if y+1 < h {
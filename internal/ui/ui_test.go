@@ -1,8 +1,11 @@
 package ui
 
 import (
+	"bufio"
 	"bytes"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestProgressReaderPercentages(t *testing.T) {
@@ -16,3 +19,34 @@ func TestProgressReaderPercentages(t *testing.T) {
 	_, _ = pr.Read(b)
 	if pr.Current != 100 { t.Fatalf("Current=%d want 100", pr.Current) }
 }
+
+func TestPickRetriesUntilValid(t *testing.T) {
+	in := bufio.NewReader(strings.NewReader("x\n7\n2\n"))
+	out := &bytes.Buffer{}
+	got, err := Pick(in, out, "Pick", []string{"a", "b", "c"})
+	if err != nil { t.Fatal(err) }
+	if got != 1 { t.Fatalf("got %d, want 1", got) }
+	if strings.Count(out.String(), "Pick [1-3]") != 3 { t.Fatalf("unexpected prompts: %q", out.String()) }
+}
+
+func TestDashboardRedrawsBelowLogs(t *testing.T) {
+	out := &bytes.Buffer{}
+	d := &Dashboard{out: out, width: 80}
+	d.Update([]Row{{Peer: "10.0.0.2", Agent: "curl/8.5.0", Name: "a.bin", Bytes: 512, Size: 1024, Rate: 1024, ETA: time.Second, State: "sending"}})
+	if !strings.Contains(out.String(), " 50%") || !strings.Contains(out.String(), "ETA 0:01") || !strings.Contains(out.String(), "curl") {
+		t.Fatalf("unexpected row: %q", out.String())
+	}
+	out.Reset()
+	d.Write([]byte("log line\n"))
+	if !strings.HasPrefix(out.String(), "\033[2F\033[J") || !strings.Contains(out.String(), "log line\n\n↓") {
+		t.Fatalf("log line not printed above the table: %q", out.String())
+	}
+	for ua, want := range map[string]string{
+		"Mozilla/5.0 (Windows NT 10.0) AppleWebKit/537.36 Chrome/120.0 Safari/537.36 Edg/120.0": "Edge",
+		"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 Chrome/120.0 Safari/537.36":         "Chrome",
+		"Go-http-client/1.1": "Go-http-client",
+		"":                   "-",
+	} {
+		if got := agentName(ua); got != want { t.Fatalf("agentName(%q) = %q, want %q", ua, got, want) }
+	}
+}
@@ -1,19 +1,36 @@
 package test
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"mime/multipart"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
 
 	"github.com/zulfikawr/warp/internal/client"
 	"github.com/zulfikawr/warp/internal/crypto"
+	"github.com/zulfikawr/warp/internal/protocol"
 	"github.com/zulfikawr/warp/internal/server"
 )
 
@@ -175,6 +192,22 @@ func TestE2E_HostUpload(t *testing.T) {
 	if string(b) != "reverse-drop-works" {
 		t.Fatalf("unexpected file content: %q", string(b))
 	}
+
+	// A second upload of the same name doesn't overwrite the first
+	buf.Reset()
+	mw = multipart.NewWriter(&buf)
+	fw, _ = mw.CreateFormFile("file", "upload.txt")
+	io.WriteString(fw, "second")
+	mw.Close()
+	resp3, err := http.Post(url, mw.FormDataContentType(), &buf)
+	if err != nil { t.Fatal(err) }
+	resp3.Body.Close()
+	if b, _ := os.ReadFile(filepath.Join(destDir, "upload (1).txt")); string(b) != "second" {
+		t.Fatalf("second upload content = %q", b)
+	}
+	if b, _ := os.ReadFile(savedPath); string(b) != "reverse-drop-works" {
+		t.Fatalf("first upload overwritten: %q", b)
+	}
 }
 
 // TestE2E_ResumableDownload verifies that downloads can be resumed from where they left off.
@@ -196,38 +229,28 @@ func TestE2E_ResumableDownload(t *testing.T) {
 	if err != nil { t.Fatal(err) }
 	defer srv.Shutdown()
 
-	// Create output path
-	outPath, err := ioutil.TempFile("", "warp-resume-out")
-	if err != nil { t.Fatal(err) }
-	outName := outPath.Name()
-	defer os.Remove(outName)
-
-	// First download: interrupt after partial download
-	// We'll simulate by downloading to a partial file
-	resp, err := http.Get(url)
-	if err != nil { t.Fatal(err) }
-	
-	// Only read 5MB (half the file)
-	limited := io.LimitReader(resp.Body, 5*1024*1024)
-	_, err = io.Copy(outPath, limited)
-	resp.Body.Close()
-	outPath.Close()
-	if err != nil { t.Fatal(err) }
+	outName := filepath.Join(t.TempDir(), "out.bin")
 
-	// Verify partial file is 5MB
-	fi, err := os.Stat(outName)
+	// First download: interrupted after 5MB
+	interruptedReceive(t, url, outName, 5*1024*1024)
+	if _, err := os.Stat(outName); !os.IsNotExist(err) {
+		t.Fatal("partial download visible under its final name")
+	}
+	fi, err := os.Stat(outName + ".warp-partial")
 	if err != nil { t.Fatal(err) }
-	if fi.Size() != 5*1024*1024 {
-		t.Fatalf("expected partial file of 5MB, got %d bytes", fi.Size())
+	if fi.Size() == 0 || fi.Size() > 5*1024*1024 {
+		t.Fatalf("expected partial file of at most 5MB, got %d bytes", fi.Size())
 	}
 
-	// Resume download using client.Receive (it should detect partial file and resume)
-	// Force is true to allow resuming existing file
-	result, err := client.Receive(url, outName, true, ioutil.Discard)
+	// Resume download using client.Receive (it should find the partial file and resume)
+	result, err := client.Receive(url, outName, false, ioutil.Discard)
 	if err != nil { t.Fatal(err) }
 	if result != outName {
 		t.Fatalf("expected %s, got %s", outName, result)
 	}
+	if left, _ := filepath.Glob(outName + ".warp-partial*"); len(left) != 0 {
+		t.Fatalf("partial files left behind: %v", left)
+	}
 
 	// Verify complete file matches original
 	srcb, _ := os.ReadFile(src.Name())
@@ -241,4 +264,1286 @@ func TestE2E_ResumableDownload(t *testing.T) {
 	if sh != oh {
 		t.Fatalf("md5 mismatch after resume: %x vs %x", sh, oh)
 	}
+
+	// An unrelated file of the same name is never taken for a partial one
+	other := filepath.Join(t.TempDir(), "other.bin")
+	os.WriteFile(other, data[:1024], 0o600)
+	if _, err := client.Receive(url, other, false, ioutil.Discard); err == nil {
+		t.Fatal("expected an error for an existing destination")
+	}
+	if _, err := client.Receive(url, other, true, ioutil.Discard); err != nil { t.Fatal(err) }
+	if b, _ := os.ReadFile(other); !bytes.Equal(b, data) {
+		t.Fatalf("forced download mismatch (got %d bytes)", len(b))
+	}
+}
+
+// interruptedReceive receives rawURL into out through a proxy that cuts
+// every response after n bytes, leaving a partial download behind. Bodies
+// come uncompressed, so n counts payload bytes.
+func interruptedReceive(t *testing.T, rawURL, out string, n int64) {
+	t.Helper()
+	target, err := neturl.Parse(rawURL)
+	if err != nil { t.Fatal(err) }
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		up := *target
+		up.Path, up.RawPath, up.RawQuery, up.Fragment = r.URL.Path, r.URL.RawPath, r.URL.RawQuery, ""
+		req, _ := http.NewRequest(r.Method, up.String(), nil)
+		req.Header = r.Header.Clone()
+		req.Header.Del(protocol.AcceptEncodingHeader)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.CopyN(w, resp.Body, n)
+	}))
+	defer proxy.Close()
+	via := *target
+	p, _ := neturl.Parse(proxy.URL)
+	via.Host = p.Host
+	if _, err := client.Receive(via.String(), out, false, ioutil.Discard); err == nil {
+		t.Fatal("interrupted receive succeeded")
+	}
+}
+
+// TestE2E_EncryptedTransfer verifies sealed payloads round-trip, resume, and
+// are unreadable without the fragment key.
+func TestE2E_EncryptedTransfer(t *testing.T) {
+	src, err := ioutil.TempFile("", "warp-enc-src")
+	if err != nil { t.Fatal(err) }
+	defer os.Remove(src.Name())
+	data := bytes.Repeat([]byte("0123456789"), 300*1024) // ~3MB
+	if _, err := src.Write(data); err != nil { t.Fatal(err) }
+	_ = src.Close()
+
+	tok, _ := crypto.GenerateToken(nil)
+	id, secret := crypto.SplitToken(tok)
+	srv := &server.Server{Token: id, Secret: secret, SrcPath: src.Name()}
+	url, err := srv.Start()
+	if err != nil { t.Fatal(err) }
+	defer srv.Shutdown()
+	if !strings.Contains(url, "#key="+secret) || strings.Contains(url, "/"+tok) {
+		t.Fatalf("unexpected URL %s", url)
+	}
+
+	// The wire bytes must not contain the plaintext
+	resp, err := http.Get(url)
+	if err != nil { t.Fatal(err) }
+	wire, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	resp.Body.Close()
+	if bytes.Contains(wire, []byte("0123456789")) {
+		t.Fatal("payload travelled in plaintext")
+	}
+
+	// Without the key the receiver refuses
+	plainURL := url[:strings.Index(url, "#")]
+	if _, err := client.Receive(plainURL, filepath.Join(os.TempDir(), "warp-enc-nokey"), true, ioutil.Discard); err == nil {
+		t.Fatal("expected error receiving without key")
+	}
+
+	// Resume an interrupted download
+	outName := filepath.Join(t.TempDir(), "out.bin")
+	interruptedReceive(t, url, outName, 1<<20)
+	out, err := client.Receive(url, outName, false, ioutil.Discard)
+	if err != nil { t.Fatal(err) }
+	got, _ := os.ReadFile(out)
+	if !bytes.Equal(got, data) {
+		t.Fatalf("decrypted payload mismatch (got %d bytes)", len(got))
+	}
+}
+
+// TestE2E_CodeExchange verifies a short code unlocks the transfer once, and a
+// wrong guess stops the sender.
+func TestE2E_CodeExchange(t *testing.T) {
+	start := func() (*server.Server, string, string) {
+		code, err := crypto.GenerateCode(nil)
+		if err != nil { t.Fatal(err) }
+		tok, _ := crypto.GenerateToken(nil)
+		id, secret := crypto.SplitToken(tok)
+		srv := &server.Server{Token: id, Secret: secret, Code: code, TextContent: "via code"}
+		u, err := srv.Start()
+		if err != nil { t.Fatal(err) }
+		return srv, u[:strings.Index(u, "/d/")], code
+	}
+
+	srv, base, code := start()
+	defer srv.Shutdown()
+	u, err := client.ExchangeCode(base, code)
+	if err != nil { t.Fatal(err) }
+	if _, err := client.Receive(u, "", false, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.ExchangeCode(base, code); err == nil {
+		t.Fatal("code accepted twice")
+	}
+
+	srv2, base2, code2 := start()
+	defer srv2.Shutdown()
+	wrong := strings.SplitN(code2, "-", 2)[0] + "-acid-acid"
+	if wrong == code2 {
+		wrong = strings.SplitN(code2, "-", 2)[0] + "-acorn-acorn"
+	}
+	if _, err := client.ExchangeCode(base2, wrong); err != client.ErrWrongCode {
+		t.Fatalf("wrong code: err = %v, want ErrWrongCode", err)
+	}
+	select {
+	case <-srv2.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("server kept running after a wrong guess")
+	}
+	if srv2.Err() != server.ErrWrongCode {
+		t.Fatalf("Err() = %v", srv2.Err())
+	}
+}
+
+// TestE2E_TLSPinnedTransfer verifies HTTPS transfers pin the certificate
+// fingerprint carried in the URL fragment.
+func TestE2E_TLSPinnedTransfer(t *testing.T) {
+	tok, _ := crypto.GenerateToken(nil)
+	srv := &server.Server{Token: tok, TextContent: "over tls", TLS: true}
+	u, err := srv.Start()
+	if err != nil { t.Fatal(err) }
+	defer srv.Shutdown()
+	if !strings.HasPrefix(u, "https://") || !strings.Contains(u, "#fp="+srv.Fingerprint) {
+		t.Fatalf("unexpected URL %s", u)
+	}
+
+	if _, err := client.Receive(u, "", false, ioutil.Discard); err != nil {
+		t.Fatalf("pinned receive failed: %v", err)
+	}
+
+	// A different pin must be refused
+	bad := u[:strings.Index(u, "#")] + "#fp=" + strings.Repeat("00", 32)
+	if _, err := client.Receive(bad, "", false, ioutil.Discard); err == nil {
+		t.Fatal("receive succeeded with the wrong fingerprint")
+	}
+	// Without a pin the self-signed certificate is not trusted
+	if _, err := client.Receive(u[:strings.Index(u, "#")], "", false, ioutil.Discard); err == nil {
+		t.Fatal("receive trusted a self-signed certificate without a pin")
+	}
+
+	// The code exchange hands out the fingerprint too
+	code, _ := crypto.GenerateCode(nil)
+	id, secret := crypto.SplitToken(tok)
+	srv2 := &server.Server{Token: id, Secret: secret, Code: code, TextContent: "code over tls", TLS: true}
+	u2, err := srv2.Start()
+	if err != nil { t.Fatal(err) }
+	defer srv2.Shutdown()
+	got, err := client.ExchangeCode(u2, code)
+	if err != nil { t.Fatal(err) }
+	if !strings.Contains(got, "fp="+srv2.Fingerprint) || !strings.HasPrefix(got, "https://") {
+		t.Fatalf("exchange returned %s", got)
+	}
+}
+
+// TestE2E_MultiItemShare verifies several paths share one session behind an
+// index, per-item URLs and a zip of everything.
+func TestE2E_MultiItemShare(t *testing.T) {
+	srcDir := t.TempDir()
+	a := filepath.Join(srcDir, "a.log")
+	b := filepath.Join(srcDir, "b.log")
+	conf := filepath.Join(srcDir, "conf")
+	os.WriteFile(a, []byte("alpha"), 0o644)
+	os.WriteFile(b, []byte("bravo"), 0o644)
+	os.MkdirAll(conf, 0o755)
+	os.WriteFile(filepath.Join(conf, "app.ini"), []byte("x=1"), 0o644)
+
+	tok, _ := crypto.GenerateToken(nil)
+	srv := &server.Server{Token: tok, SrcPath: a, SrcPaths: []string{b, conf}}
+	u, err := srv.Start()
+	if err != nil { t.Fatal(err) }
+	defer srv.Shutdown()
+
+	// Browsers get an HTML index
+	resp, err := http.Get(u)
+	if err != nil { t.Fatal(err) }
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(page), "b.log") || !strings.Contains(string(page), "/all") {
+		t.Fatalf("unexpected index page: %s", page)
+	}
+
+	out := t.TempDir()
+	got, err := client.Receive(u, out, false, ioutil.Discard)
+	if err != nil { t.Fatal(err) }
+	if got != out { t.Fatalf("Receive returned %s, want %s", got, out) }
+	for name, want := range map[string]string{"a.log": "alpha", "b.log": "bravo"} {
+		if b, _ := os.ReadFile(filepath.Join(out, name)); string(b) != want {
+			t.Fatalf("%s = %q, want %q", name, b, want)
+		}
+	}
+	if b, _ := os.ReadFile(filepath.Join(out, "conf", "app.ini")); string(b) != "x=1" {
+		t.Fatalf("conf/app.ini = %q, want %q", b, "x=1")
+	}
+
+	// Everything as one zip
+	resp, err = http.Get(u + "/all")
+	if err != nil { t.Fatal(err) }
+	all, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	zr, err := zip.NewReader(bytes.NewReader(all), int64(len(all)))
+	if err != nil { t.Fatal(err) }
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	if strings.Join(names, ",") != "a.log,b.log,conf/,conf/app.ini" {
+		t.Fatalf("zip entries = %v", names)
+	}
+}
+
+// TestE2E_DirectoryTree verifies a shared directory is mirrored file by file,
+// with partial files resumed and paths outside the tree refused.
+func TestE2E_DirectoryTree(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "photos")
+	big := bytes.Repeat([]byte("0123456789"), 200*1024) // ~2MB
+	os.MkdirAll(filepath.Join(src, "2024", "june"), 0o755)
+	os.MkdirAll(filepath.Join(src, "empty"), 0o755)
+	os.WriteFile(filepath.Join(src, "index.txt"), []byte("photos"), 0o644)
+	os.WriteFile(filepath.Join(src, "2024", "june", "beach.raw"), big, 0o600)
+	os.WriteFile(filepath.Join(src, "run.sh"), []byte("#!/bin/sh\n"), 0o755)
+	mtime := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	os.Chtimes(filepath.Join(src, "index.txt"), mtime, mtime)
+
+	tok, _ := crypto.GenerateToken(nil)
+	id, secret := crypto.SplitToken(tok)
+	srv := &server.Server{Token: id, Secret: secret, SrcPath: src}
+	u, err := srv.Start()
+	if err != nil { t.Fatal(err) }
+	defer srv.Shutdown()
+
+	// Files outside the shared directory are not reachable
+	base := u[:strings.Index(u, "#")]
+	resp, err := http.Get(base + "/1/..%2F..%2Fetc%2Fpasswd")
+	if err != nil { t.Fatal(err) }
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("traversal status = %d, want 404", resp.StatusCode)
+	}
+
+	// An interrupted earlier run left half of the large file behind
+	out := filepath.Join(t.TempDir(), "photos")
+	interruptedReceive(t, u, out, 1<<20)
+	if _, err := os.Stat(filepath.Join(out, "2024", "june", "beach.raw.warp-partial")); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := client.Receive(u, out, false, ioutil.Discard)
+	if err != nil { t.Fatal(err) }
+	if got != out { t.Fatalf("Receive returned %s, want %s", got, out) }
+	if b, _ := os.ReadFile(filepath.Join(out, "2024", "june", "beach.raw")); !bytes.Equal(b, big) {
+		t.Fatalf("resumed file mismatch (got %d bytes)", len(b))
+	}
+	if fi, err := os.Stat(filepath.Join(out, "empty")); err != nil || !fi.IsDir() {
+		t.Fatalf("empty directory not recreated: %v", err)
+	}
+	if fi, err := os.Stat(filepath.Join(out, "run.sh")); err != nil || fi.Mode().Perm() != 0o755 {
+		t.Fatalf("run.sh mode not preserved: %v", err)
+	}
+	if fi, err := os.Stat(filepath.Join(out, "index.txt")); err != nil || !fi.ModTime().Equal(mtime) {
+		t.Fatalf("index.txt mtime not preserved: %v", err)
+	}
+
+	// A second run finds everything complete
+	if _, err := client.Receive(u, out, false, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestE2E_SymlinkPolicies verifies symlinks inside a mirrored directory
+// are kept as links, followed or skipped as the sender chose.
+func TestE2E_SymlinkPolicies(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "repo")
+	outside := t.TempDir()
+	os.MkdirAll(src, 0o755)
+	os.WriteFile(filepath.Join(src, "run.sh"), []byte("#!/bin/sh\n"), 0o755)
+	os.WriteFile(filepath.Join(outside, "lib.txt"), []byte("lib"), 0o644)
+	os.Symlink("run.sh", filepath.Join(src, "latest"))
+	os.Symlink(outside, filepath.Join(src, "vendor"))
+
+	for _, policy := range []string{server.SymlinksPreserve, server.SymlinksFollow, server.SymlinksSkip} {
+		tok, _ := crypto.GenerateToken(nil)
+		srv := &server.Server{Token: tok, SrcPath: src, Symlinks: policy}
+		u, err := srv.Start()
+		if err != nil { t.Fatal(err) }
+		defer srv.Shutdown()
+
+		out := filepath.Join(t.TempDir(), "repo")
+		if _, err := client.Receive(u, out, false, ioutil.Discard); err != nil { t.Fatalf("%s: %v", policy, err) }
+		latest, _ := os.Readlink(filepath.Join(out, "latest"))
+		lib, _ := os.ReadFile(filepath.Join(out, "vendor", "lib.txt"))
+		_, lerr := os.Lstat(filepath.Join(out, "vendor"))
+		switch policy {
+		case server.SymlinksPreserve:
+			if vendor, _ := os.Readlink(filepath.Join(out, "vendor")); latest != "run.sh" || vendor != outside {
+				t.Fatalf("preserve: links point at %q and %q", latest, vendor)
+			}
+		case server.SymlinksFollow:
+			if b, _ := os.ReadFile(filepath.Join(out, "latest")); latest != "" || string(b) != "#!/bin/sh\n" || string(lib) != "lib" {
+				t.Fatalf("follow: latest %q, vendor/lib.txt %q", b, lib)
+			}
+		case server.SymlinksSkip:
+			if latest != "" || !os.IsNotExist(lerr) {
+				t.Fatalf("skip: links were sent (%q, %v)", latest, lerr)
+			}
+		}
+		// Links already in place count as complete
+		if _, err := client.Receive(u, out, false, ioutil.Discard); err != nil { t.Fatalf("%s: second run: %v", policy, err) }
+	}
+}
+
+// TestE2E_FilteredDirectory verifies --gitignore and --exclude trim what a
+// directory send lists, sizes, serves and delivers.
+func TestE2E_FilteredDirectory(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "project")
+	files := map[string]string{
+		".gitignore":            "node_modules/\n*.tmp\n",
+		"main.go":               "package main\n",
+		"node_modules/dep/a.js": strings.Repeat("x", 100000),
+		"cache.tmp":             "scratch",
+		".git/HEAD":             "ref: refs/heads/main\n",
+		"dist/bundle.js":        "bundle",
+	}
+	for name, data := range files {
+		os.MkdirAll(filepath.Join(src, filepath.Dir(name)), 0o755)
+		os.WriteFile(filepath.Join(src, name), []byte(data), 0o644)
+	}
+	notes := filepath.Join(t.TempDir(), "notes.txt")
+	os.WriteFile(notes, []byte("notes"), 0o644)
+
+	tok, _ := crypto.GenerateToken(nil)
+	srv := &server.Server{Token: tok, SrcPath: src, SrcPaths: []string{notes}, GitIgnore: true, Exclude: []string{"dist"}}
+	u, err := srv.Start()
+	if err != nil { t.Fatal(err) }
+	defer srv.Shutdown()
+
+	// The index sizes the directory by what is sent
+	req, _ := http.NewRequest(http.MethodGet, u, nil)
+	req.Header.Set("Accept", protocol.IndexMediaType)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil { t.Fatal(err) }
+	var idx protocol.Index
+	err = json.NewDecoder(resp.Body).Decode(&idx)
+	resp.Body.Close()
+	if err != nil { t.Fatal(err) }
+	if want := int64(len(files[".gitignore"]) + len(files["main.go"])); idx.Items[0].Size != want {
+		t.Fatalf("index size = %d, want %d", idx.Items[0].Size, want)
+	}
+
+	// Left-out files can't be fetched by name either
+	for _, name := range []string{"node_modules/dep/a.js", "cache.tmp", ".git/HEAD", "dist/bundle.js"} {
+		resp, err := http.Get(u + "/1/" + name)
+		if err != nil { t.Fatal(err) }
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("%s: status %d, want 404", name, resp.StatusCode)
+		}
+	}
+
+	out := t.TempDir()
+	if _, err := client.Receive(u, out, false, ioutil.Discard); err != nil { t.Fatal(err) }
+	var got []string
+	filepath.Walk(filepath.Join(out, "project"), func(p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			rel, _ := filepath.Rel(filepath.Join(out, "project"), p)
+			got = append(got, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if strings.Join(got, ",") != ".gitignore,main.go" {
+		t.Fatalf("received %v", got)
+	}
+}
+
+// TestE2E_CompressedTransfer verifies compressible files travel compressed
+// per range, sealed or not, that compressed data is sent as is, and that a
+// compressed download resumes.
+func TestE2E_CompressedTransfer(t *testing.T) {
+	var log bytes.Buffer
+	for i := 0; log.Len() < 12<<20; i++ {
+		fmt.Fprintf(&log, "2026-10-16T06:%02d:%02d INFO request %d served in %dms\n", i/60%60, i%60, i, i%97)
+	}
+	data := log.Bytes()
+	dir := t.TempDir()
+	src := filepath.Join(dir, "app.log")
+	os.WriteFile(src, data, 0o644)
+	noise := make([]byte, 1<<20)
+	rand.Read(noise)
+	os.WriteFile(filepath.Join(dir, "noise.bin"), noise, 0o644)
+
+	for _, sealed := range []bool{false, true} {
+		tok, _ := crypto.GenerateToken(nil)
+		srv := &server.Server{Token: tok, SrcPath: src, SrcPaths: []string{filepath.Join(dir, "noise.bin")}}
+		if sealed {
+			srv.Token, srv.Secret = crypto.SplitToken(tok)
+		}
+		u, err := srv.Start()
+		if err != nil { t.Fatal(err) }
+		defer srv.Shutdown()
+		base, frag, _ := strings.Cut(u, "#")
+		logURL, noiseURL := base+"/1", base+"/2"
+		if frag != "" {
+			logURL += "#" + frag
+		}
+
+		fetch := func(url, rng, coding string) (*http.Response, int64) {
+			req, _ := http.NewRequest(http.MethodGet, url, nil)
+			req.Header.Set(protocol.AcceptEncodingHeader, coding)
+			if rng != "" {
+				req.Header.Set("Range", rng)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil { t.Fatal(err) }
+			n, _ := io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			return resp, n
+		}
+		resp, wire := fetch(base+"/1", "", "zstd, gzip")
+		if resp.Header.Get(protocol.EncodingHeader) != protocol.EncodingZstd || wire > int64(len(data))/5 {
+			t.Fatalf("sealed=%v: encoding %q, %d of %d bytes on the wire", sealed, resp.Header.Get(protocol.EncodingHeader), wire, len(data))
+		}
+		resp, _ = fetch(base+"/1", "bytes=1000-1999999", "gzip")
+		if resp.StatusCode != http.StatusPartialContent || resp.Header.Get(protocol.EncodingHeader) != protocol.EncodingGzip ||
+			resp.Header.Get(protocol.PlainLengthHeader) != "1999000" {
+			t.Fatalf("sealed=%v: range: status %d, encoding %q, length %q", sealed, resp.StatusCode,
+				resp.Header.Get(protocol.EncodingHeader), resp.Header.Get(protocol.PlainLengthHeader))
+		}
+		if resp, _ := fetch(noiseURL, "", "zstd"); resp.Header.Get(protocol.EncodingHeader) != "" {
+			t.Fatalf("sealed=%v: random data sent as %q", sealed, resp.Header.Get(protocol.EncodingHeader))
+		}
+
+		// An uncompressed run left part of the file behind; the rest comes
+		// compressed
+		out := filepath.Join(t.TempDir(), "app.log")
+		interruptedReceive(t, logURL, out, 1<<20)
+		if _, err := client.Receive(logURL, out, false, ioutil.Discard); err != nil { t.Fatalf("sealed=%v: %v", sealed, err) }
+		if b, _ := os.ReadFile(out); !bytes.Equal(b, data) {
+			t.Fatalf("sealed=%v: received log mismatch (got %d bytes)", sealed, len(b))
+		}
+	}
+}
+
+// TestE2E_SegmentedDownload verifies bounded ranges and that large files
+// arrive intact over parallel ranged requests, sealed or not.
+func TestE2E_SegmentedDownload(t *testing.T) {
+	data := make([]byte, 20<<20+12345)
+	for i := range data {
+		data[i] = byte(i * 7 % 251)
+	}
+	src := filepath.Join(t.TempDir(), "big.bin")
+	if err := os.WriteFile(src, data, 0o644); err != nil { t.Fatal(err) }
+
+	tok, _ := crypto.GenerateToken(nil)
+	srv := &server.Server{Token: tok, SrcPath: src}
+	u, err := srv.Start()
+	if err != nil { t.Fatal(err) }
+	defer srv.Shutdown()
+
+	req, _ := http.NewRequest(http.MethodGet, u, nil)
+	req.Header.Set("Range", "bytes=10-19")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil { t.Fatal(err) }
+	part, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(part, data[10:20]) {
+		t.Fatalf("range 10-19: status %d, %d bytes", resp.StatusCode, len(part))
+	}
+
+	out, err := client.Receive(u, filepath.Join(t.TempDir(), "plain.bin"), false, ioutil.Discard)
+	if err != nil { t.Fatal(err) }
+	if got, _ := os.ReadFile(out); !bytes.Equal(got, data) {
+		t.Fatalf("plain download mismatch (got %d bytes)", len(got))
+	}
+
+	// Interrupted segments leave a partial file of full size, as a killed
+	// receiver would; only the ranges recorded beside it count as received
+	cut := filepath.Join(t.TempDir(), "cut.bin")
+	interruptedReceive(t, u, cut, 1<<20)
+	pf, err := os.OpenFile(cut+".warp-partial", os.O_RDWR, 0)
+	if err != nil { t.Fatal(err) }
+	if fi, _ := pf.Stat(); fi.Size() != int64(len(data)) {
+		t.Fatalf("partial file of %d bytes, want the full %d", fi.Size(), len(data))
+	}
+	pf.WriteAt(bytes.Repeat([]byte{0xff}, 1<<20), int64(len(data)-1<<20))
+	pf.Close()
+	if _, err := client.Receive(u, cut, false, ioutil.Discard); err != nil { t.Fatal(err) }
+	if got, _ := os.ReadFile(cut); !bytes.Equal(got, data) {
+		t.Fatal("resumed segmented download mismatch")
+	}
+
+	id, secret := crypto.SplitToken(tok)
+	enc := &server.Server{Token: id, Secret: secret, SrcPath: src}
+	eu, err := enc.Start()
+	if err != nil { t.Fatal(err) }
+	defer enc.Shutdown()
+	out, err = client.Receive(eu, filepath.Join(t.TempDir(), "sealed.bin"), false, ioutil.Discard)
+	if err != nil { t.Fatal(err) }
+	if got, _ := os.ReadFile(out); !bytes.Equal(got, data) {
+		t.Fatalf("sealed download mismatch (got %d bytes)", len(got))
+	}
+}
+
+// TestE2E_IntegrityVerification verifies a corrupt resumed prefix is caught
+// with the range to re-fetch, and host uploads reject chunks whose digest
+// doesn't match.
+func TestE2E_IntegrityVerification(t *testing.T) {
+	data := bytes.Repeat([]byte("integrity!"), 1<<20) // 10MB
+	src := filepath.Join(t.TempDir(), "data.bin")
+	os.WriteFile(src, data, 0o644)
+
+	tok, _ := crypto.GenerateToken(nil)
+	srv := &server.Server{Token: tok, SrcPath: src}
+	u, err := srv.Start()
+	if err != nil { t.Fatal(err) }
+	defer srv.Shutdown()
+
+	// A partial file whose prefix got corrupted on disk
+	out := filepath.Join(t.TempDir(), "data.bin")
+	interruptedReceive(t, u, out, 5<<20)
+	pf, err := os.OpenFile(out+".warp-partial", os.O_RDWR, 0)
+	if err != nil { t.Fatal(err) }
+	pf.WriteAt([]byte{^data[4<<20+1]}, 4<<20+1)
+	pf.Close()
+	_, err = client.Receive(u, out, false, ioutil.Discard)
+	var ce *client.CorruptError
+	if !errors.As(err, &ce) {
+		t.Fatalf("expected CorruptError, got %v", err)
+	}
+	if len(ce.Ranges) != 1 || ce.Ranges[0] != [2]int64{4 << 20, 8<<20 - 1} {
+		t.Fatalf("corrupt ranges = %v", ce.Ranges)
+	}
+	// The next run re-fetches from the first bad byte
+	if _, err := client.Receive(u, out, false, ioutil.Discard); err != nil { t.Fatal(err) }
+	if b, _ := os.ReadFile(out); !bytes.Equal(b, data) {
+		t.Fatal("re-fetched file mismatch")
+	}
+
+	// Host mode: a chunk with a wrong digest is rejected, the right one taken
+	destDir := t.TempDir()
+	host := &server.Server{Token: tok, HostMode: true, UploadDir: destDir}
+	hu, err := host.Start()
+	if err != nil { t.Fatal(err) }
+	defer host.Shutdown()
+	chunk := []byte("chunk-payload")
+	sum := sha256.Sum256(chunk)
+	for _, tc := range []struct {
+		sum  string
+		want int
+	}{
+		{hex.EncodeToString(make([]byte, sha256.Size)), http.StatusUnprocessableEntity},
+		{hex.EncodeToString(sum[:]), http.StatusOK},
+	} {
+		req, _ := http.NewRequest(http.MethodPost, hu, bytes.NewReader(chunk))
+		req.Header.Set("X-File-Name", "up.bin")
+		req.Header.Set("X-Upload-Offset", "0")
+		req.Header.Set("X-Upload-Total", "13")
+		req.Header.Set("X-Upload-ID", "e2e-digest")
+		req.Header.Set("X-Upload-SHA256", tc.sum)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil { t.Fatal(err) }
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Fatalf("upload with digest %s: status %d, want %d", tc.sum[:8], resp.StatusCode, tc.want)
+		}
+	}
+	if b, _ := os.ReadFile(filepath.Join(destDir, "up.bin")); !bytes.Equal(b, chunk) {
+		t.Fatalf("uploaded content = %q", b)
+	}
+
+	// Chunks that can't be staged in a session are refused, not written in place
+	for _, h := range []map[string]string{
+		{"X-Upload-ID": "e2e-open"},
+		{"X-Upload-Total": "13"},
+	} {
+		req, _ := http.NewRequest(http.MethodPost, hu, bytes.NewReader(chunk))
+		req.Header.Set("X-File-Name", "up.bin")
+		req.Header.Set("X-Upload-Offset", "0")
+		for k, v := range h {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil { t.Fatal(err) }
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("chunk with only %v: status %d", h, resp.StatusCode)
+		}
+	}
+	if left, _ := filepath.Glob(filepath.Join(destDir, "up (*")); len(left) != 0 {
+		t.Fatalf("refused chunks left files behind: %v", left)
+	}
+}
+
+// TestE2E_IPv6Transfer verifies a sender bound to an IPv6 address hands out
+// a bracketed URL receivers can use.
+func TestE2E_IPv6Transfer(t *testing.T) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil { t.Skip("no IPv6 loopback:", err) }
+	ln.Close()
+
+	src := filepath.Join(t.TempDir(), "v6.txt")
+	os.WriteFile(src, []byte("over ipv6"), 0o644)
+	tok, _ := crypto.GenerateToken(nil)
+	srv := &server.Server{Token: tok, SrcPath: src, ListenAddr: "::1"}
+	u, err := srv.Start()
+	if err != nil { t.Fatal(err) }
+	defer srv.Shutdown()
+	if !strings.HasPrefix(u, "http://[::1]:") {
+		t.Fatalf("unexpected URL %s", u)
+	}
+	out, err := client.Receive(u, filepath.Join(t.TempDir(), "v6.txt"), false, ioutil.Discard)
+	if err != nil { t.Fatal(err) }
+	if b, _ := os.ReadFile(out); string(b) != "over ipv6" {
+		t.Fatalf("got %q", b)
+	}
+}
+
+// TestE2E_UploadToHost verifies the Go uploader delivers a multi-chunk file
+// to a host, digests included.
+func TestE2E_UploadToHost(t *testing.T) {
+	destDir := t.TempDir()
+	tok, _ := crypto.GenerateToken(nil)
+	srv := &server.Server{Token: tok, HostMode: true, UploadDir: destDir}
+	u, err := srv.Start()
+	if err != nil { t.Fatal(err) }
+	defer srv.Shutdown()
+
+	data := bytes.Repeat([]byte("upload-"), 700*1024) // ~4.9MB, three chunks
+	src := filepath.Join(t.TempDir(), "scan.bin")
+	os.WriteFile(src, data, 0o644)
+	if err := client.Upload(u, src, ioutil.Discard); err != nil { t.Fatal(err) }
+	if got, _ := os.ReadFile(filepath.Join(destDir, "scan.bin")); !bytes.Equal(got, data) {
+		t.Fatalf("uploaded file mismatch (got %d bytes)", len(got))
+	}
+}
+
+// TestE2E_ResumableUpload verifies an upload session survives a host
+// restart and resumes with only the missing ranges.
+func TestE2E_ResumableUpload(t *testing.T) {
+	destDir := t.TempDir()
+	tok, _ := crypto.GenerateToken(nil)
+	srv := &server.Server{Token: tok, HostMode: true, UploadDir: destDir}
+	u, err := srv.Start()
+	if err != nil { t.Fatal(err) }
+
+	data := bytes.Repeat([]byte("session-"), 512*1024) // 4MB
+	src := filepath.Join(t.TempDir(), "video.bin")
+	os.WriteFile(src, data, 0o644)
+	// Name and size alone don't tell two files apart
+	body, _ := json.Marshal(protocol.UploadSessionRequest{Name: "video.bin", Size: int64(len(data))})
+	resp, err := http.Post(u+"/sessions", "application/json", bytes.NewReader(body))
+	if err != nil { t.Fatal(err) }
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("session without a digest: status %d", resp.StatusCode)
+	}
+
+	sum := sha256.Sum256(data)
+	body, _ = json.Marshal(protocol.UploadSessionRequest{Name: "video.bin", Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:])})
+	resp, err = http.Post(u+"/sessions", "application/json", bytes.NewReader(body))
+	if err != nil { t.Fatal(err) }
+	var sess protocol.UploadSession
+	json.NewDecoder(resp.Body).Decode(&sess)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(sess.Missing) != 1 || sess.Missing[0] != [2]int64{0, int64(len(data)) - 1} {
+		t.Fatalf("new session: status %d, %+v", resp.StatusCode, sess)
+	}
+	req, _ := http.NewRequest(http.MethodPost, u+"/sessions/"+sess.ID, bytes.NewReader(data[:1<<20]))
+	req.Header.Set("X-Upload-Offset", "0")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil { t.Fatal(err) }
+	resp.Body.Close()
+	srv.Shutdown()
+
+	// A restarted host finds the session in its journal
+	srv2 := &server.Server{Token: tok, HostMode: true, UploadDir: destDir}
+	u2, err := srv2.Start()
+	if err != nil { t.Fatal(err) }
+	defer srv2.Shutdown()
+	resp, err = http.Get(u2 + "/sessions/" + sess.ID)
+	if err != nil { t.Fatal(err) }
+	json.NewDecoder(resp.Body).Decode(&sess)
+	resp.Body.Close()
+	if len(sess.Missing) != 1 || sess.Missing[0] != [2]int64{1 << 20, int64(len(data)) - 1} || sess.Complete {
+		t.Fatalf("resumed session: %+v", sess)
+	}
+	resp, err = http.Post(u2+"/sessions/"+sess.ID+"/finish", "application/json", nil)
+	if err != nil { t.Fatal(err) }
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("finishing an incomplete upload: status %d", resp.StatusCode)
+	}
+	if _, err := os.Stat(filepath.Join(destDir, "video.bin")); !os.IsNotExist(err) {
+		t.Fatal("partial upload visible under its final name")
+	}
+
+	if err := client.Upload(u2, src, ioutil.Discard); err != nil { t.Fatal(err) }
+	if got, _ := os.ReadFile(filepath.Join(destDir, "video.bin")); !bytes.Equal(got, data) {
+		t.Fatalf("uploaded file mismatch (got %d bytes)", len(got))
+	}
+	if left, _ := filepath.Glob(filepath.Join(destDir, ".warp-*")); len(left) != 0 {
+		t.Fatalf("staging files left behind: %v", left)
+	}
+}
+
+// TestE2E_SuffixAndMultiRange verifies browsers and media players can ask
+// for the tail of a payload, or several ranges of it at once.
+func TestE2E_SuffixAndMultiRange(t *testing.T) {
+	dir := t.TempDir()
+	data := make([]byte, 64<<10)
+	rand.Read(data)
+	os.WriteFile(filepath.Join(dir, "clip.bin"), data, 0o644)
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("notes"), 0o644)
+
+	get := func(u, rng string) (*http.Response, []byte) {
+		req, _ := http.NewRequest(http.MethodGet, u, nil)
+		req.Header.Set("Range", rng)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil { t.Fatal(err) }
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil { t.Fatal(err) }
+		return resp, b
+	}
+
+	tok, _ := crypto.GenerateToken(nil)
+	srv := &server.Server{Token: tok, SrcPath: filepath.Join(dir, "clip.bin")}
+	u, err := srv.Start()
+	if err != nil { t.Fatal(err) }
+	defer srv.Shutdown()
+	resp, b := get(u, "bytes=-100")
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(b, data[len(data)-100:]) {
+		t.Fatalf("suffix range: status %d, %d bytes", resp.StatusCode, len(b))
+	}
+	if cr := resp.Header.Get("Content-Range"); cr != fmt.Sprintf("bytes %d-%d/%d", len(data)-100, len(data)-1, len(data)) {
+		t.Fatalf("suffix range: Content-Range %q", cr)
+	}
+	resp, _ = get(u, "bytes=0-9,100-109")
+	if resp.StatusCode != http.StatusPartialContent || !strings.HasPrefix(resp.Header.Get("Content-Type"), "multipart/byteranges") {
+		t.Fatalf("multi-range: status %d, type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	// Directories go out as a zip, whose tail can be asked for too
+	tok2, _ := crypto.GenerateToken(nil)
+	dirSrv := &server.Server{Token: tok2, SrcPath: dir}
+	du, err := dirSrv.Start()
+	if err != nil { t.Fatal(err) }
+	defer dirSrv.Shutdown()
+	whole, full := get(du, "")
+	resp, b = get(du, "bytes=-22")
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(b, full[len(full)-22:]) {
+		t.Fatalf("zip suffix range: status %d (whole %d), %d bytes", resp.StatusCode, whole.StatusCode, len(b))
+	}
+	resp, b = get(du, "bytes=0-9,100-109")
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(b, full) {
+		t.Fatalf("zip multi-range: status %d, %d bytes", resp.StatusCode, len(b))
+	}
+}
+
+// TestE2E_ResumeAfterSourceChange verifies a partial download of a file the
+// sender has since replaced starts over instead of splicing two versions.
+func TestE2E_ResumeAfterSourceChange(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "report.bin")
+	v1 := bytes.Repeat([]byte("version-1:"), 1<<20) // 10MB
+	v2 := bytes.Repeat([]byte("version-2:"), 1<<20)
+	os.WriteFile(src, v1, 0o644)
+	mtime := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	os.Chtimes(src, mtime, mtime)
+
+	tok, _ := crypto.GenerateToken(nil)
+	srv := &server.Server{Token: tok, SrcPath: src}
+	u, err := srv.Start()
+	if err != nil { t.Fatal(err) }
+	defer srv.Shutdown()
+
+	out := filepath.Join(t.TempDir(), "report.bin")
+	interruptedReceive(t, u, out, 5<<20)
+
+	// Same name, size and mtime; only the inode tells them apart
+	tmp := filepath.Join(dir, "report.new")
+	os.WriteFile(tmp, v2, 0o644)
+	os.Chtimes(tmp, mtime, mtime)
+	if err := os.Rename(tmp, src); err != nil { t.Fatal(err) }
+
+	// A stale validator gets the whole file rather than a range
+	req, _ := http.NewRequest(http.MethodGet, u, nil)
+	req.Header.Set("Range", "bytes=100-")
+	req.Header.Set("If-Range", `"stale"`)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil { t.Fatal(err) }
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") == "" || resp.Header.Get("Last-Modified") == "" {
+		t.Fatalf("stale If-Range: status %d, validators %q %q", resp.StatusCode, resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"))
+	}
+
+	// The unchanged date cannot tell the versions apart, so it is no validator
+	req.Header.Set("If-Range", resp.Header.Get("Last-Modified"))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil { t.Fatal(err) }
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("If-Range with Last-Modified: status %d", resp.StatusCode)
+	}
+
+	if _, err := client.Receive(u, out, false, ioutil.Discard); err != nil { t.Fatal(err) }
+	if b, _ := os.ReadFile(out); !bytes.Equal(b, v2) {
+		t.Fatal("received file splices two versions of the source")
+	}
+}
+
+// TestE2E_ArchiveResume verifies zip downloads have a length and resume
+// from a byte range, sealed or not.
+func TestE2E_ArchiveResume(t *testing.T) {
+	src := t.TempDir()
+	one := bytes.Repeat([]byte("first-file"), 300*1024) // 3MB
+	two := bytes.Repeat([]byte("other-file"), 300*1024)
+	os.WriteFile(filepath.Join(src, "one.bin"), one, 0o644)
+	os.MkdirAll(filepath.Join(src, "sub"), 0o755)
+	os.WriteFile(filepath.Join(src, "sub", "two.bin"), two, 0o644)
+
+	for _, sealed := range []bool{false, true} {
+		tok, _ := crypto.GenerateToken(nil)
+		srv := &server.Server{Token: tok, SrcPath: src, SrcPaths: []string{filepath.Join(src, "one.bin")}}
+		if sealed {
+			srv.Token, srv.Secret = crypto.SplitToken(tok)
+		}
+		u, err := srv.Start()
+		if err != nil { t.Fatal(err) }
+		defer srv.Shutdown()
+		base, frag, _ := strings.Cut(u, "#")
+		allURL := base + "/all"
+		if frag != "" {
+			allURL += "#" + frag
+		}
+
+		resp, err := http.Get(base + "/all")
+		if err != nil { t.Fatal(err) }
+		resp.Body.Close()
+		if resp.ContentLength <= 0 || resp.Header.Get("Accept-Ranges") != "bytes" {
+			t.Fatalf("sealed=%v: Content-Length %d, Accept-Ranges %q", sealed, resp.ContentLength, resp.Header.Get("Accept-Ranges"))
+		}
+
+		out := filepath.Join(t.TempDir(), "all.zip")
+		interruptedReceive(t, allURL, out, 4<<20)
+		if _, err := client.Receive(allURL, out, false, ioutil.Discard); err != nil { t.Fatal(err) }
+		zr, err := zip.OpenReader(out)
+		if err != nil { t.Fatalf("sealed=%v: %v", sealed, err) }
+		want := map[string][]byte{"one.bin": one, "sub/two.bin": two}
+		for _, f := range zr.File {
+			rc, err := f.Open()
+			if err != nil { t.Fatal(err) }
+			got, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil || !bytes.Equal(got, want[strings.TrimPrefix(f.Name, filepath.Base(src)+"/")]) {
+				t.Fatalf("sealed=%v: %s mismatch: %v", sealed, f.Name, err)
+			}
+		}
+		// Three files, the shared directory and sub/
+		if len(zr.File) != 5 {
+			t.Fatalf("sealed=%v: %d entries, want 5", sealed, len(zr.File))
+		}
+		zr.Close()
+	}
+}
+
+// TestE2E_ArchiveFormats verifies directory archive negotiation and that
+// tarballs keep modes, symlinks and mtimes.
+func TestE2E_ArchiveFormats(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "tools")
+	os.MkdirAll(filepath.Join(src, "bin"), 0o755)
+	os.WriteFile(filepath.Join(src, "bin", "run.sh"), []byte("#!/bin/sh\necho hi\n"), 0o755)
+	os.Symlink("bin/run.sh", filepath.Join(src, "run"))
+	mtime := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	os.Chtimes(filepath.Join(src, "bin", "run.sh"), mtime, mtime)
+
+	tok, _ := crypto.GenerateToken(nil)
+	srv := &server.Server{Token: tok, SrcPath: src, ArchiveFormat: protocol.FormatTarGz}
+	u, err := srv.Start()
+	if err != nil { t.Fatal(err) }
+	defer srv.Shutdown()
+
+	for _, tc := range []struct {
+		query, accept string
+		want          int
+		typ           string
+	}{
+		{"", "", http.StatusOK, "application/gzip"}, // the sender's default
+		{"", "application/x-tar", http.StatusOK, "application/x-tar"},
+		{"?format=zst", "application/x-tar", http.StatusOK, "application/zstd"},
+		{"?format=rar", "", http.StatusBadRequest, ""},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, u+tc.query, nil)
+		if tc.accept != "" {
+			req.Header.Set("Accept", tc.accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil { t.Fatal(err) }
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.want || (tc.typ != "" && resp.Header.Get("Content-Type") != tc.typ) {
+			t.Fatalf("%s with Accept %q: status %d, type %q", tc.query, tc.accept, resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+	}
+
+	for _, format := range []string{protocol.FormatTar, protocol.FormatTarGz, protocol.FormatTarZst} {
+		out, err := client.ReceiveArchive(u, format, filepath.Join(t.TempDir(), "tools"+protocol.ArchiveExtensions[format]), false, ioutil.Discard)
+		if err != nil { t.Fatalf("%s: %v", format, err) }
+		f, err := os.Open(out)
+		if err != nil { t.Fatal(err) }
+		var r io.Reader = f
+		switch format {
+		case protocol.FormatTarGz:
+			if r, err = gzip.NewReader(f); err != nil { t.Fatal(err) }
+		case protocol.FormatTarZst:
+			if r, err = zstd.NewReader(f); err != nil { t.Fatal(err) }
+		}
+		seen := map[string]*tar.Header{}
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil { t.Fatalf("%s: %v", format, err) }
+			seen[hdr.Name] = hdr
+		}
+		f.Close()
+		run := seen["tools/bin/run.sh"]
+		if run == nil || run.FileInfo().Mode().Perm() != 0o755 || !run.ModTime.Equal(mtime) {
+			t.Fatalf("%s: run.sh header %+v", format, run)
+		}
+		if link := seen["tools/run"]; link == nil || link.Typeflag != tar.TypeSymlink || link.Linkname != "bin/run.sh" {
+			t.Fatalf("%s: symlink header %+v", format, link)
+		}
+		if dir := seen["tools/bin/"]; dir == nil || dir.Typeflag != tar.TypeDir {
+			t.Fatalf("%s: missing directory entry", format)
+		}
+	}
+}
+
+// TestE2E_DownloadLimit verifies a one-shot share counts an interrupted and
+// resumed receive once, then stops itself.
+func TestE2E_DownloadLimit(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "secret.env")
+	data := bytes.Repeat([]byte("TOKEN=abcdef\n"), 400*1024) // 5MB
+	os.WriteFile(src, data, 0o600)
+
+	tok, _ := crypto.GenerateToken(nil)
+	srv := &server.Server{Token: tok, SrcPath: src, MaxDownloads: 1}
+	url, err := srv.Start()
+	if err != nil { t.Fatal(err) }
+	defer srv.Shutdown()
+
+	out := filepath.Join(t.TempDir(), "secret.env")
+	interruptedReceive(t, url, out, 2<<20)
+	select {
+	case <-srv.Done():
+		t.Fatal("share closed before the download completed")
+	default:
+	}
+	if _, err := client.Receive(url, out, false, ioutil.Discard); err != nil { t.Fatal(err) }
+	if b, _ := os.ReadFile(out); !bytes.Equal(b, data) {
+		t.Fatalf("download mismatch (got %d bytes)", len(b))
+	}
+	// The receiver that finished can't fetch it again while the share lingers
+	if _, err := client.Receive(url, filepath.Join(t.TempDir(), "again.env"), false, ioutil.Discard); err == nil {
+		t.Fatal("finished receiver downloaded the share again")
+	}
+
+	select {
+	case <-srv.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("share still open after its last download")
+	}
+	if !errors.Is(srv.Err(), server.ErrDownloadLimit) {
+		t.Fatalf("Err() = %v, want ErrDownloadLimit", srv.Err())
+	}
+	if _, err := client.Receive(url, filepath.Join(t.TempDir(), "again.env"), false, ioutil.Discard); err == nil {
+		t.Fatal("share served a download past its limit")
+	}
+}
+
+// TestE2E_DownloadLimitTarball verifies a --once directory share sent as a
+// tarball, which streams without ranges, counts only the real download.
+func TestE2E_DownloadLimitTarball(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "tools")
+	os.MkdirAll(dir, 0o755)
+	os.WriteFile(filepath.Join(dir, "run.sh"), []byte("#!/bin/sh\necho hi\n"), 0o755)
+
+	tok, _ := crypto.GenerateToken(nil)
+	srv := &server.Server{Token: tok, SrcPath: dir, MaxDownloads: 1}
+	url, err := srv.Start()
+	if err != nil { t.Fatal(err) }
+	defer srv.Shutdown()
+
+	out := filepath.Join(t.TempDir(), "tools.tar")
+	if _, err := client.ReceiveArchive(url, protocol.FormatTar, out, false, ioutil.Discard); err != nil { t.Fatal(err) }
+	f, err := os.Open(out)
+	if err != nil { t.Fatal(err) }
+	defer f.Close()
+	tr := tar.NewReader(f)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil { t.Fatal(err) }
+		names = append(names, hdr.Name)
+	}
+	if len(names) != 2 || names[1] != "tools/run.sh" {
+		t.Fatalf("tarball holds %v", names)
+	}
+	select {
+	case <-srv.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("share still open after its one download")
+	}
+	if !errors.Is(srv.Err(), server.ErrDownloadLimit) {
+		t.Fatalf("Err() = %v, want ErrDownloadLimit", srv.Err())
+	}
+}
+
+// TestE2E_ShareExpiry verifies a share stops itself once it expires.
+func TestE2E_ShareExpiry(t *testing.T) {
+	tok, _ := crypto.GenerateToken(nil)
+	srv := &server.Server{Token: tok, TextContent: "short-lived", Expire: 300 * time.Millisecond}
+	url, err := srv.Start()
+	if err != nil { t.Fatal(err) }
+	defer srv.Shutdown()
+
+	resp, err := http.Get(url)
+	if err != nil { t.Fatal(err) }
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d before expiry", resp.StatusCode)
+	}
+	select {
+	case <-srv.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("share still open after it expired")
+	}
+	if !errors.Is(srv.Err(), server.ErrExpired) {
+		t.Fatalf("Err() = %v, want ErrExpired", srv.Err())
+	}
+}
+
+// TestE2E_GracefulDrain verifies Drain refuses new connections but lets a
+// download in flight finish, and cuts it once its context is done.
+func TestE2E_GracefulDrain(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "big.bin")
+	data := make([]byte, 8<<20)
+	rand.Read(data)
+	os.WriteFile(src, data, 0o644)
+
+	for _, stalled := range []bool{false, true} {
+		tok, _ := crypto.GenerateToken(nil)
+		srv := &server.Server{Token: tok, SrcPath: src}
+		url, err := srv.Start()
+		if err != nil { t.Fatal(err) }
+		defer srv.Shutdown()
+
+		resp, err := http.Get(url)
+		if err != nil { t.Fatal(err) }
+		defer resp.Body.Close()
+		head := make([]byte, 1<<10)
+		if _, err := io.ReadFull(resp.Body, head); err != nil { t.Fatal(err) }
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if stalled {
+			ctx, cancel = context.WithTimeout(context.Background(), 300*time.Millisecond)
+		}
+		defer cancel()
+		drained := make(chan error, 1)
+		go func() { drained <- srv.Drain(ctx) }()
+
+		fresh := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, Timeout: 2 * time.Second}
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			r, err := fresh.Get(url)
+			if err != nil { break }
+			r.Body.Close()
+			if time.Now().After(deadline) { t.Fatalf("stalled=%v: new requests still served while draining", stalled) }
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if stalled {
+			if err := <-drained; !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("Drain() = %v, want DeadlineExceeded", err)
+			}
+			if _, err := io.ReadAll(resp.Body); err == nil {
+				t.Fatal("stalled download survived the drain timeout")
+			}
+			continue
+		}
+		rest, err := io.ReadAll(resp.Body)
+		if err != nil { t.Fatal(err) }
+		if !bytes.Equal(append(head, rest...), data) {
+			t.Fatalf("download mismatch after drain (got %d bytes)", len(head)+len(rest))
+		}
+		if err := <-drained; err != nil { t.Fatalf("Drain() = %v", err) }
+		select {
+		case <-srv.Done():
+		default:
+			t.Fatal("Done not closed after Drain")
+		}
+		if srv.Err() != nil { t.Fatalf("Err() = %v after Drain", srv.Err()) }
+	}
+}
+
+// TestE2E_TransferProgress verifies the sender's view of a receive that was
+// interrupted and resumed, and the host's view of an upload.
+func TestE2E_TransferProgress(t *testing.T) {
+	data := bytes.Repeat([]byte("progress-"), 600*1024) // ~5.3MB
+	src := filepath.Join(t.TempDir(), "report.bin")
+	os.WriteFile(src, data, 0o644)
+
+	tok, _ := crypto.GenerateToken(nil)
+	srv := &server.Server{Token: tok, SrcPath: src}
+	u, err := srv.Start()
+	if err != nil { t.Fatal(err) }
+	defer srv.Shutdown()
+	out := filepath.Join(t.TempDir(), "report.bin")
+	interruptedReceive(t, u, out, 1<<20)
+	if _, err := client.Receive(u, out, false, ioutil.Discard); err != nil { t.Fatal(err) }
+
+	ts := srv.Transfers()
+	if len(ts) != 1 {
+		t.Fatalf("%d transfers, want 1: %+v", len(ts), ts)
+	}
+	tr := ts[0]
+	if tr.Name != "report.bin" || tr.Upload || tr.Peer == "" || tr.UserAgent == "" {
+		t.Fatalf("unexpected transfer %+v", tr)
+	}
+	if !tr.Done || tr.Active || tr.Size != int64(len(data)) || tr.Bytes != tr.Size || tr.Moved < tr.Size || tr.Rate() <= 0 {
+		t.Fatalf("resumed receive not complete: %+v", tr)
+	}
+
+	host := &server.Server{Token: tok, HostMode: true, UploadDir: t.TempDir()}
+	hu, err := host.Start()
+	if err != nil { t.Fatal(err) }
+	defer host.Shutdown()
+	if err := client.Upload(hu, src, ioutil.Discard); err != nil { t.Fatal(err) }
+	ts = host.Transfers()
+	if len(ts) != 1 || !ts[0].Upload || !ts[0].Done || ts[0].Name != "report.bin" || ts[0].Bytes != int64(len(data)) {
+		t.Fatalf("unexpected upload transfers %+v", ts)
+	}
+}
+
+// reportRecorder keeps the last figures a receive reported, and the text
+// of a text share.
+type reportRecorder struct {
+	bytes.Buffer
+	calls       int
+	read, total int64
+	text        bytes.Buffer
+}
+
+func (r *reportRecorder) TextOutput() io.Writer { return &r.text }
+
+func (r *reportRecorder) ReportProgress(read, total int64, elapsed time.Duration) {
+	r.calls++
+	r.read, r.total = read, total
+}
+
+func TestE2E_ProgressReporter(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "payload.bin")
+	data := make([]byte, 3<<20)
+	rand.Read(data)
+	if err := os.WriteFile(src, data, 0o644); err != nil { t.Fatal(err) }
+	tok, _ := crypto.GenerateToken(nil)
+	srv := &server.Server{Token: tok, SrcPath: src}
+	url, err := srv.Start()
+	if err != nil { t.Fatal(err) }
+	defer srv.Shutdown()
+
+	// Reporters get figures instead of a rendered bar
+	rec := new(reportRecorder)
+	if _, err := client.Receive(url, filepath.Join(dir, "out.bin"), true, rec); err != nil { t.Fatal(err) }
+	if rec.calls == 0 || rec.read != int64(len(data)) || rec.total != int64(len(data)) {
+		t.Fatalf("reported %d/%d over %d calls, want %d", rec.read, rec.total, rec.calls, len(data))
+	}
+	if rec.Len() != 0 {
+		t.Fatalf("a bar was written to the reporter: %q", rec.String())
+	}
+
+	// Text shares go to the reporter's text output, not os.Stdout
+	tok2, _ := crypto.GenerateToken(nil)
+	textSrv := &server.Server{Token: tok2, TextContent: "for the pipeline"}
+	textURL, err := textSrv.Start()
+	if err != nil { t.Fatal(err) }
+	defer textSrv.Shutdown()
+	if _, err := client.Receive(textURL, "", false, rec); err != nil { t.Fatal(err) }
+	if rec.text.String() != "for the pipeline" {
+		t.Fatalf("got text %q", rec.text.String())
+	}
+}
+
+func TestE2E_ReceiveToWriter(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.bin")
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	if err := os.WriteFile(a, []byte("first"), 0o644); err != nil { t.Fatal(err) }
+	if err := os.WriteFile(b, data, 0o644); err != nil { t.Fatal(err) }
+
+	// A file streams as is, with progress on its own writer
+	tok, _ := crypto.GenerateToken(nil)
+	srv := &server.Server{Token: tok, SrcPath: b}
+	url, err := srv.Start()
+	if err != nil { t.Fatal(err) }
+	defer srv.Shutdown()
+	var got, progress bytes.Buffer
+	name, err := client.ReceiveTo(url, &got, &progress)
+	if err != nil { t.Fatal(err) }
+	if name != "b.bin" || !bytes.Equal(got.Bytes(), data) {
+		t.Fatalf("got %q with %d bytes", name, got.Len())
+	}
+	if !strings.Contains(progress.String(), "100%") {
+		t.Fatalf("progress = %q", progress.String())
+	}
+
+	// Text streams as is, without progress
+	tok, _ = crypto.GenerateToken(nil)
+	textSrv := &server.Server{Token: tok, TextContent: "piped text"}
+	url, err = textSrv.Start()
+	if err != nil { t.Fatal(err) }
+	defer textSrv.Shutdown()
+	got.Reset()
+	progress.Reset()
+	if name, err = client.ReceiveTo(url, &got, &progress); err != nil { t.Fatal(err) }
+	if name != "" || got.String() != "piped text" || progress.Len() != 0 {
+		t.Fatalf("got %q %q, progress %q", name, got.String(), progress.String())
+	}
+
+	// A multi-item share streams as one archive of everything, encrypted
+	// or not
+	for _, encrypt := range []bool{false, true} {
+		tok, _ = crypto.GenerateToken(nil)
+		pathTok, secret := tok, ""
+		if encrypt {
+			pathTok, secret = crypto.SplitToken(tok)
+		}
+		multi := &server.Server{Token: pathTok, Secret: secret, SrcPath: a, SrcPaths: []string{b}}
+		url, err = multi.Start()
+		if err != nil { t.Fatal(err) }
+		defer multi.Shutdown()
+		got.Reset()
+		if name, err = client.ReceiveArchiveTo(url, protocol.FormatZip, &got, nil); err != nil { t.Fatal(err) }
+		zr, err := zip.NewReader(bytes.NewReader(got.Bytes()), int64(got.Len()))
+		if err != nil { t.Fatalf("encrypt=%v: %s is no zip: %v", encrypt, name, err) }
+		var names []string
+		for _, f := range zr.File {
+			names = append(names, f.Name)
+		}
+		if strings.Join(names, ",") != "a.txt,b.bin" {
+			t.Fatalf("encrypt=%v: zip holds %v", encrypt, names)
+		}
+	}
 }